@@ -0,0 +1,415 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"nginx_configure/common"
+	"nginx_configure/management/doctor"
+	"nginx_configure/management/health"
+	"nginx_configure/management/nginx"
+	"nginx_configure/management/pki"
+	"nginx_configure/model"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: nginx_configure [command]
+
+Without a command the interactive menu is started (requires root).
+
+Commands:
+  doctor    check this host for problems and suggest fixes
+  upstream list <site>
+            print the upstream servers of a site
+  upstream drain|enable|backup|primary|remove <site> [-upstream <name>] <server>
+            mark a server down or up, make it a backup or primary server,
+            or remove it, then reload nginx gracefully; -upstream picks the
+            upstream when the server is in several
+  upstream add <site> [-upstream <name>] "<server> [options]"
+            add a server, e.g. "10.0.0.5:8000 weight=2", to the first
+            upstream of the site or the named one
+  upstream check <site> [-path /healthz] [-status 200] [-watch 5s]
+            probe every upstream server and exit non-zero when one is down
+  tls upgrade <from> <to>
+            move every SSL site from one TLS profile (modern, intermediate,
+            old, or none) to another
+  ca issue <name> [-days 365] [-password-file <file>|-]
+            issue a client certificate from the private CA as a PKCS#12
+            file, a password is generated unless it is read from the first
+            line of a file or, with -, from stdin
+  htpasswd set <file> <user> [-password-file <file>|-]
+            add a basic auth user to /etc/nginx/htpasswd/<file> or rotate
+            their password (bcrypt), a password is generated unless it is
+            read as for ca issue
+  htpasswd remove <file> <user>
+            remove a basic auth user
+  htpasswd list <file>
+            print the users of an htpasswd file
+  cert import <name> <cert-file> <key-file>
+            copy a PEM certificate and its key into /etc/ssl/files, e.g. a
+            Cloudflare Origin CA certificate
+  cdn refresh [cloudflare]
+            download the published ranges of a CDN, render the sites behind
+            it again and move their firewall rules to the new ranges`
+
+// runCommand runs a subcommand and returns the process exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "doctor":
+		return runDoctor()
+	case "upstream":
+		return runUpstream(args[1:])
+	case "tls":
+		return runTLS(args[1:])
+	case "ca":
+		return runCA(args[1:])
+	case "htpasswd":
+		return runHtpasswd(args[1:])
+	case "cdn":
+		return runCDN(args[1:])
+	case "cert":
+		return runCert(args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return 0
+	}
+	common.ColoredText("31", "Unknown command: "+args[0])
+	fmt.Println(usage)
+	return 2
+}
+
+// runDoctor prints every finding and exits non-zero when a check failed.
+func runDoctor() int {
+	findings := doctor.Run(common.ConfigsBasePath)
+	for _, f := range findings {
+		color := "32"
+		switch f.Status {
+		case doctor.Warn:
+			color = "33"
+		case doctor.Fail:
+			color = "31"
+		}
+		common.ColoredText(color, fmt.Sprintf("[%s] %-12s %s", f.Status, f.Check, f.Detail))
+		if f.Fix != "" && f.Status != doctor.OK {
+			fmt.Println("       fix: " + f.Fix)
+		}
+	}
+	if doctor.Failed(findings) {
+		return 1
+	}
+	return 0
+}
+
+// runUpstream lists or changes the upstream servers of a site.
+func runUpstream(args []string) int {
+	if len(args) < 2 {
+		fmt.Println(usage)
+		return 2
+	}
+	change, site := args[0], args[1]
+
+	if change == "list" {
+		blocks, err := nginx.ReadUpstreams(nginx.ConfigPath(common.ConfigsBasePath, site))
+		if err != nil {
+			common.ColoredText("31", err.Error())
+			return 1
+		}
+		for _, block := range blocks {
+			for _, server := range block.Servers {
+				fmt.Println(block.Name + ": " + nginx.FormatUpstreamServer(server))
+			}
+		}
+		return 0
+	}
+
+	if change == "check" {
+		return runUpstreamCheck(site, args[2:])
+	}
+
+	flags := flag.NewFlagSet("upstream "+change, flag.ContinueOnError)
+	block := flags.String("upstream", "", "name of the upstream block, as shown by upstream list")
+	if err := flags.Parse(args[2:]); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		fmt.Println(usage)
+		return 2
+	}
+	switch change {
+	case nginx.UpstreamDrain, nginx.UpstreamEnable, nginx.UpstreamBackup, nginx.UpstreamPrimary, nginx.UpstreamRemove, nginx.UpstreamAdd:
+	default:
+		common.ColoredText("31", "Unknown upstream change: "+change)
+		fmt.Println(usage)
+		return 2
+	}
+	if os.Geteuid() != 0 {
+		common.ColoredText("31", "Please run as root (sudo).")
+		return 1
+	}
+
+	out, err := nginx.ChangeUpstreamServer(common.ConfigsBasePath, site, *block, change, strings.Join(flags.Args(), " "))
+	for _, line := range out {
+		fmt.Println(line)
+	}
+	if err != nil {
+		common.ColoredText("31", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// runUpstreamCheck probes the upstream servers of a site. Without -path the
+// HTTP check stored with the site is used.
+func runUpstreamCheck(site string, args []string) int {
+	flags := flag.NewFlagSet("upstream check", flag.ContinueOnError)
+	path := flags.String("path", "", "HTTP path to request after the connect succeeds")
+	status := flags.Int("status", 0, "expected HTTP status, 0 accepts any 2xx or 3xx")
+	watch := flags.Duration("watch", 0, "probe again after this interval until interrupted")
+	timeout := flags.Duration("timeout", 3*time.Second, "timeout of each probe")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var check *model.HealthCheck
+	if *path != "" {
+		spec := *path
+		if *status != 0 {
+			spec += " " + strconv.Itoa(*status)
+		}
+		parsed, err := health.ParseCheck(spec)
+		if err != nil {
+			common.ColoredText("31", err.Error())
+			return 2
+		}
+		check = &parsed
+	}
+
+	checker := health.Checker{Timeout: *timeout}
+	for {
+		results, err := checker.CheckSite(common.ConfigsBasePath, site, check)
+		if err != nil {
+			common.ColoredText("31", err.Error())
+			return 1
+		}
+		if *watch > 0 {
+			fmt.Println(time.Now().Format(time.TimeOnly))
+		}
+		fmt.Print(health.Table(results))
+		if *watch <= 0 {
+			if health.AnyDown(results) {
+				return 1
+			}
+			return 0
+		}
+		time.Sleep(*watch)
+		fmt.Println()
+	}
+}
+
+// runTLS changes the TLS profile of the stored SSL sites.
+func runTLS(args []string) int {
+	if len(args) != 3 || args[0] != "upgrade" {
+		fmt.Println(usage)
+		return 2
+	}
+	from, to := args[1], args[2]
+	if from == "none" {
+		from = ""
+	}
+	if os.Geteuid() != 0 {
+		common.ColoredText("31", "Please run as root (sudo).")
+		return 1
+	}
+
+	out, err := nginx.UpgradeTLSProfiles(common.ConfigsBasePath, common.CertBasePath+"/", from, to)
+	for _, line := range out {
+		fmt.Println(line)
+	}
+	if err != nil {
+		common.ColoredText("31", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// runCert imports certificates.
+func runCert(args []string) int {
+	if len(args) != 4 || args[0] != "import" {
+		fmt.Println(usage)
+		return 2
+	}
+	if os.Geteuid() != 0 {
+		common.ColoredText("31", "Please run as root (sudo).")
+		return 1
+	}
+
+	cert, err := nginx.ImportCert(common.CertBasePath+"/", args[1], args[2], args[3])
+	if err != nil {
+		common.ColoredText("31", err.Error())
+		return 1
+	}
+	fmt.Println("Imported " + common.CertBasePath + "/" + cert.Name + ".crt and " + cert.Name + ".key")
+	fmt.Println(cert.KeyType + " | Domains: " + strings.Join(cert.Domains, ", ") + " | valid until " + cert.NotAfter.Format("2006-01-02"))
+	if cert.OriginCA {
+		for _, line := range nginx.OriginCAWarning(cert.Name) {
+			common.ColoredText("33", line)
+		}
+	}
+	return 0
+}
+
+// runCDN refreshes the address ranges of a CDN.
+func runCDN(args []string) int {
+	if len(args) < 1 || len(args) > 2 || args[0] != "refresh" {
+		fmt.Println(usage)
+		return 2
+	}
+	name := "cloudflare"
+	if len(args) == 2 {
+		name = args[1]
+	}
+	if os.Geteuid() != 0 {
+		common.ColoredText("31", "Please run as root (sudo).")
+		return 1
+	}
+
+	out, err := nginx.RefreshCDN(common.ConfigsBasePath, common.CertBasePath+"/", name)
+	for _, line := range out {
+		fmt.Println(line)
+	}
+	if err != nil {
+		common.ColoredText("31", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// runCA issues client certificates from the private CA.
+func runCA(args []string) int {
+	if len(args) < 2 || args[0] != "issue" {
+		fmt.Println(usage)
+		return 2
+	}
+	flags := flag.NewFlagSet("ca issue", flag.ContinueOnError)
+	days := flags.Int("days", 365, "days the certificate is valid")
+	passwordFile := flags.String("password-file", "", "file holding the password of the PKCS#12 file, - for stdin, generated when empty")
+	if err := flags.Parse(args[2:]); err != nil {
+		return 2
+	}
+	password, err := readPassword(*passwordFile)
+	if err != nil {
+		common.ColoredText("31", err.Error())
+		return 1
+	}
+	if os.Geteuid() != 0 {
+		common.ColoredText("31", "Please run as root (sudo).")
+		return 1
+	}
+
+	client, err := pki.IssueClient(args[1], *days, password)
+	if err != nil {
+		common.ColoredText("31", err.Error())
+		return 1
+	}
+	fmt.Println("PKCS#12 bundle: " + client.Path)
+	if password == "" {
+		fmt.Println("Password: " + client.Password)
+	}
+	fmt.Println("Serial: " + client.Serial + ", valid until " + client.NotAfter.Format("2006-01-02"))
+	fmt.Println("CA certificate: " + pki.CACertPath)
+	return 0
+}
+
+// runHtpasswd manages the users of the htpasswd files used for basic auth.
+func runHtpasswd(args []string) int {
+	if len(args) < 2 {
+		fmt.Println(usage)
+		return 2
+	}
+	change, file := args[0], args[1]
+	if change == "list" {
+		users, err := pki.Users(file)
+		if err != nil {
+			common.ColoredText("31", err.Error())
+			return 1
+		}
+		for _, user := range users {
+			fmt.Println(user)
+		}
+		return 0
+	}
+
+	if len(args) < 3 || (change != "set" && change != "remove") {
+		fmt.Println(usage)
+		return 2
+	}
+	flags := flag.NewFlagSet("htpasswd "+change, flag.ContinueOnError)
+	passwordFile := flags.String("password-file", "", "file holding the password of the user, - for stdin, generated when empty")
+	if err := flags.Parse(args[3:]); err != nil {
+		return 2
+	}
+	password, err := readPassword(*passwordFile)
+	if err != nil {
+		common.ColoredText("31", err.Error())
+		return 1
+	}
+	if os.Geteuid() != 0 {
+		common.ColoredText("31", "Please run as root (sudo).")
+		return 1
+	}
+
+	user := args[2]
+	if change == "remove" {
+		if err := pki.RemoveUser(file, user); err != nil {
+			common.ColoredText("31", err.Error())
+			return 1
+		}
+		fmt.Println("Removed " + user + " from " + pki.HtpasswdPath(file))
+		return 0
+	}
+	generated, created, err := pki.SetUser(file, user, password)
+	if err != nil {
+		common.ColoredText("31", err.Error())
+		return 1
+	}
+	if created {
+		fmt.Println("Added " + user + " to " + pki.HtpasswdPath(file))
+	} else {
+		fmt.Println("Changed the password of " + user + " in " + pki.HtpasswdPath(file))
+	}
+	if password == "" {
+		fmt.Println("Password: " + generated)
+	}
+	return 0
+}
+
+// readPassword reads a password from the first line of path, or of stdin when
+// path is -, so it does not show up in the process list. An empty path
+// returns "" to have one generated.
+func readPassword(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	password := strings.TrimSuffix(line, "\r")
+	if password == "" {
+		if path == "-" {
+			return "", fmt.Errorf("no password found on stdin")
+		}
+		return "", fmt.Errorf("no password found in %s", path)
+	}
+	return password, nil
+}
@@ -1,14 +1,18 @@
 package common
 
 import (
+	"archive/tar"
 	"bufio"
+	"compress/gzip"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	tea "github.com/charmbracelet/bubbletea"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -23,14 +27,15 @@ const (
 	Red = "#FF6F61"
 )
 
-// FixDpkgLock attempts to kill process 8001 and run dpkg --configure -a.
-func FixDpkgLock() error {
-	ColoredText("36", "Fix the dpkg lock")
-	if err := RunCommand("sudo kill 8001"); err != nil {
-		ColoredText("31", "Failed to kill process 8001: "+err.Error())
-	}
-	return RunCommand("dpkg --configure -a")
-}
+// ConfigsBasePath is where nginx picks up the generated site configs.
+const ConfigsBasePath = "/etc/nginx/conf.d/"
+
+// NginxConfPath is the main nginx config, read for the user workers run as and
+// extended with the includes of the stream proxies and limit zones.
+const NginxConfPath = "/etc/nginx/nginx.conf"
+
+// StateBasePath holds the files this tool keeps about its own installs and sites.
+const StateBasePath = "/etc/nginx_configure"
 
 // ClearCache mimics cache clearing by removing a file.
 func ClearCache() {
@@ -40,7 +45,7 @@ func ClearCache() {
 
 // ColoredText prints the given text in a terminal color (using ANSI escape codes).
 func ColoredText(color, text string) {
-	tea.Printf("\033[%sm%s\033[0m\n", color, text)
+	fmt.Printf("\033[%sm%s\033[0m\n", color, text)
 }
 
 // FindKeyByValue searches a map for a value and returns its key.
@@ -61,11 +66,14 @@ func GetValues(assocMap map[string]string) []string {
 	return assoc
 }
 
+// ExtractKeys returns the keys of a map in sorted order, so lists built from
+// it and GetKeyByIndex agree on the position of every key.
 func ExtractKeys(assocMap map[string]string) []string {
 	var assoc []string
 	for k, _ := range assocMap {
 		assoc = append(assoc, k)
 	}
+	sort.Strings(assoc)
 	return assoc
 }
 
@@ -155,6 +163,91 @@ func RunCommandWithLogs(cmd string) tea.Cmd {
 	}
 }
 
+// RunCommandOutput runs cmd with bash and returns its combined output split into lines.
+func RunCommandOutput(cmd string) ([]string, error) {
+	out, err := exec.Command("bash", "-c", cmd).CombinedOutput()
+	text := strings.TrimSpace(string(out))
+	if text == "" {
+		return nil, err
+	}
+	return strings.Split(text, "\n"), err
+}
+
+// RunCommandsOutput runs the commands in order with RunCommandOutput and stops
+// at the first one that fails.
+func RunCommandsOutput(cmds []string) ([]string, error) {
+	var out []string
+	for _, cmd := range cmds {
+		lines, err := RunCommandOutput(cmd)
+		out = append(out, lines...)
+		if err != nil {
+			return out, fmt.Errorf("%s failed: %v", cmd, err)
+		}
+	}
+	return out, nil
+}
+
+// Step is one unit of work in a flow run by RunSteps.
+type Step struct {
+	Title string
+	Run   func() ([]string, error)
+	// IgnoreError logs a failure of this step but keeps running the next ones.
+	IgnoreError bool
+}
+
+// CommandStep returns a Step that runs cmd with bash.
+func CommandStep(title string, cmd string) Step {
+	return Step{Title: title, Run: func() ([]string, error) { return RunCommandOutput(cmd) }}
+}
+
+// RunSteps runs the steps in order and logs their output. The first failing
+// step stops the flow, so done is only logged when every step succeeded.
+func RunSteps(steps []Step, done string) tea.Cmd {
+	return RunStepsWithReport(steps, func(failed string) LogData {
+		if failed != "" {
+			return CreateSingleLog("Stopped after a failed step: "+failed+" Nothing after it was run.", Red)
+		}
+		return CreateSingleLog(done, Green)
+	})
+}
+
+// RunStepsWithReport works like RunSteps but ends with the LogData built by
+// report, which receives the title of the failed step or "" on success.
+func RunStepsWithReport(steps []Step, report func(failed string) LogData) tea.Cmd {
+	failed := ""
+	var cmds []tea.Cmd
+	for _, step := range steps {
+		cmds = append(cmds,
+			func() tea.Msg {
+				if failed != "" {
+					return nil
+				}
+				return CreateSingleLog(step.Title, Gold)
+			},
+			func() tea.Msg {
+				if failed != "" {
+					return nil
+				}
+				out, err := step.Run()
+				logs := CreateLogItems(out, White)
+				if err != nil {
+					if step.IgnoreError {
+						logs = append(logs, LogItem{Msg: "⚠ " + err.Error() + " (ignored)", Color: Gold})
+					} else {
+						failed = step.Title
+						logs = append(logs, LogItem{Msg: "❌ " + err.Error(), Color: Red})
+					}
+				}
+				return LogData{Messages: logs}
+			},
+		)
+	}
+	cmds = append(cmds, func() tea.Msg {
+		return report(failed)
+	})
+	return tea.Sequence(cmds...)
+}
+
 func RunCommand(cmd string) error {
 	command := exec.Command("bash", "-c", cmd)
 	if err := command.Run(); err != nil {
@@ -198,10 +291,40 @@ func Certificates(certBasePath string) (map[string]string, LogData) {
 		}
 		domainStr := strings.Join(domains, ", ")
 		assoc[baseName] = fmt.Sprintf("Cert: %s | Key: %s | Domains: %s", certFile, keyFile, domainStr)
+		if OriginCA(cert) {
+			assoc[baseName] += " | " + OriginCALabel
+		}
 	}
 	return assoc, LogData{}
 }
 
+// OriginCALabel marks certificates issued by the Cloudflare Origin CA.
+const OriginCALabel = "Cloudflare Origin CA, not publicly trusted"
+
+// OriginCA reports whether a certificate was issued by the Cloudflare Origin
+// CA. Only Cloudflare trusts it, browsers connecting directly reject it.
+func OriginCA(certPath string) bool {
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(certData)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	for _, unit := range cert.Issuer.OrganizationalUnit {
+		// "CloudFlare Origin SSL Certificate Authority" and its ECC counterpart.
+		if strings.HasPrefix(strings.ToLower(unit), "cloudflare origin ssl") {
+			return true
+		}
+	}
+	return false
+}
+
 func ExtractDomains(certPath string) ([]string, error) {
 	certData, err := os.ReadFile(certPath)
 	if err != nil {
@@ -225,6 +348,85 @@ func ExtractDomains(certPath string) ([]string, error) {
 	return domains, nil
 }
 
+// WriteTarGz archives the given directories into a gzip compressed tarball at
+// dest. Entries are stored relative to / so `tar -xzf dest -C /` restores them.
+func WriteTarGz(dest string, dirs ...string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	for _, dir := range dirs {
+		if !FileExists(dir) {
+			continue
+		}
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+			header, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			header.Name = strings.TrimPrefix(path, "/")
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			src, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			_, err = io.Copy(tw, src)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// OSRelease parses /etc/os-release into a map, e.g. ID=ubuntu, VERSION_CODENAME=jammy.
+func OSRelease() (map[string]string, error) {
+	data, err := os.ReadFile("/etc/os-release")
+	if err != nil {
+		return nil, err
+	}
+	release := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		release[key] = strings.Trim(value, `"'`)
+	}
+	return release, nil
+}
+
 // FileExists returns true if the file at path exists.
 func FileExists(path string) bool {
 	_, err := os.Stat(path)
@@ -532,26 +734,6 @@ func deleteAllCertificates() {
 	}
 }
 
-// --------------------
-// Install/Uninstall Requirements
-// --------------------
-
-// installRequirements installs both nginx and ufw.
-func installRequirements() {
-	ColoredText("32", "Updating package list...")
-	_ = RunCommand("apt-get update -y")
-	ColoredText("32", "Installing nginx...")
-	_ = RunCommand("apt-get install nginx -y")
-	ColoredText("32", "Installing firewall...")
-	_ = RunCommand("apt-get install -y ufw")
-}
-
-// uninstallEverything calls the uninstallation routines.
-func uninstallEverything() {
-	uninstallFirewall()
-	deleteAllCertificates()
-}
-
 // confirmPrompt asks for a yes/no confirmation.
 func confirmPrompt(message string) bool {
 	ColoredText("94", message+" (yes/y to confirm, no/n to cancel):")
@@ -32,6 +32,8 @@ require (
 	github.com/charmbracelet/bubbles v0.20.0
 	github.com/charmbracelet/bubbletea v1.3.4
 	github.com/charmbracelet/lipgloss v1.0.0
+	golang.org/x/crypto v0.11.0
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
 require (
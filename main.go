@@ -7,6 +7,11 @@ import (
 )
 
 func main() {
+	// Subcommands such as `doctor` run without the TUI.
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	// Check if running as root.
 
 	if os.Geteuid() != 0 {
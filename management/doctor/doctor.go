@@ -0,0 +1,271 @@
+package doctor
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"nginx_configure/common"
+	"nginx_configure/management/dpkg"
+	"nginx_configure/management/nginx"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type Status int
+
+const (
+	OK Status = iota
+	Warn
+	Fail
+)
+
+func (s Status) String() string {
+	switch s {
+	case Warn:
+		return "WARN"
+	case Fail:
+		return "FAIL"
+	}
+	return "OK"
+}
+
+// Finding is the result of a single check together with a suggested fix.
+type Finding struct {
+	Check  string
+	Status Status
+	Detail string
+	Fix    string
+}
+
+// minFreeBytes is the free space below which package installs start to fail.
+const minFreeBytes = 1 << 30
+
+// Run performs every check against this host. Domains are read from the
+// server_name directives of the configs in configsBasePath.
+func Run(configsBasePath string) []Finding {
+	var findings []Finding
+	findings = append(findings, checkRoot(), checkDistro(), checkNginx(), checkUfw(), checkSystemd(), checkDpkgLock())
+	findings = append(findings, checkDisk("/"), checkDisk("/var"))
+	findings = append(findings, checkPort("80"), checkPort("443"))
+	findings = append(findings, checkDomains(configsBasePath)...)
+	findings = append(findings, checkClock())
+	return findings
+}
+
+// Problems returns the findings that are not OK.
+func Problems(findings []Finding) []Finding {
+	var problems []Finding
+	for _, f := range findings {
+		if f.Status != OK {
+			problems = append(problems, f)
+		}
+	}
+	return problems
+}
+
+// Failed reports whether any finding failed.
+func Failed(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Status == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+func checkRoot() Finding {
+	if os.Geteuid() != 0 {
+		return Finding{Check: "root", Status: Fail, Detail: "not running as root", Fix: "run again with sudo"}
+	}
+	return Finding{Check: "root", Status: OK, Detail: "running as root"}
+}
+
+func checkDistro() Finding {
+	release, err := common.OSRelease()
+	if err != nil {
+		return Finding{Check: "distro", Status: Warn, Detail: "cannot read /etc/os-release: " + err.Error(), Fix: "this tool targets Debian and Ubuntu"}
+	}
+	name := release["PRETTY_NAME"]
+	if name == "" {
+		name = release["ID"]
+	}
+	id := release["ID"]
+	if id != "ubuntu" && id != "debian" && !strings.Contains(release["ID_LIKE"], "debian") {
+		return Finding{Check: "distro", Status: Warn, Detail: name + " is not Debian based", Fix: "apt based installs will not work, manage packages by hand"}
+	}
+	return Finding{Check: "distro", Status: OK, Detail: name}
+}
+
+func checkNginx() Finding {
+	info := nginx.Inspect()
+	if info.Version == "" {
+		return Finding{Check: "nginx", Status: Warn, Detail: "nginx is not installed", Fix: "use Nginx Management > Install Nginx or Install Requirements"}
+	}
+	return Finding{Check: "nginx", Status: OK, Detail: "nginx " + info.Version}
+}
+
+func checkUfw() Finding {
+	if _, err := exec.LookPath("ufw"); err != nil {
+		return Finding{Check: "ufw", Status: Warn, Detail: "ufw is not installed", Fix: "use Install Requirements or apt-get install -y ufw"}
+	}
+	out, _ := exec.Command("ufw", "version").Output()
+	version := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+	status, _ := exec.Command("ufw", "status").Output()
+	if strings.Contains(string(status), "inactive") {
+		return Finding{Check: "ufw", Status: Warn, Detail: version + ", inactive", Fix: "ufw --force enable (make sure ssh is allowed first)"}
+	}
+	return Finding{Check: "ufw", Status: OK, Detail: version}
+}
+
+func checkSystemd() Finding {
+	// sd_booted(3): systemd is running if this directory exists.
+	if !common.FileExists("/run/systemd/system") {
+		return Finding{Check: "systemd", Status: Fail, Detail: "systemd is not running", Fix: "systemctl reload/enable will fail, use `nginx -s reload` or boot with systemd"}
+	}
+	return Finding{Check: "systemd", Status: OK, Detail: "systemd is running"}
+}
+
+func checkDpkgLock() Finding {
+	holders := dpkg.Holders()
+	if len(holders) == 0 {
+		return Finding{Check: "dpkg lock", Status: OK, Detail: "no dpkg or apt lock is held"}
+	}
+	var details []string
+	for _, h := range holders {
+		details = append(details, h.String())
+	}
+	return Finding{Check: "dpkg lock", Status: Warn, Detail: strings.Join(details, "; "), Fix: "wait for the holder (often unattended-upgrades) to finish before installing packages"}
+}
+
+func checkDisk(path string) Finding {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return Finding{Check: "disk " + path, Status: Warn, Detail: err.Error()}
+	}
+	free := stat.Bavail * uint64(stat.Bsize)
+	detail := fmt.Sprintf("%.1f GiB free", float64(free)/(1<<30))
+	if free < minFreeBytes {
+		return Finding{Check: "disk " + path, Status: Fail, Detail: detail, Fix: "free some space, e.g. apt-get clean and journalctl --vacuum-size=100M"}
+	}
+	return Finding{Check: "disk " + path, Status: OK, Detail: detail}
+}
+
+var ssUsers = regexp.MustCompile(`"([^"]+)",pid=(\d+)`)
+
+func checkPort(port string) Finding {
+	check := "port " + port
+	out, err := exec.Command("ss", "-Hltnp", "sport = :"+port).Output()
+	if err != nil {
+		return Finding{Check: check, Status: Warn, Detail: "cannot run ss: " + err.Error(), Fix: "apt-get install -y iproute2"}
+	}
+	text := strings.TrimSpace(string(out))
+	if text == "" {
+		return Finding{Check: check, Status: OK, Detail: "free"}
+	}
+
+	listeners := make(map[string]bool)
+	for _, match := range ssUsers.FindAllStringSubmatch(text, -1) {
+		listeners[match[1]+" (pid "+match[2]+")"] = true
+	}
+	var names []string
+	others := false
+	for name := range listeners {
+		names = append(names, name)
+		if !strings.HasPrefix(name, "nginx ") {
+			others = true
+		}
+	}
+	sort.Strings(names)
+
+	if others {
+		return Finding{Check: check, Status: Fail, Detail: "in use by " + strings.Join(names, ", "), Fix: "stop that service or choose another port for the site"}
+	}
+	if len(names) == 0 {
+		return Finding{Check: check, Status: Warn, Detail: "in use by an unknown process", Fix: "run as root to see the owner"}
+	}
+	return Finding{Check: check, Status: OK, Detail: "served by " + strings.Join(names, ", ")}
+}
+
+func checkDomains(configsBasePath string) []Finding {
+	var findings []Finding
+	for _, domain := range serverNames(configsBasePath) {
+		check := "dns " + domain
+		addrs, err := net.LookupHost(domain)
+		if err != nil {
+			findings = append(findings, Finding{Check: check, Status: Warn, Detail: "does not resolve", Fix: "add an A/AAAA record for " + domain + " pointing to this server"})
+			continue
+		}
+		findings = append(findings, Finding{Check: check, Status: OK, Detail: "resolves to " + strings.Join(addrs, ", ")})
+	}
+	return findings
+}
+
+// serverNames collects the host names used in server_name directives, skipping IPs, wildcards and "_".
+func serverNames(configsBasePath string) []string {
+	files, _ := filepath.Glob(filepath.Join(configsBasePath, "*.conf"))
+	seen := make(map[string]bool)
+	var names []string
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";"))
+			if len(fields) < 2 || fields[0] != "server_name" {
+				continue
+			}
+			for _, name := range fields[1:] {
+				if name == "_" || net.ParseIP(name) != nil || strings.ContainsAny(name, "*~") || seen[name] {
+					continue
+				}
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		_ = file.Close()
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkClock() Finding {
+	if out, err := exec.Command("timedatectl", "show", "-p", "NTPSynchronized", "--value").Output(); err == nil {
+		if strings.TrimSpace(string(out)) == "yes" {
+			return Finding{Check: "clock", Status: OK, Detail: "synchronized with NTP"}
+		}
+	}
+
+	// Not synced (or no timedatectl): compare against the Date header of a web server.
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Head("http://nginx.org")
+	if err != nil {
+		return Finding{Check: "clock", Status: Warn, Detail: "not NTP synchronized and no reference time reachable", Fix: "timedatectl set-ntp true"}
+	}
+	_ = resp.Body.Close()
+	remote, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return Finding{Check: "clock", Status: Warn, Detail: "not NTP synchronized", Fix: "timedatectl set-ntp true"}
+	}
+
+	skew := time.Since(remote).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	detail := fmt.Sprintf("not NTP synchronized, %s off", skew)
+	switch {
+	case skew > 5*time.Minute:
+		return Finding{Check: "clock", Status: Fail, Detail: detail, Fix: "TLS handshakes and certificate checks will fail, run timedatectl set-ntp true"}
+	case skew > 30*time.Second:
+		return Finding{Check: "clock", Status: Warn, Detail: detail, Fix: "timedatectl set-ntp true"}
+	}
+	return Finding{Check: "clock", Status: OK, Detail: detail}
+}
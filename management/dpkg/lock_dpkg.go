@@ -0,0 +1,158 @@
+package dpkg
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// LockFiles are the locks taken by dpkg and apt while they change the system.
+var LockFiles = []string{
+	"/var/lib/dpkg/lock-frontend",
+	"/var/lib/dpkg/lock",
+	"/var/lib/apt/lists/lock",
+	"/var/cache/apt/archives/lock",
+}
+
+// Holder is a process holding one of the LockFiles.
+type Holder struct {
+	Path    string
+	PID     int
+	Command string
+}
+
+func (h Holder) String() string {
+	if h.PID <= 0 {
+		return fmt.Sprintf("%s is locked by an unknown process", h.Path)
+	}
+	return fmt.Sprintf("%s is held by pid %d (%s)", h.Path, h.PID, h.Command)
+}
+
+// Holders returns who currently holds any of the LockFiles. dpkg and apt use
+// fcntl record locks, so F_GETLK tells us the owning pid without taking the lock.
+func Holders() []Holder {
+	var holders []Holder
+	for _, path := range LockFiles {
+		if holder, locked := holderOf(path); locked {
+			holders = append(holders, holder)
+		}
+	}
+	return holders
+}
+
+func holderOf(path string) (Holder, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Holder{}, false
+	}
+	defer file.Close()
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 0}
+	if err := syscall.FcntlFlock(file.Fd(), syscall.F_GETLK, &lock); err != nil {
+		return Holder{}, false
+	}
+	if lock.Type == syscall.F_UNLCK {
+		return Holder{}, false
+	}
+
+	pid := int(lock.Pid)
+	return Holder{Path: path, PID: pid, Command: processCommand(pid)}, true
+}
+
+// processCommand returns the command line of pid, or its name if the command line is empty.
+func processCommand(pid int) string {
+	if pid <= 0 {
+		return ""
+	}
+	proc := "/proc/" + strconv.Itoa(pid)
+	if cmdline, err := os.ReadFile(proc + "/cmdline"); err == nil && len(cmdline) > 0 {
+		return strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+	if comm, err := os.ReadFile(proc + "/comm"); err == nil {
+		return strings.TrimSpace(string(comm))
+	}
+	return "unknown"
+}
+
+// WaitTimeout is how long the TUI waits for a lock before asking again.
+const WaitTimeout = 5 * time.Minute
+
+// stopTimeout is how long Stop waits for a holder to release its lock.
+const stopTimeout = 2 * time.Minute
+
+// Stop asks the holder to exit cleanly and waits until it released its lock.
+// unattended-upgrades is stopped through systemd so it can finish the package
+// it is working on; other processes get SIGTERM, never SIGKILL. Afterwards
+// `dpkg --configure -a` finishes any interrupted package configuration.
+func Stop(holder Holder) ([]string, error) {
+	if holder.PID <= 0 {
+		return nil, fmt.Errorf("the process holding %s is unknown, it cannot be stopped", holder.Path)
+	}
+
+	var out []string
+	if fromUnattendedUpgrades(holder.PID) {
+		out = append(out, "Stopping unattended-upgrades.service...")
+		if err := exec.Command("systemctl", "stop", "unattended-upgrades.service").Run(); err != nil {
+			out = append(out, "systemctl stop failed ("+err.Error()+"), sending SIGTERM instead")
+			if err := syscall.Kill(holder.PID, syscall.SIGTERM); err != nil {
+				return out, err
+			}
+		}
+	} else {
+		out = append(out, fmt.Sprintf("Sending SIGTERM to pid %d (%s)...", holder.PID, holder.Command))
+		if err := syscall.Kill(holder.PID, syscall.SIGTERM); err != nil {
+			return out, err
+		}
+	}
+
+	deadline := time.Now().Add(stopTimeout)
+	for {
+		if _, locked := holderOf(holder.Path); !locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			return out, fmt.Errorf("%s is still locked after %s", holder.Path, stopTimeout)
+		}
+		time.Sleep(time.Second)
+	}
+	out = append(out, holder.Path+" released.")
+
+	lines, err := exec.Command("dpkg", "--configure", "-a").CombinedOutput()
+	if text := strings.TrimSpace(string(lines)); text != "" {
+		out = append(out, strings.Split(text, "\n")...)
+	}
+	if err != nil {
+		return out, fmt.Errorf("dpkg --configure -a failed: %v", err)
+	}
+	return out, nil
+}
+
+// fromUnattendedUpgrades reports whether pid is unattended-upgrades or one of
+// the apt/dpkg processes it started.
+func fromUnattendedUpgrades(pid int) bool {
+	for depth := 0; pid > 1 && depth < 5; depth++ {
+		if strings.Contains(processCommand(pid), "unattended-upgr") {
+			return true
+		}
+		pid = parentPID(pid)
+	}
+	return false
+}
+
+func parentPID(pid int) int {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0
+	}
+	// The command name in field 2 may contain spaces, so parse after its closing parenthesis.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) < 2 {
+		return 0
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	return ppid
+}
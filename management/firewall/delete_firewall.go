@@ -0,0 +1,21 @@
+package firewall
+
+import (
+	"nginx_configure/common"
+	"os"
+)
+
+const ufwBasePath = "/etc/ufw"
+
+// DeleteSteps returns the steps that disable and purge ufw and remove its directory.
+func DeleteSteps() []common.Step {
+	return []common.Step{
+		common.CommandStep("Stopping ufw service...", "ufw disable"),
+		common.CommandStep("Purging firewall ufw...", "apt-get purge -y ufw"),
+		common.CommandStep("Auto removing packages...", "apt-get autoremove -y"),
+		{
+			Title: "Removing ufw directory...",
+			Run:   func() ([]string, error) { return nil, os.RemoveAll(ufwBasePath) },
+		},
+	}
+}
@@ -0,0 +1,34 @@
+package firewall
+
+import (
+	"nginx_configure/common"
+	"os/exec"
+	"strings"
+)
+
+// DefaultPorts are opened right after ufw is installed so the box stays reachable.
+var DefaultPorts = []string{"9011/tcp", "22/tcp"}
+
+// Installed reports whether ufw is available.
+func Installed() bool {
+	_, err := exec.LookPath("ufw")
+	return err == nil
+}
+
+// Active reports whether ufw is installed and enabled.
+func Active() bool {
+	out, err := exec.Command("ufw", "status").Output()
+	return err == nil && strings.Contains(string(out), "Status: active")
+}
+
+// InstallSteps returns the steps that install ufw and open the default ports.
+func InstallSteps() []common.Step {
+	steps := []common.Step{
+		common.CommandStep("Updating package list...", "apt-get update -y"),
+		common.CommandStep("Installing firewall...", "apt-get install -y ufw"),
+	}
+	for _, port := range DefaultPorts {
+		steps = append(steps, common.CommandStep("Allowing "+port+"...", "ufw allow "+port))
+	}
+	return steps
+}
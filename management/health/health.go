@@ -0,0 +1,261 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"nginx_configure/management/nginx"
+	"nginx_configure/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type State int
+
+const (
+	Up State = iota
+	// Drained servers are marked down in the config and are not probed.
+	Drained
+	Down
+	// Unprobed servers speak UDP, which has no connect to check.
+	Unprobed
+)
+
+func (s State) String() string {
+	switch s {
+	case Drained:
+		return "DRAINED"
+	case Down:
+		return "DOWN"
+	case Unprobed:
+		return "NOT PROBED"
+	}
+	return "UP"
+}
+
+// Result is the outcome of probing one upstream server.
+type Result struct {
+	Upstream string
+	Server   model.UpstreamServer
+	State    State
+	// Latency covers the connect and, when configured, the HTTP request.
+	Latency time.Duration
+	// Status is the HTTP status received, 0 when no HTTP check was made.
+	Status int
+	Detail string
+}
+
+// Checker probes upstream servers. The zero value uses a 3 second timeout
+// and the system dialer.
+type Checker struct {
+	Timeout time.Duration
+	// Dial opens the connection for both the TCP and the HTTP check. It can be
+	// replaced to probe through something other than the network stack.
+	Dial func(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+func (c Checker) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 3 * time.Second
+}
+
+func (c Checker) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	if c.Dial != nil {
+		return c.Dial(ctx, network, address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// Target returns the network and address to dial for an upstream address.
+// nginx uses port 80 when an address has no port.
+func Target(address string) (string, string) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return "unix", path
+	}
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return "tcp", address
+	}
+	return "tcp", net.JoinHostPort(strings.Trim(address, "[]"), "80")
+}
+
+// Check probes every server of the given upstream blocks concurrently.
+func (c Checker) Check(blocks []nginx.UpstreamBlock, check model.HealthCheck) []Result {
+	results := upstreamResults(blocks)
+	done := make(chan struct{})
+	for i := range results {
+		go func(r *Result) {
+			c.probe(r, check)
+			done <- struct{}{}
+		}(&results[i])
+	}
+	for range results {
+		<-done
+	}
+	return results
+}
+
+func upstreamResults(blocks []nginx.UpstreamBlock) []Result {
+	var results []Result
+	for _, block := range blocks {
+		for _, server := range block.Servers {
+			results = append(results, Result{Upstream: block.Name, Server: server})
+		}
+	}
+	return results
+}
+
+// CheckSite probes the upstream servers of a site config. The HTTP check
+// stored with the site is used unless check overrides it. The servers of UDP
+// stream proxies are listed as not probed.
+func (c Checker) CheckSite(configsBasePath string, site string, check *model.HealthCheck) ([]Result, error) {
+	blocks, err := nginx.ReadUpstreams(nginx.ConfigPath(configsBasePath, site))
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("%s has no upstream block", site)
+	}
+	stored, _ := nginx.LoadSite(site)
+	if stored.Setup == nginx.SetupStream && stored.Stream.Protocol == model.StreamUDP {
+		results := upstreamResults(blocks)
+		for i := range results {
+			if results[i].Server.Down {
+				results[i].State, results[i].Detail = Drained, "marked down in the config"
+				continue
+			}
+			results[i].State, results[i].Detail = Unprobed, "udp, nginx only notices failures from live traffic"
+		}
+		return results, nil
+	}
+	if check == nil {
+		check = &stored.Health
+	}
+	return c.Check(blocks, *check), nil
+}
+
+func (c Checker) probe(r *Result, check model.HealthCheck) {
+	if r.Server.Down {
+		r.State = Drained
+		r.Detail = "marked down in the config"
+		return
+	}
+
+	network, address := Target(r.Server.Address)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+
+	start := time.Now()
+	conn, err := c.dial(ctx, network, address)
+	if err != nil {
+		r.State = Down
+		r.Detail = err.Error()
+		return
+	}
+	conn.Close()
+	r.Latency = time.Since(start)
+
+	if check.Path == "" {
+		r.Detail = "tcp connect ok"
+		return
+	}
+
+	host := r.Server.Address
+	if network == "unix" {
+		host = "localhost"
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				return c.dial(ctx, network, address)
+			},
+			DisableKeepAlives: true,
+		},
+		// The status of the health endpoint itself is what counts, not where it redirects to.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+check.Path, nil)
+	if err != nil {
+		r.State = Down
+		r.Detail = err.Error()
+		return
+	}
+	start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		r.State = Down
+		r.Detail = err.Error()
+		return
+	}
+	resp.Body.Close()
+	r.Latency = time.Since(start)
+	r.Status = resp.StatusCode
+
+	if !statusMatches(resp.StatusCode, check.Status) {
+		r.State = Down
+		if check.Status == 0 {
+			r.Detail = fmt.Sprintf("GET %s returned %d, expected 2xx or 3xx", check.Path, resp.StatusCode)
+		} else {
+			r.Detail = fmt.Sprintf("GET %s returned %d, expected %d", check.Path, resp.StatusCode, check.Status)
+		}
+		return
+	}
+	r.Detail = fmt.Sprintf("GET %s returned %d", check.Path, resp.StatusCode)
+}
+
+func statusMatches(got int, want int) bool {
+	if want == 0 {
+		return got >= 200 && got < 400
+	}
+	return got == want
+}
+
+// AnyDown reports whether a probed server did not answer.
+func AnyDown(results []Result) bool {
+	for _, r := range results {
+		if r.State == Down {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCheck parses "<path> [status]", e.g. "/healthz 200". An empty value
+// turns the HTTP check off.
+func ParseCheck(value string) (model.HealthCheck, error) {
+	fields := strings.Fields(value)
+	var check model.HealthCheck
+	if len(fields) == 0 {
+		return check, nil
+	}
+	if len(fields) > 2 || !strings.HasPrefix(fields[0], "/") {
+		return check, fmt.Errorf("expected a path starting with / and an optional status, e.g. /healthz 200")
+	}
+	check.Path = fields[0]
+	if len(fields) == 2 {
+		status, err := strconv.Atoi(fields[1])
+		if err != nil || status < 100 || status > 599 {
+			return check, fmt.Errorf("status must be between 100 and 599, got %q", fields[1])
+		}
+		check.Status = status
+	}
+	return check, nil
+}
+
+// Table renders the results as aligned text columns.
+func Table(results []Result) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%-10s %-16s %-28s %-9s %s\n", "STATE", "UPSTREAM", "SERVER", "LATENCY", "DETAIL"))
+	for _, r := range results {
+		latency := "-"
+		if r.Latency > 0 {
+			latency = r.Latency.Round(time.Millisecond).String()
+		}
+		sb.WriteString(fmt.Sprintf("%-10s %-16s %-28s %-9s %s\n", r.State, r.Upstream, r.Server.Address, latency, r.Detail))
+	}
+	return sb.String()
+}
@@ -0,0 +1,171 @@
+package health
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"nginx_configure/management/nginx"
+	"nginx_configure/model"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/teapot", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/broken", http.StatusFound)
+	})
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func probeOne(t *testing.T, checker Checker, address string, check model.HealthCheck) Result {
+	t.Helper()
+	blocks := []nginx.UpstreamBlock{{Name: "app", Servers: []model.UpstreamServer{{Address: address}}}}
+	results := checker.Check(blocks, check)
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	return results[0]
+}
+
+func TestCheckTCP(t *testing.T) {
+	server := newServer(t)
+	r := probeOne(t, Checker{}, server.Listener.Addr().String(), model.HealthCheck{})
+	if r.State != Up || r.Status != 0 {
+		t.Fatalf("got %s with status %d (%s), want UP without HTTP status", r.State, r.Status, r.Detail)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+	r = probeOne(t, Checker{Timeout: time.Second}, closed, model.HealthCheck{})
+	if r.State != Down {
+		t.Fatalf("closed port: got %s (%s), want DOWN", r.State, r.Detail)
+	}
+}
+
+func TestCheckHTTP(t *testing.T) {
+	server := newServer(t)
+	address := server.Listener.Addr().String()
+	tests := []struct {
+		name   string
+		check  model.HealthCheck
+		state  State
+		status int
+	}{
+		{"any 2xx", model.HealthCheck{Path: "/ok"}, Up, 200},
+		{"matching status", model.HealthCheck{Path: "/teapot", Status: 418}, Up, 418},
+		{"mismatched status", model.HealthCheck{Path: "/teapot", Status: 200}, Down, 418},
+		{"4xx without status", model.HealthCheck{Path: "/teapot"}, Down, 418},
+		{"redirect is not followed", model.HealthCheck{Path: "/moved"}, Up, 302},
+		{"redirect against status", model.HealthCheck{Path: "/moved", Status: 200}, Down, 302},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := probeOne(t, Checker{}, address, tt.check)
+			if r.State != tt.state || r.Status != tt.status {
+				t.Fatalf("got %s with status %d (%s), want %s with %d", r.State, r.Status, r.Detail, tt.state, tt.status)
+			}
+		})
+	}
+}
+
+func TestCheckDrained(t *testing.T) {
+	checker := Checker{Dial: func(context.Context, string, string) (net.Conn, error) {
+		t.Error("a drained server was probed")
+		return nil, net.ErrClosed
+	}}
+	blocks := []nginx.UpstreamBlock{{Name: "app", Servers: []model.UpstreamServer{{Address: "10.0.0.1:8080", Down: true}}}}
+	results := checker.Check(blocks, model.HealthCheck{Path: "/ok"})
+	if len(results) != 1 || results[0].State != Drained {
+		t.Fatalf("got %+v, want one DRAINED result", results)
+	}
+	if AnyDown(results) {
+		t.Fatal("AnyDown counts drained servers")
+	}
+}
+
+func TestAnyDown(t *testing.T) {
+	if AnyDown(nil) {
+		t.Fatal("AnyDown(nil) = true")
+	}
+	if AnyDown([]Result{{State: Up}, {State: Drained}}) {
+		t.Fatal("AnyDown without a DOWN result = true")
+	}
+	if !AnyDown([]Result{{State: Up}, {State: Down}}) {
+		t.Fatal("AnyDown with a DOWN result = false")
+	}
+}
+
+func TestParseCheck(t *testing.T) {
+	check, err := ParseCheck("/healthz 204")
+	if err != nil || check.Path != "/healthz" || check.Status != 204 {
+		t.Fatalf("got %+v, %v", check, err)
+	}
+	check, err = ParseCheck("  ")
+	if err != nil || check.Path != "" {
+		t.Fatalf("empty value: got %+v, %v, want the check off", check, err)
+	}
+	for _, value := range []string{"healthz", "/healthz 200 extra", "/healthz ok", "/healthz 99", "/healthz 600"} {
+		if _, err := ParseCheck(value); err == nil {
+			t.Errorf("ParseCheck(%q) accepted an invalid value", value)
+		} else if !strings.Contains(err.Error(), "status") && !strings.Contains(err.Error(), "path") {
+			t.Errorf("ParseCheck(%q): unexpected error %v", value, err)
+		}
+	}
+}
+
+func TestCheckSiteUDPStream(t *testing.T) {
+	dir := t.TempDir()
+	sites, streams := nginx.SitesBasePath, nginx.StreamsBasePath
+	t.Cleanup(func() { nginx.SitesBasePath, nginx.StreamsBasePath = sites, streams })
+	nginx.SitesBasePath, nginx.StreamsBasePath = dir+"/sites", dir+"/streams"
+	site := model.Site{
+		Name:      "dns",
+		Setup:     nginx.SetupStream,
+		Stream:    model.Stream{Port: "53", Protocol: model.StreamUDP},
+		Upstreams: []model.UpstreamServer{{Address: "10.0.0.1:53"}, {Address: "10.0.0.2:53", Down: true}},
+	}
+	if err := os.MkdirAll(nginx.StreamsBasePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(nginx.StreamsBasePath+"/dns.conf", []byte(nginx.RenderStream(site)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := nginx.SaveSite(site); err != nil {
+		t.Fatal(err)
+	}
+
+	checker := Checker{Dial: func(context.Context, string, string) (net.Conn, error) {
+		t.Error("a udp server was dialed")
+		return nil, net.ErrClosed
+	}}
+	results, err := checker.CheckSite(dir, "dns", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].State != Unprobed || results[1].State != Drained {
+		t.Fatalf("got %+v, want one NOT PROBED and one DRAINED result", results)
+	}
+	if AnyDown(results) {
+		t.Fatal("AnyDown counts udp servers that were not probed")
+	}
+}
@@ -0,0 +1,317 @@
+package nginx
+
+import (
+	"fmt"
+	"net"
+	"nginx_configure/common"
+	"nginx_configure/management/pki"
+	"nginx_configure/model"
+	"strings"
+)
+
+const defaultAuthRealm = "Restricted"
+
+// AccessField is one value of the access section that can be edited on its own.
+type AccessField struct {
+	Label string
+	Hint  string
+	Get   func(a model.Access) string
+	Set   func(a *model.Access, value string) error
+}
+
+// AccessFields are the editable access values in the order they are shown.
+var AccessFields = []AccessField{
+	{
+		Label: "Allow",
+		Hint:  "addresses or CIDRs separated by spaces, every other client is denied, empty allows all",
+		Get:   func(a model.Access) string { return noneIfEmpty(a.Allow) },
+		Set:   func(a *model.Access, value string) error { return setAddresses(&a.Allow, value) },
+	},
+	{
+		Label: "Deny",
+		Hint:  "addresses or CIDRs separated by spaces, checked before Allow",
+		Get:   func(a model.Access) string { return noneIfEmpty(a.Deny) },
+		Set:   func(a *model.Access, value string) error { return setAddresses(&a.Deny, value) },
+	},
+	{
+		Label: "Basic auth file",
+		Hint:  "name of an htpasswd file in " + pki.HtpasswdBasePath + ", or off",
+		Get:   func(a model.Access) string { return offIfEmpty(a.AuthFile) },
+		Set: func(a *model.Access, value string) error {
+			if value == "" || value == "off" {
+				a.AuthFile = ""
+				return nil
+			}
+			if err := pki.ValidateHtpasswdName(value); err != nil {
+				return err
+			}
+			a.AuthFile = value
+			return nil
+		},
+	},
+	{
+		Label: "Basic auth realm",
+		Hint:  "the name browsers show in the login prompt",
+		Get:   func(a model.Access) string { return authRealm(a) },
+		Set: func(a *model.Access, value string) error {
+			if strings.ContainsAny(value, "\"\n;{}") {
+				return fmt.Errorf("the realm must not contain quotes or ; { }")
+			}
+			a.AuthRealm = value
+			return nil
+		},
+	},
+	{
+		Label: "Satisfy",
+		Hint:  "all to require both the address and the password, any to let clients in by either",
+		Get: func(a model.Access) string {
+			if a.Satisfy == model.SatisfyAny {
+				return model.SatisfyAny
+			}
+			return "all"
+		},
+		Set: func(a *model.Access, value string) error {
+			switch value {
+			case "", "all":
+				a.Satisfy = ""
+			case model.SatisfyAny:
+				a.Satisfy = model.SatisfyAny
+			default:
+				return fmt.Errorf("satisfy must be all or any, got %q", value)
+			}
+			return nil
+		},
+	},
+	{
+		Label: "Behind CDN",
+		Hint:  "cloudflare to trust its published ranges and its client address header, or none",
+		Get: func(a model.Access) string {
+			if a.CDN == "" {
+				return "none"
+			}
+			return a.CDN
+		},
+		Set: func(a *model.Access, value string) error {
+			value = strings.ToLower(value)
+			if value == "" || value == "none" {
+				a.CDN, a.CDNFirewall = "", false
+				return nil
+			}
+			if _, ok := FindCDNProvider(value); !ok {
+				return fmt.Errorf("unknown CDN %q, use cloudflare or none", value)
+			}
+			a.CDN = value
+			return nil
+		},
+	},
+	{
+		Label: "Only let the CDN in",
+		Hint:  "on to allow the web ports of the site in ufw only from the CDN ranges, for every site on this host, or off",
+		Get: func(a model.Access) string {
+			if a.CDNFirewall {
+				return "on"
+			}
+			return "off"
+		},
+		Set: func(a *model.Access, value string) error {
+			switch value {
+			case "on":
+				a.CDNFirewall = true
+			case "", "off":
+				a.CDNFirewall = false
+			default:
+				return fmt.Errorf("please enter on or off")
+			}
+			return nil
+		},
+	},
+	{
+		Label: "Trusted proxies",
+		Hint:  "addresses or CIDRs of proxies in front of nginx whose real IP header is believed, empty for none",
+		Get:   func(a model.Access) string { return noneIfEmpty(a.RealIPFrom) },
+		Set:   func(a *model.Access, value string) error { return setAddresses(&a.RealIPFrom, value) },
+	},
+	{
+		Label: "Real IP header",
+		Hint:  "the header trusted proxies put the client address in, e.g. X-Forwarded-For or X-Real-IP, empty for the header of the CDN",
+		Get:   func(a model.Access) string { return realIPHeader(a) },
+		Set: func(a *model.Access, value string) error {
+			if value != "" && !headerNamePattern.MatchString(value) {
+				return fmt.Errorf("%q is not a valid header name", value)
+			}
+			a.RealIPHeader = value
+			return nil
+		},
+	},
+}
+
+func noneIfEmpty(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	return strings.Join(values, " ")
+}
+
+func setAddresses(field *[]string, value string) error {
+	if value == "none" {
+		value = ""
+	}
+	addresses, err := ParseAddresses(value)
+	if err != nil {
+		return err
+	}
+	*field = addresses
+	return nil
+}
+
+func authRealm(a model.Access) string {
+	if a.AuthRealm == "" {
+		return defaultAuthRealm
+	}
+	return a.AuthRealm
+}
+
+func realIPHeader(a model.Access) string {
+	if a.RealIPHeader != "" {
+		return a.RealIPHeader
+	}
+	if provider, ok := FindCDNProvider(a.CDN); ok {
+		return provider.Header
+	}
+	return "X-Forwarded-For"
+}
+
+// ParseAddresses parses space or comma separated addresses and CIDRs, e.g.
+//
+//	10.0.0.0/8 192.168.1.5 2001:db8::/32
+func ParseAddresses(spec string) ([]string, error) {
+	var addresses []string
+	for _, address := range strings.FieldsFunc(spec, func(r rune) bool { return r == ' ' || r == ',' }) {
+		if err := validateAddress(address); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+func validateAddress(address string) error {
+	if address == "all" {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(address); err == nil {
+		return nil
+	}
+	if net.ParseIP(address) != nil {
+		return nil
+	}
+	return fmt.Errorf("%q is not an address or CIDR, e.g. 10.0.0.0/8 or 192.168.1.5", address)
+}
+
+// realIPDirectives renders the trusted proxies of a site.
+func realIPDirectives(site model.Site) string {
+	if len(site.Access.RealIPFrom) == 0 && site.Access.CDN == "" {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("\n")
+	sb.WriteString(cdnRealIP(site))
+	for _, address := range site.Access.RealIPFrom {
+		sb.WriteString(fmt.Sprintf("\n\tset_real_ip_from %s;", address))
+	}
+	sb.WriteString(fmt.Sprintf("\n\treal_ip_header %s;", realIPHeader(site.Access)))
+	sb.WriteString("\n\treal_ip_recursive on;")
+	return sb.String()
+}
+
+// accessRules renders deny and allow rules. nginx stops at the first rule
+// matching the client, so denies come first and a final deny all closes an allowlist.
+func accessRules(allow []string, deny []string, indent string) string {
+	var sb strings.Builder
+	for _, address := range deny {
+		sb.WriteString(fmt.Sprintf("\n%sdeny %s;", indent, address))
+	}
+	closed := false
+	for _, address := range allow {
+		sb.WriteString(fmt.Sprintf("\n%sallow %s;", indent, address))
+		closed = closed || address == "all"
+	}
+	if len(allow) > 0 && !closed {
+		sb.WriteString(fmt.Sprintf("\n%sdeny all;", indent))
+	}
+	return sb.String()
+}
+
+func authDirectives(file string, realm string, indent string) string {
+	if file == "off" {
+		return fmt.Sprintf("\n%sauth_basic off;", indent)
+	}
+	return fmt.Sprintf("\n%sauth_basic \"%s\";\n%sauth_basic_user_file %s;", indent, realm, indent, pki.HtpasswdPath(file))
+}
+
+// accessDirectives renders the server level access rules of a site.
+func accessDirectives(site model.Site) string {
+	a := site.Access
+	if len(a.Allow) == 0 && len(a.Deny) == 0 && a.AuthFile == "" {
+		return ""
+	}
+	rules := "\n" + accessRules(a.Allow, a.Deny, "\t")
+	if a.AuthFile != "" {
+		rules += authDirectives(a.AuthFile, authRealm(a), "\t")
+	}
+	if a.Satisfy == model.SatisfyAny {
+		rules += "\n\tsatisfy any;"
+	}
+	return rules
+}
+
+// locationAccess renders the access overrides of a location. Rules in a
+// location replace the rules of the server, they are not added to them.
+func locationAccess(site model.Site, location model.Location) string {
+	rules := accessRules(location.Allow, location.Deny, "\t\t")
+	if location.Auth != "" {
+		rules += authDirectives(location.Auth, authRealm(site.Access), "\t\t")
+	}
+	if rules == "" {
+		return ""
+	}
+	return strings.TrimPrefix(rules, "\n") + "\n"
+}
+
+// ValidateAccess checks the access section of a site and of its locations.
+func ValidateAccess(site model.Site) error {
+	a := site.Access
+	for _, addresses := range [][]string{a.Allow, a.Deny, a.RealIPFrom} {
+		for _, address := range addresses {
+			if err := validateAddress(address); err != nil {
+				return err
+			}
+		}
+	}
+	for _, address := range a.RealIPFrom {
+		if address == "all" {
+			return fmt.Errorf("trusted proxies must be addresses or CIDRs, trusting all would let every client choose its address")
+		}
+	}
+	if err := ValidateCDN(site); err != nil {
+		return err
+	}
+	if a.Satisfy == model.SatisfyAny && (a.AuthFile == "" || len(a.Allow) == 0) {
+		return fmt.Errorf("satisfy any needs both an allowlist and a basic auth file")
+	}
+	files := []string{a.AuthFile}
+	for _, location := range site.Locations {
+		if location.Auth != "off" {
+			files = append(files, location.Auth)
+		}
+	}
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		if !common.FileExists(pki.HtpasswdPath(file)) {
+			return fmt.Errorf("%s does not exist, add a user with: nginx_configure htpasswd set %s <user>", pki.HtpasswdPath(file), file)
+		}
+	}
+	return nil
+}
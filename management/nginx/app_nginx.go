@@ -0,0 +1,86 @@
+package nginx
+
+import (
+	"fmt"
+	"net"
+	"nginx_configure/model"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Setups that hand requests to an application server instead of an upstream.
+const (
+	SetupPHP   = "PHP-FPM"
+	SetupUWSGI = "uWSGI"
+)
+
+// PHPSocketsPath is where the php-fpm packages create their sockets.
+var PHPSocketsPath = "/run/php"
+
+// PHPSockets returns the php-fpm sockets found on this host, newest PHP version first.
+func PHPSockets() []string {
+	files, _ := filepath.Glob(filepath.Join(PHPSocketsPath, "*.sock"))
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	var sockets []string
+	for _, file := range files {
+		sockets = append(sockets, "unix:"+file)
+	}
+	return sockets
+}
+
+// ValidateAppAddress accepts unix:/path and host:port. Unlike upstream
+// servers the port cannot be left out, FastCGI and uwsgi have no default.
+func ValidateAppAddress(address string) error {
+	if err := ValidateUpstreamAddress(address); err != nil {
+		return err
+	}
+	if strings.HasPrefix(address, "unix:") {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("%s: a port is needed, e.g. 127.0.0.1:9000", address)
+	}
+	return nil
+}
+
+// proxied reports whether a setup proxies to the site upstream.
+func proxied(setup string) bool {
+	return setup != SetupStatic && setup != SetupPHP && setup != SetupUWSGI
+}
+
+// phpBlock renders the server body of a PHP-FPM site.
+func phpBlock(app model.App) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("\troot %s;\n", app.Root))
+	sb.WriteString("\tindex index.php index.html;\n\n")
+
+	sb.WriteString("\tlocation / {\n")
+	sb.WriteString("\t\ttry_files $uri $uri/ /index.php?$query_string;\n")
+	sb.WriteString("\t}\n\n")
+
+	sb.WriteString("\tlocation ~ \\.php$ {\n")
+	// Only pass scripts that exist, otherwise php-fpm could run uploads named image.jpg/x.php.
+	sb.WriteString("\t\ttry_files $fastcgi_script_name =404;\n")
+	sb.WriteString("\t\tinclude fastcgi_params;\n")
+	sb.WriteString("\t\tfastcgi_param SCRIPT_FILENAME $realpath_root$fastcgi_script_name;\n")
+	sb.WriteString("\t\tfastcgi_param DOCUMENT_ROOT $realpath_root;\n")
+	sb.WriteString("\t\tfastcgi_index index.php;\n")
+	sb.WriteString(fmt.Sprintf("\t\tfastcgi_pass %s;\n", app.Address))
+	sb.WriteString("\t}\n\n")
+
+	sb.WriteString("\tlocation ~ /\\.(?!well-known) {\n")
+	sb.WriteString("\t\tdeny all;\n")
+	sb.WriteString("\t}")
+	return sb.String()
+}
+
+// uwsgiBlock renders the server body of a uWSGI site.
+func uwsgiBlock(app model.App) string {
+	var sb strings.Builder
+	sb.WriteString("\tlocation / {\n")
+	sb.WriteString("\t\tinclude uwsgi_params;\n")
+	sb.WriteString(fmt.Sprintf("\t\tuwsgi_pass %s;\n", app.Address))
+	sb.WriteString("\t}")
+	return sb.String()
+}
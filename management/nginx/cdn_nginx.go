@@ -0,0 +1,289 @@
+package nginx
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"nginx_configure/common"
+	"nginx_configure/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CDNRangesBasePath holds the refreshed address ranges of the CDN providers,
+// one <name>.txt per provider. Without a file the bundled ranges are used.
+var CDNRangesBasePath = filepath.Join(common.StateBasePath, "cdn")
+
+// CDNProvider is a CDN whose edge servers connect to the origin.
+type CDNProvider struct {
+	Name  string
+	Label string
+	// Header carries the address of the client the CDN received the request from.
+	Header string
+	// URLs publish the current ranges as one CIDR per line.
+	URLs []string
+	// Ranges are bundled for hosts that never refreshed them.
+	Ranges []string
+}
+
+// CDNProviders are the CDNs a site can be behind.
+var CDNProviders = []CDNProvider{
+	{
+		Name:   "cloudflare",
+		Label:  "Cloudflare",
+		Header: "CF-Connecting-IP",
+		URLs:   []string{"https://www.cloudflare.com/ips-v4", "https://www.cloudflare.com/ips-v6"},
+		Ranges: []string{
+			"173.245.48.0/20",
+			"103.21.244.0/22",
+			"103.22.200.0/22",
+			"103.31.4.0/22",
+			"141.101.64.0/18",
+			"108.162.192.0/18",
+			"190.93.240.0/20",
+			"188.114.96.0/20",
+			"197.234.240.0/22",
+			"198.41.128.0/17",
+			"162.158.0.0/15",
+			"104.16.0.0/13",
+			"104.24.0.0/14",
+			"172.64.0.0/13",
+			"131.0.72.0/22",
+			"2400:cb00::/32",
+			"2606:4700::/32",
+			"2803:f800::/32",
+			"2405:b500::/32",
+			"2405:8100::/32",
+			"2a06:98c0::/29",
+			"2c0f:f248::/32",
+		},
+	},
+}
+
+// FindCDNProvider returns the provider with the given name.
+func FindCDNProvider(name string) (CDNProvider, bool) {
+	for _, provider := range CDNProviders {
+		if provider.Name == name {
+			return provider, true
+		}
+	}
+	return CDNProvider{}, false
+}
+
+// CDNRangesPath returns the file the ranges of a provider are refreshed into.
+func CDNRangesPath(name string) string {
+	return filepath.Join(CDNRangesBasePath, name+".txt")
+}
+
+// CDNRanges returns the ranges of a provider from its refreshed file, or the
+// bundled ranges when it was never refreshed.
+func CDNRanges(provider CDNProvider) ([]string, error) {
+	data, err := os.ReadFile(CDNRangesPath(provider.Name))
+	if os.IsNotExist(err) {
+		return provider.Ranges, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := parseRanges(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", CDNRangesPath(provider.Name), err)
+	}
+	return ranges, nil
+}
+
+// parseRanges parses one CIDR per line, skipping empty lines and # comments.
+func parseRanges(text string) ([]string, error) {
+	var ranges []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := validateAddress(line); err != nil || line == "all" {
+			return nil, fmt.Errorf("%q is not a CIDR", line)
+		}
+		ranges = append(ranges, line)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no ranges found")
+	}
+	return ranges, nil
+}
+
+// downloadRanges fetches the published ranges of a provider.
+func downloadRanges(provider CDNProvider) ([]string, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	var ranges []string
+	for _, url := range provider.URLs {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+		}
+		parsed, err := parseRanges(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", url, err)
+		}
+		ranges = append(ranges, parsed...)
+	}
+	return ranges, nil
+}
+
+// cdnSites returns the stored sites behind the provider, and for Cloudflare
+// the sites verifying its origin-pull certificate.
+func cdnSites(configsBasePath string, name string) []model.Site {
+	var sites []model.Site
+	for _, siteName := range Sites(configsBasePath) {
+		site, ok := LoadSite(siteName)
+		if !ok {
+			continue
+		}
+		if site.Access.CDN == name || (name == "cloudflare" && site.ClientAuth.CA == model.ClientCACloudflare) {
+			sites = append(sites, site)
+		}
+	}
+	return sites
+}
+
+// RefreshCDN downloads the current ranges of a provider into its ranges file,
+// renders the sites behind it again and moves their firewall rules to the new
+// ranges. The previous file is put back when nginx rejects the new configs.
+func RefreshCDN(configsBasePath string, certBasePath string, name string) ([]string, error) {
+	provider, ok := FindCDNProvider(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown CDN %q", name)
+	}
+	previous, err := CDNRanges(provider)
+	if err != nil {
+		previous = nil
+	}
+	ranges, err := downloadRanges(provider)
+	if err != nil {
+		return nil, fmt.Errorf("downloading the %s ranges failed: %v", provider.Label, err)
+	}
+	if err := os.MkdirAll(CDNRangesBasePath, 0755); err != nil {
+		return nil, err
+	}
+	path := CDNRangesPath(name)
+	original, readErr := os.ReadFile(path)
+	content := fmt.Sprintf("# %s ranges from %s, refreshed %s.\n%s\n", provider.Label, strings.Join(provider.URLs, " "), time.Now().Format("2006-01-02"), strings.Join(ranges, "\n"))
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return nil, err
+	}
+	out := []string{fmt.Sprintf("Wrote %d %s ranges to %s", len(ranges), provider.Label, path)}
+	if name == "cloudflare" && common.FileExists(OriginPullCAPath) {
+		ca, err := EnsureOriginPullCA(true)
+		out = append(out, ca...)
+		if err != nil {
+			return out, err
+		}
+	}
+
+	sites := cdnSites(configsBasePath, name)
+	if len(sites) == 0 {
+		return append(out, "No site uses "+provider.Label+"."), nil
+	}
+	rewritten, err := RewriteSites(configsBasePath, certBasePath, sites)
+	out = append(out, rewritten...)
+	if err != nil {
+		if readErr == nil {
+			os.WriteFile(path, original, 0644)
+		} else {
+			os.Remove(path)
+		}
+		return out, err
+	}
+	for _, site := range sites {
+		if !site.Access.CDNFirewall {
+			continue
+		}
+		for _, cmd := range cdnFirewallCommands(site, ranges, previous) {
+			lines, err := common.RunCommandOutput(cmd)
+			out = append(out, lines...)
+			if err != nil {
+				return out, fmt.Errorf("%s failed: %v", cmd, err)
+			}
+		}
+	}
+	return out, nil
+}
+
+// cdnPorts returns the web ports a site listens on.
+func cdnPorts(site model.Site) []string {
+	var ports []string
+	if site.CType != "SSL" || !site.Redirect.SkipHTTP {
+		ports = append(ports, site.HttpPort)
+	}
+	if site.CType == "SSL" && site.HttpsPort != site.HttpPort {
+		ports = append(ports, site.HttpsPort)
+	}
+	return ports
+}
+
+// cdnFirewallCommands returns the ufw commands that let only ranges reach the
+// web ports of a site. Rules for stale ranges that are no longer published are
+// deleted. The ports are closed to everyone else, for every site on this host.
+func cdnFirewallCommands(site model.Site, ranges []string, stale []string) []string {
+	ports := cdnPorts(site)
+	var cmds []string
+	for _, port := range ports {
+		cmds = append(cmds, "ufw delete allow "+port+"/tcp")
+	}
+	current := make(map[string]bool)
+	portList := strings.Join(ports, ",")
+	for _, cidr := range ranges {
+		current[cidr] = true
+		cmds = append(cmds, fmt.Sprintf("ufw allow proto tcp from %s to any port %s", cidr, portList))
+	}
+	for _, cidr := range stale {
+		if !current[cidr] {
+			cmds = append(cmds, fmt.Sprintf("ufw delete allow proto tcp from %s to any port %s", cidr, portList))
+		}
+	}
+	return cmds
+}
+
+// cdnRealIP renders the trusted ranges of the CDN of a site.
+func cdnRealIP(site model.Site) string {
+	provider, ok := FindCDNProvider(site.Access.CDN)
+	if !ok {
+		return ""
+	}
+	ranges, err := CDNRanges(provider)
+	source := CDNRangesPath(provider.Name)
+	if err != nil || !common.FileExists(source) {
+		ranges, source = provider.Ranges, "the ranges bundled with nginx_configure"
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("\n\t# %s edge servers, from %s", provider.Label, source))
+	for _, cidr := range ranges {
+		sb.WriteString(fmt.Sprintf("\n\tset_real_ip_from %s;", cidr))
+	}
+	return sb.String()
+}
+
+// ValidateCDN checks the CDN of a site and that its ranges can be read.
+func ValidateCDN(site model.Site) error {
+	if site.Access.CDN == "" {
+		if site.Access.CDNFirewall {
+			return fmt.Errorf("restricting the firewall to a CDN needs a CDN")
+		}
+		return nil
+	}
+	provider, ok := FindCDNProvider(site.Access.CDN)
+	if !ok {
+		return fmt.Errorf("unknown CDN %q", site.Access.CDN)
+	}
+	_, err := CDNRanges(provider)
+	return err
+}
@@ -0,0 +1,195 @@
+package nginx
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"nginx_configure/common"
+	"nginx_configure/model"
+	"os"
+	"strings"
+)
+
+// certGroup is one HTTPS server of a site: the names it answers and the
+// certificates it presents.
+type certGroup struct {
+	ServerNames []string
+	Certs       []string
+	// Dedicated is set for servers of an extra certificate with its own names.
+	Dedicated bool
+}
+
+// certGroups splits an SSL site into HTTPS servers. The main server presents
+// CertName and the extra certificates without names, every extra certificate
+// with names gets a server of its own.
+func certGroups(site model.Site) []certGroup {
+	main := certGroup{Certs: []string{site.CertName}}
+	var dedicated []certGroup
+	claimed := make(map[string]bool)
+	alias := canonicalAlias(site)
+	for _, cert := range site.ExtraCerts {
+		if len(cert.ServerNames) == 0 {
+			main.Certs = append(main.Certs, cert.Name)
+			continue
+		}
+		group := certGroup{Certs: []string{cert.Name}, Dedicated: true}
+		for _, name := range cert.ServerNames {
+			claimed[name] = true
+			if name != alias {
+				group.ServerNames = append(group.ServerNames, name)
+			}
+		}
+		if len(group.ServerNames) > 0 {
+			dedicated = append(dedicated, group)
+		}
+	}
+	for _, name := range strings.Fields(primaryServerNames(site)) {
+		if !claimed[name] {
+			main.ServerNames = append(main.ServerNames, name)
+		}
+	}
+	return append([]certGroup{main}, dedicated...)
+}
+
+// certGroupOf returns the HTTPS server a name is served by.
+func certGroupOf(site model.Site, name string) certGroup {
+	for _, cert := range site.ExtraCerts {
+		for _, certName := range cert.ServerNames {
+			if certName == name {
+				return certGroup{ServerNames: []string{name}, Certs: []string{cert.Name}, Dedicated: true}
+			}
+		}
+	}
+	return certGroups(site)[0]
+}
+
+// certDirectives renders the certificate pairs of a server, one pair per certificate.
+func certDirectives(certBasePath string, certs []string) string {
+	var sb strings.Builder
+	for _, cert := range certs {
+		sb.WriteString(fmt.Sprintf("\n\tssl_certificate %s;", certBasePath+cert+".crt"))
+		sb.WriteString(fmt.Sprintf("\n\tssl_certificate_key %s;", certBasePath+cert+".key"))
+	}
+	return sb.String()
+}
+
+// httpsServer renders one HTTPS server of an SSL site.
+func httpsServer(certBasePath string, site model.Site, group certGroup, listen string, serverExtra string) string {
+	comment := "# HTTPS block: SSL configuration and reverse proxy settings"
+	if group.Dedicated {
+		comment = fmt.Sprintf("# HTTPS block for %s with certificate %s", strings.Join(group.ServerNames, " "), group.Certs[0])
+	}
+	// OCSP stapling uses the chain of the first certificate of the server.
+	served := site
+	served.CertName = group.Certs[0]
+	return fmt.Sprintf(`%s
+server {
+	listen %s;
+	server_name %s;
+%s
+%s%s%s%s
+
+%s
+}
+`, comment, listen, strings.Join(group.ServerNames, " "), certDirectives(certBasePath, group.Certs), tlsDirectives(site.TLSProfile), clientAuthDirectives(certBasePath, site), securityDirectives(certBasePath, served), serverExtra, locationBlock(site))
+}
+
+// CertKeyType returns the public key algorithm of a certificate: RSA, ECDSA or Ed25519.
+func CertKeyType(certPath string) (string, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", fmt.Errorf("%s is not a PEM certificate", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", nil
+	case *ecdsa.PublicKey:
+		return "ECDSA", nil
+	case ed25519.PublicKey:
+		return "Ed25519", nil
+	}
+	return "", fmt.Errorf("%s has an unsupported key type", certPath)
+}
+
+// CoveringCerts returns the certificates in certBasePath whose names cover
+// every one of names, described with their key type and names.
+func CoveringCerts(certBasePath string, names []string) (map[string]string, common.LogData) {
+	certs, logMsg := common.Certificates(certBasePath)
+	covering := make(map[string]string)
+	for name := range certs {
+		sans, err := common.ExtractDomains(certBasePath + name + ".crt")
+		if err != nil || len(Uncovered(sans, names)) > 0 {
+			continue
+		}
+		keyType, err := CertKeyType(certBasePath + name + ".crt")
+		if err != nil {
+			keyType = "unknown key"
+		}
+		covering[name] = fmt.Sprintf("%s | %s | Domains: %s", name, keyType, strings.Join(sans, ", "))
+		if common.OriginCA(certBasePath + name + ".crt") {
+			covering[name] += " | " + common.OriginCALabel
+		}
+	}
+	if len(covering) == 0 && len(logMsg.Messages) == 0 {
+		logMsg = common.CreateSingleLog("No certificate in "+certBasePath+" covers "+strings.Join(names, ", ")+".", common.Gold)
+	}
+	return covering, logMsg
+}
+
+// ValidateCerts checks the extra certificates of an SSL site.
+func ValidateCerts(certBasePath string, site model.Site) error {
+	domains := make(map[string]bool)
+	for _, name := range SiteDomains(site) {
+		domains[name] = true
+	}
+	keyTypes := make(map[string]string)
+	if keyType, err := CertKeyType(certBasePath + site.CertName + ".crt"); err == nil {
+		keyTypes[keyType] = site.CertName
+	}
+	claimed := make(map[string]string)
+	for _, cert := range site.ExtraCerts {
+		if cert.Name == site.CertName {
+			return fmt.Errorf("%s is already the main certificate", cert.Name)
+		}
+		for _, path := range []string{certBasePath + cert.Name + ".crt", certBasePath + cert.Name + ".key"} {
+			if !common.FileExists(path) {
+				return fmt.Errorf("%s does not exist", path)
+			}
+		}
+		if len(cert.ServerNames) == 0 {
+			keyType, err := CertKeyType(certBasePath + cert.Name + ".crt")
+			if err != nil {
+				return err
+			}
+			if other, ok := keyTypes[keyType]; ok {
+				return fmt.Errorf("%s and %s both use %s keys, one server can only present one certificate per key type", other, cert.Name, keyType)
+			}
+			keyTypes[keyType] = cert.Name
+			continue
+		}
+		for _, name := range cert.ServerNames {
+			if !domains[name] {
+				return fmt.Errorf("%s is not a server name of the site", name)
+			}
+			if other, ok := claimed[name]; ok {
+				return fmt.Errorf("%s is served with both %s and %s", name, other, cert.Name)
+			}
+			claimed[name] = cert.Name
+		}
+	}
+	if len(certGroups(site)[0].ServerNames) == 0 {
+		return fmt.Errorf("every server name uses an extra certificate, leave at least one to the main certificate %s", site.CertName)
+	}
+	return nil
+}
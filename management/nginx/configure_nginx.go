@@ -4,202 +4,279 @@ import (
 	"fmt"
 	tea "github.com/charmbracelet/bubbletea"
 	"nginx_configure/common"
+	"nginx_configure/management/pki"
+	"nginx_configure/model"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
-func Configure(
-	configsBasePath string,
-	certBasePath string,
-	configName string,
-	setup string,
-	upstreamIPs []string,
-	cType string,
-	certName string,
-	domain string,
-	serverIp string,
-	httpPort string,
-	httpsPort string,
-
-) tea.Cmd {
-
-	certPath := certBasePath + certName + ".crt"
-	keyPath := certBasePath + certName + ".key"
-	configFilePath := filepath.Join(configsBasePath, configName+".conf")
-
-	var upstreamConf strings.Builder
-	upstreamConf.WriteString(fmt.Sprintf("upstream %s {", configName))
-	if setup == "Websocket" {
-		upstreamConf.WriteString("\n    ip_hash;")
+// BalancingDirective returns the upstream directive for the balancing
+// method, or "" for round robin. Websocket sites default to ip_hash so a
+// client keeps talking to the same backend.
+func BalancingDirective(setup string, balancing model.Balancing) string {
+	method := balancing.Method
+	if method == "" && setup == "Websocket" {
+		method = model.BalanceIPHash
 	}
-	for _, ip := range upstreamIPs {
-		upstreamConf.WriteString(fmt.Sprintf("\n    server %s;", ip))
+	switch method {
+	case model.BalanceLeastConn:
+		return "least_conn;"
+	case model.BalanceIPHash:
+		return "ip_hash;"
+	case model.BalanceHash:
+		if balancing.Consistent {
+			return fmt.Sprintf("hash %s consistent;", balancing.Key)
+		}
+		return fmt.Sprintf("hash %s;", balancing.Key)
+	case model.BalanceRandomTwo:
+		return "random two least_conn;"
 	}
-	upstreamConf.WriteString("\n}")
-
-	var configContent string
-	// Build configuration based on the chosen options.
-	if cType == "SSL" && setup == "Default" {
-		config := `
-# Define an upstream block for the backend server(s)
-%s
-
-# HTTP block: Redirect all HTTP traffic to HTTPS
-server {
-	listen %s;
-	server_name %s;
-	return 301 https://$host$request_uri;
+	return ""
 }
 
-# HTTPS block: SSL configuration and reverse proxy settings
-server {
-	listen %s ssl;
-	server_name %s;
-
-	ssl_certificate %s;
-	ssl_certificate_key %s;
-
-	ssl_protocols TLSv1.2 TLSv1.3;
-	ssl_ciphers HIGH:!aNULL:!MD5;
-
-	location / {
-		proxy_pass http://%s;
-
-		proxy_set_header Host $host;
-
-		proxy_set_header X-Real-IP $remote_addr;
-		proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-		proxy_set_header X-Forwarded-Proto $scheme;
+// ValidateHashKey checks a key entered for hash balancing.
+func ValidateHashKey(key string) error {
+	if strings.TrimSpace(key) == "" {
+		return fmt.Errorf("the hash key must not be empty")
 	}
-}
-		`
-		configContent = fmt.Sprintf(config, upstreamConf.String(), httpPort, domain, httpsPort, domain, certPath, keyPath, configName)
-	} else if cType == "SSL" && setup == "Websocket" {
-		config := `
-# Define an upstream block for the backend server(s)
-%s
-
-# HTTP block: Redirect all HTTP traffic to HTTPS
-server {
-	listen %s;
-	server_name %s;
-	return 301 https://$host$request_uri;
+	if strings.ContainsAny(key, ";{}\"'") {
+		return fmt.Errorf("the hash key must not contain ; { } or quotes")
+	}
+	if !strings.Contains(key, "$") {
+		return fmt.Errorf("the hash key should use a variable such as $request_uri or $remote_addr")
+	}
+	return nil
 }
 
-# HTTPS block: SSL configuration and reverse proxy settings
-server {
-	listen %s ssl;
-	server_name %s;
+// DefaultConfigs are the default sites of the nginx packages, removed so they
+// do not claim port 80 before the generated sites.
+var DefaultConfigs = []string{"/etc/nginx/sites-enabled/default", "/etc/nginx/conf.d/default.conf"}
 
-	ssl_certificate %s;
-	ssl_certificate_key %s;
+// Render builds the config file content for a site.
+func Render(certBasePath string, site model.Site) string {
 
-	ssl_protocols TLSv1.2 TLSv1.3;
-	ssl_ciphers HIGH:!aNULL:!MD5;
+	configName := site.Name
+	setup := site.Setup
+	cType := site.CType
+	serverIp := site.ServerIp
+	httpPort := site.HttpPort
+	httpsPort := site.HttpsPort
 
-	location / {
-		proxy_pass http://%s;
+	var upstreamConf strings.Builder
+	if proxied(setup) {
+		upstreamConf.WriteString(upstreamBlock(configName, BalancingDirective(setup, site.Balancing), site.Upstreams, site.Tuning))
+		for _, pool := range site.Pools {
+			upstreamConf.WriteString("\n\n" + upstreamBlock(PoolUpstream(configName, pool.Name), "", pool.Servers, site.Tuning))
+		}
+		upstreamConf.WriteString("\n\n")
+	}
 
-		proxy_http_version 1.1;
-		proxy_set_header Upgrade $http_upgrade;
-		proxy_set_header Connection "upgrade";
+	// gRPC needs HTTP/2 on the listener, and room for large messages.
+	httpsListen, httpListen := httpsPort+" ssl", httpPort
+	serverExtra := serverTuning(site.Tuning)
+	if setup == SetupGRPC {
+		http2On := http2OnDirective(Inspect().Version)
+		if http2On {
+			serverExtra += "\n\thttp2 on;"
+		} else if cType == "SSL" {
+			httpsListen += " http2"
+		} else {
+			httpListen += " http2"
+		}
+		if site.Tuning.ClientMaxBodySize == "" && site.GRPC.MaxMessageSize != "" {
+			serverExtra += fmt.Sprintf("\n\tclient_max_body_size %s;", site.GRPC.MaxMessageSize)
+		}
+	}
 
-		proxy_set_header Host $host;
+	serverExtra += realIPDirectives(site) + accessDirectives(site) + protectionDirectives(site)
 
-		proxy_set_header X-Real-IP $remote_addr;
-		proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-		proxy_set_header X-Forwarded-Proto $scheme;
-	}
-}
-		`
-		configContent = fmt.Sprintf(config, upstreamConf.String(), httpPort, domain, httpsPort, domain, certPath, keyPath, configName)
-	} else if cType == "No SSL" && setup == "Default" {
+	var configContent string
+	// Build configuration based on the chosen options.
+	if cType == "SSL" {
 		config := `
-%s
-
-server {
+%s%s%s%s		`
+		upstreams := upstreamConf.String()
+		if upstreams != "" {
+			upstreams = "# Define an upstream block for the backend server(s)\n" + upstreams
+		}
+		var servers []string
+		for _, group := range certGroups(site) {
+			servers = append(servers, httpsServer(certBasePath, site, group, httpsListen, serverExtra))
+		}
+		configContent = fmt.Sprintf(config, upstreams, redirectServer(site), strings.Join(servers, "\n"), canonicalServer(certBasePath, site, httpsListen))
+	} else {
+		config := `
+%sserver {
 	listen %s;
-	server_name %s;
+	server_name %s;%s
 
-	location / {
-		proxy_pass http://%s;
-		proxy_set_header Host $host;
-		proxy_set_header X-Real-IP $remote_addr;
-		proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-		proxy_set_header X-Forwarded-Proto $scheme;
-	}
+%s
 }
 		`
-		configContent = fmt.Sprintf(config, upstreamConf.String(), httpPort, serverIp, configName)
-	} else if cType == "No SSL" && setup == "Websocket" {
-		config := `
-%s
+		configContent = fmt.Sprintf(config, upstreamConf.String(), httpListen, serverIp, serverExtra, locationBlock(site))
+	}
+	return configContent
+}
 
-server {
-	listen %s;
-	server_name %s;
+// upstreamBlock renders one upstream block.
+func upstreamBlock(name string, directive string, servers []model.UpstreamServer, tuning model.Tuning) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("upstream %s {", name))
+	if directive != "" {
+		sb.WriteString("\n    " + directive)
+	}
+	for _, server := range servers {
+		sb.WriteString(fmt.Sprintf("\n    server %s;", FormatUpstreamServer(server)))
+	}
+	if tuning.Keepalive > 0 {
+		sb.WriteString(fmt.Sprintf("\n    keepalive %d;", tuning.Keepalive))
+	}
+	sb.WriteString("\n}")
+	return sb.String()
+}
 
-	location / {
-		proxy_pass http://%s;
+// locationBlock renders the location blocks of a site.
+func locationBlock(site model.Site) string {
+	switch site.Setup {
+	case SetupStatic:
+		return staticBlock(site)
+	case SetupPHP:
+		return phpBlock(site.App)
+	case SetupUWSGI:
+		return uwsgiBlock(site.App)
+	case SetupGRPC:
+		return grpcBlock(site)
+	}
+	var blocks []string
+	for i, location := range SiteLocations(site) {
+		blocks = append(blocks, renderLocation(site, i, location))
+	}
+	return strings.Join(blocks, "\n\n")
+}
 
-		proxy_http_version 1.1;
-		proxy_set_header Upgrade $http_upgrade;
-		proxy_set_header Connection "upgrade";
+// Configure writes the config of a site, tests and reloads nginx and opens the
+// ports of the sites in ufw. It stops at the first failing step; when `nginx -t`
+// fails the config and the limit zones are rolled back, and the definition is
+// only stored once nginx reloaded.
+func Configure(configsBasePath string, certBasePath string, site model.Site) tea.Cmd {
 
-		proxy_set_header Host $host;
+	configFilePath := filepath.Join(configsBasePath, site.Name+".conf")
+	configContent := Render(certBasePath, site)
+	var originalConfig []byte
+	zoneOriginals := make(map[string][]byte)
 
-		proxy_set_header X-Real-IP $remote_addr;
-		proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-		proxy_set_header X-Forwarded-Proto $scheme;
+	steps := []common.Step{
+		{
+			Title: "Creating config file...",
+			Run: func() ([]string, error) {
+				original, err := os.ReadFile(configFilePath)
+				if err != nil && !os.IsNotExist(err) {
+					return nil, err
+				}
+				originalConfig = original
+				if err := os.WriteFile(configFilePath, []byte(configContent), 0644); err != nil {
+					return nil, fmt.Errorf("error writing config file: %v", err)
+				}
+				if err := ensureACMERoot(site); err != nil {
+					return nil, fmt.Errorf("error creating %s: %v", ACMERoot, err)
+				}
+				return nil, nil
+			},
+		},
+		{
+			Title: "Removing default configurations...",
+			Run: func() ([]string, error) {
+				var out []string
+				for _, df := range DefaultConfigs {
+					if common.FileExists(df) {
+						if err := os.Remove(df); err != nil {
+							return out, fmt.Errorf("error removing default configuration at %s: %v", df, err)
+						}
+						out = append(out, "Removed default configuration at "+df)
+					}
+				}
+				return out, nil
+			},
+		},
 	}
-}
-		`
-		configContent = fmt.Sprintf(config, upstreamConf.String(), httpPort, serverIp, configName)
+	if site.ClientAuth.CA == model.ClientCAPrivate && !pki.CAExists() {
+		steps = append(steps, common.Step{
+			Title: "Creating the private client CA in " + pki.CABasePath + "...",
+			Run: func() ([]string, error) {
+				if _, _, err := pki.EnsureCA(); err != nil {
+					return nil, fmt.Errorf("error creating the client CA: %v", err)
+				}
+				return []string{"Client CA created."}, nil
+			},
+		})
+	}
+	if site.ClientAuth.CA == model.ClientCACloudflare {
+		steps = append(steps, common.Step{
+			Title: "Checking the Cloudflare origin-pull CA in " + OriginPullCAPath + "...",
+			Run:   func() ([]string, error) { return EnsureOriginPullCA(false) },
+		})
+	}
+	if NeedsDHParam(site) {
+		steps = append(steps, common.CommandStep("Generating "+DHParamPath+" for the old TLS profile (this can take a minute)...", DHParamCommand()))
 	}
 
-	return tea.Sequence(
-		common.LogMessage("Creating config file...", common.Gold),
-		func() tea.Msg {
-			err := os.WriteFile(configFilePath, []byte(configContent), 0644)
-			if err != nil {
-				return common.CreateSingleLog("Error writing config file: "+err.Error(), common.Red)
+	rollback := func() {
+		if originalConfig == nil {
+			os.Remove(configFilePath)
+		} else {
+			os.WriteFile(configFilePath, originalConfig, 0644)
+		}
+		for path, content := range zoneOriginals {
+			if content == nil {
+				os.Remove(path)
+				continue
 			}
-			return common.CreateSingleLog("Config file created successfully.", common.Gold)
+			os.WriteFile(path, content, 0644)
+		}
+	}
+	// ufw rules are host wide, so they are derived from every stored site.
+	sites := sitesWithZones(configsBasePath, []model.Site{site})
+	rules := append([]string{"ufw allow 9011/tcp", "ufw allow 22/tcp"}, FirewallCommands(sites)...)
+	rules = append(rules, "ufw --force enable")
+
+	steps = append(steps,
+		common.Step{
+			Title: "Writing the limit zones to " + LimitZonesPath + "...",
+			Run: func() ([]string, error) {
+				var err error
+				zoneOriginals, err = WriteZones(configsBasePath, []model.Site{site})
+				if err != nil {
+					rollback()
+					return nil, err
+				}
+				return nil, nil
+			},
 		},
-		func() tea.Msg {
-			defaultFiles := []string{"/etc/nginx/sites-enabled/default", "/etc/nginx/conf.d/default.conf"}
-			var logs []common.LogItem
-			haveError := false
-			for _, df := range defaultFiles {
-				if common.FileExists(df) {
-					logs = append(logs, common.LogItem{Msg: "Removing default configuration at " + df, Color: common.White})
-					err := os.Remove(df)
-					if err != nil {
-						logs = append(logs, common.LogItem{Msg: "Error Removing default configuration at " + df, Color: common.Red})
-						haveError = true
-					}
+		common.Step{
+			Title: "Testing nginx configuration...",
+			Run: func() ([]string, error) {
+				out, err := common.RunCommandOutput("nginx -t")
+				if err == nil {
+					return out, nil
 				}
-			}
-			if !haveError {
-				logs = append(logs, common.LogItem{Msg: "Default files removed.", Color: common.Gold})
-			}
-			return common.LogData{Messages: logs}
+				rollback()
+				return append(out, "The new config was removed and the limit zones restored."), fmt.Errorf("nginx -t failed")
+			},
+		},
+		common.CommandStep("Reloading nginx...", "systemctl reload nginx"),
+		common.Step{
+			Title: "Saving the site definition...",
+			Run:   func() ([]string, error) { return nil, SaveSite(site) },
+		},
+		common.CommandStep("Enabling nginx service to automatically start after reboot...", "systemctl enable nginx"),
+		common.Step{
+			Title: "Allowing SSH on port 22 and web traffic on the ports of the sites...",
+			Run: func() ([]string, error) {
+				out, err := common.RunCommandsOutput(rules)
+				return append(FirewallWarnings(sites), out...), err
+			},
 		},
-		common.LogMessage("Testing nginx configuration...", common.Gold),
-		common.RunCommandWithLogs("nginx -t"),
-		common.LogMessage("Reloading nginx...", common.Gold),
-		common.RunCommandWithLogs("systemctl reload nginx"),
-		common.LogMessage("Enabling nginx service to automatically start after reboot...", common.Gold),
-		common.RunCommandWithLogs("systemctl enable nginx"),
-		common.LogMessage("Reverse proxy and Load balancer installation and configuration completed successfully.", common.Gold),
-		common.LogMessage("Allowing SSH on port 22 and web traffic on ports 80, 443...", common.Gold),
-		common.RunCommandWithLogs("ufw allow 9011/tcp"),
-		common.RunCommandWithLogs("ufw allow 22/tcp"),
-		common.RunCommandWithLogs("ufw allow 80/tcp"),
-		common.RunCommandWithLogs("ufw allow 443/tcp"),
-		common.RunCommandWithLogs("ufw --force enable"),
-		common.LogMessage("All is done.", common.Green),
 	)
-
+	return common.RunSteps(steps, "Reverse proxy and Load balancer installation and configuration completed successfully. All is done.")
 }
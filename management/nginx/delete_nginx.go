@@ -1,37 +1,214 @@
 package nginx
 
 import (
+	"bufio"
+	"fmt"
 	tea "github.com/charmbracelet/bubbletea"
 	"nginx_configure/common"
+	"nginx_configure/model"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
-func Delete() tea.Cmd {
+const nginxBasePath = "/etc/nginx"
 
-	if _, err := exec.LookPath("nginx"); err == nil {
+// Removal lists everything Delete is going to remove or leave behind.
+type Removal struct {
+	Packages    []string
+	ConfigFiles []string
+	Sites       []string
+	// Certificates are referenced by the configs; they are kept but can be archived.
+	Certificates []string
+}
+
+// PreviewDelete collects what a Delete would touch without changing anything.
+func PreviewDelete(configsBasePath string) Removal {
+	var removal Removal
+
+	out, err := exec.Command("dpkg-query", "-W", "-f=${binary:Package} ${db:Status-Status}\n", "nginx*", "libnginx-mod-*").Output()
+	if err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[1] == "installed" {
+				removal.Packages = append(removal.Packages, fields[0])
+			}
+		}
+	}
+
+	_ = filepath.Walk(nginxBasePath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			removal.ConfigFiles = append(removal.ConfigFiles, path)
+		}
+		return nil
+	})
+	removal.Sites, _ = filepath.Glob(filepath.Join(configsBasePath, "*.conf"))
+	removal.Certificates = configCertificates()
+
+	return removal
+}
+
+// configCertificates returns the certificate and key paths used by the files
+// in /etc/nginx, sorted.
+func configCertificates() []string {
+	certs := make(map[string]bool)
+	_ = filepath.Walk(nginxBasePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		for _, cert := range referencedCertificates(path) {
+			certs[cert] = true
+		}
+		return nil
+	})
+	var paths []string
+	for cert := range certs {
+		paths = append(paths, cert)
+	}
+	sort.Strings(paths)
+	return paths
+}
 
-		return tea.Sequence(
-			common.LogMessage("Nginx is installed. Purging existing installation and configuration files...", common.Gold),
-			common.LogMessage("Stopping nginx service...", common.Gold),
-			common.RunCommandWithLogs("systemctl stop nginx"),
-			common.LogMessage("Purging nginx...", common.Gold),
-			common.RunCommandWithLogs("apt-get purge -y nginx"),
-			common.LogMessage("Auto removing packages...", common.Gold),
-			common.RunCommandWithLogs("apt-get autoremove -y"),
-			common.LogMessage("Removing nginx directory...", common.Gold),
-			func() tea.Msg {
-				err := os.RemoveAll("/etc/nginx")
-				if err != nil {
-					return common.LogItem{Msg: "An Error occurred : " + err.Error(), Color: common.Red}
-				}
-				return common.LogItem{Msg: "All is done.", Color: common.Green}
-			},
-		)
+// referencedCertificates returns the certificate and key paths used by a config file.
+func referencedCertificates(path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
 
+	var paths []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";"))
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "ssl_certificate", "ssl_certificate_key", "ssl_client_certificate", "ssl_trusted_certificate":
+			paths = append(paths, fields[1])
+		}
 	}
+	return paths
+}
 
-	return tea.Sequence(
-		common.LogMessage("Nginx is not installed.", common.Blue),
+// RestoreCommand returns a shell command that reinstalls nginx with its extra
+// modules and unpacks archive over it. Pinned versions are kept when apt still
+// knows them, so the restored load_module lines find their modules.
+func RestoreCommand(install model.Install, archive string) string {
+	packages, _, _, err := installSpecs(install)
+	if err != nil {
+		unpinned := install
+		unpinned.Version = ""
+		if packages, _, _, err = installSpecs(unpinned); err != nil {
+			packages = []string{"nginx"}
+		}
+	}
+	return fmt.Sprintf(
+		"apt-get update -y && apt-get install -y --allow-downgrades -o Dpkg::Options::=--force-confold %s && tar -xzf %s -C / && nginx -t && systemctl restart nginx",
+		strings.Join(packages, " "), archive,
 	)
 }
+
+// NewArchivePath returns a fresh path for an archive written before removing things.
+func NewArchivePath() string {
+	return filepath.Join(common.StateBasePath, "backups", "nginx-"+time.Now().Format("20060102-150405")+".tar.gz")
+}
+
+// archivePaths returns what an archive holds: /etc/nginx, the certificates,
+// the state of this tool except earlier archives, and every certificate the
+// configs reference elsewhere, e.g. in /etc/letsencrypt. Symlinked
+// certificates are followed so the archive holds their content.
+func archivePaths() []string {
+	paths := []string{nginxBasePath, common.CertBasePath}
+	entries, _ := os.ReadDir(common.StateBasePath)
+	for _, entry := range entries {
+		if entry.Name() != "backups" {
+			paths = append(paths, filepath.Join(common.StateBasePath, entry.Name()))
+		}
+	}
+	covered := func(path string) bool {
+		for _, dir := range paths {
+			if path == dir || strings.HasPrefix(path, dir+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	for _, cert := range configCertificates() {
+		targets := []string{cert}
+		if resolved, err := filepath.EvalSymlinks(cert); err == nil && resolved != cert {
+			targets = append(targets, resolved)
+		}
+		for _, target := range targets {
+			if !covered(target) {
+				paths = append(paths, target)
+			}
+		}
+	}
+	return paths
+}
+
+// ArchiveStep writes /etc/nginx, the certificates and the state of this tool
+// to archivePath together with a script holding the restore command.
+func ArchiveStep(archivePath string) common.Step {
+	return common.Step{
+		Title: "Archiving " + nginxBasePath + ", " + common.CertBasePath + ", " + common.StateBasePath + " and the referenced certificates to " + archivePath + "...",
+		Run: func() ([]string, error) {
+			paths := archivePaths()
+			if err := common.WriteTarGz(archivePath, paths...); err != nil {
+				return nil, err
+			}
+			restore := RestoreCommand(LoadInstall(), archivePath)
+			if err := os.WriteFile(archivePath+".restore.sh", []byte("#!/bin/bash\n"+restore+"\n"), 0700); err != nil {
+				return nil, err
+			}
+			return []string{
+				"Archive written: " + archivePath,
+				"Archived: " + strings.Join(paths, ", "),
+				"Restore with: " + restore,
+				"The restore command is also saved in " + archivePath + ".restore.sh",
+			}, nil
+		},
+	}
+}
+
+func Delete(configsBasePath string, archive bool) tea.Cmd {
+
+	if _, err := exec.LookPath("nginx"); err != nil {
+		return common.LogMessage("Nginx is not installed.", common.Blue)
+	}
+
+	var steps []common.Step
+	if archive {
+		steps = append(steps, ArchiveStep(NewArchivePath()))
+	}
+	steps = append(steps, DeleteSteps(configsBasePath)...)
+
+	return common.RunSteps(steps, "All is done.")
+}
+
+// DeleteSteps returns the steps that stop and purge nginx and remove /etc/nginx.
+func DeleteSteps(configsBasePath string) []common.Step {
+	packages := PreviewDelete(configsBasePath).Packages
+	if len(packages) == 0 {
+		packages = []string{"nginx"}
+	}
+
+	return []common.Step{
+		{
+			Title:       "Stopping nginx service...",
+			Run:         func() ([]string, error) { return common.RunCommandOutput("systemctl stop nginx") },
+			IgnoreError: true,
+		},
+		common.CommandStep("Purging "+strings.Join(packages, ", ")+"...", "apt-mark unhold "+strings.Join(packages, " ")+"; apt-get purge -y "+strings.Join(packages, " ")),
+		common.CommandStep("Auto removing packages...", "apt-get autoremove -y"),
+		{
+			Title: "Removing nginx directory...",
+			Run:   func() ([]string, error) { return nil, os.RemoveAll(nginxBasePath) },
+		},
+	}
+}
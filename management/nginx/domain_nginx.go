@@ -0,0 +1,156 @@
+package nginx
+
+import (
+	"fmt"
+	"nginx_configure/model"
+	"regexp"
+	"strings"
+)
+
+var serverNamePattern = regexp.MustCompile(`^(\*\.)?([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+// SiteDomains returns the server names of a site. Sites stored before names
+// could be combined only have Domain.
+func SiteDomains(site model.Site) []string {
+	if len(site.Domains) > 0 {
+		return site.Domains
+	}
+	return strings.Fields(site.Domain)
+}
+
+// ParseServerNames parses space or comma separated host names, e.g.
+//
+//	example.com www.example.com *.example.org
+func ParseServerNames(spec string) ([]string, error) {
+	var names []string
+	for _, name := range strings.FieldsFunc(spec, func(r rune) bool { return r == ' ' || r == ',' }) {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !serverNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("%q is not a host name, e.g. api.example.com or *.example.com", name)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("please enter at least one host name")
+	}
+	return names, nil
+}
+
+// Covers reports whether the certificate name san is valid for the server
+// name. A wildcard covers exactly one label: *.example.com covers
+// api.example.com, but neither example.com nor a.b.example.com.
+func Covers(san string, name string) bool {
+	san, name = strings.ToLower(san), strings.ToLower(name)
+	if san == name {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(san, "*.")
+	if !ok {
+		return false
+	}
+	label, rest, found := strings.Cut(name, ".")
+	return found && label != "" && label != "*" && rest == suffix
+}
+
+// Uncovered returns the names that none of the certificate names cover.
+func Uncovered(sans []string, names []string) []string {
+	var uncovered []string
+	for _, name := range names {
+		covered := false
+		for _, san := range sans {
+			if Covers(san, name) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			uncovered = append(uncovered, name)
+		}
+	}
+	return uncovered
+}
+
+// CanonicalPairs returns the apex names whose www name is also in names, the
+// pairs a canonical redirect can be set up for.
+func CanonicalPairs(names []string) []string {
+	chosen := make(map[string]bool)
+	for _, name := range names {
+		chosen[name] = true
+	}
+	var apexes []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, "www.") && !strings.HasPrefix(name, "*.") && chosen["www."+name] {
+			apexes = append(apexes, name)
+		}
+	}
+	return apexes
+}
+
+// canonicalAlias returns the name that redirects to the canonical name of a
+// site, or "" when the site has no canonical redirect.
+func canonicalAlias(site model.Site) string {
+	if site.Canonical == "" {
+		return ""
+	}
+	alias := "www." + site.Canonical
+	if apex, ok := strings.CutPrefix(site.Canonical, "www."); ok {
+		alias = apex
+	}
+	for _, name := range SiteDomains(site) {
+		if name == alias {
+			return alias
+		}
+	}
+	return ""
+}
+
+// ValidateDomains checks the server names of an SSL site.
+func ValidateDomains(site model.Site) error {
+	names := SiteDomains(site)
+	if len(names) == 0 {
+		return fmt.Errorf("please choose at least one domain")
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			return fmt.Errorf("%s is chosen twice", name)
+		}
+		seen[name] = true
+	}
+	if site.Canonical != "" && canonicalAlias(site) == "" {
+		return fmt.Errorf("a canonical redirect to %s needs both the www and the apex name", site.Canonical)
+	}
+	return nil
+}
+
+// canonicalServer renders the HTTPS server that redirects the alias to the canonical name.
+func canonicalServer(certBasePath string, site model.Site, listen string) string {
+	alias := canonicalAlias(site)
+	if alias == "" {
+		return ""
+	}
+	return fmt.Sprintf(`
+# Canonical host: redirect %s to %s
+server {
+	listen %s;
+	server_name %s;
+%s
+%s
+
+	return 301 %s;
+}
+`, alias, site.Canonical, listen, alias, certDirectives(certBasePath, certGroupOf(site, alias).Certs), tlsDirectives(site.TLSProfile), httpsURL(site.Canonical, site.HttpsPort))
+}
+
+// primaryServerNames returns the server_name of the main HTTPS server, all
+// names except the alias of a canonical redirect.
+func primaryServerNames(site model.Site) string {
+	alias := canonicalAlias(site)
+	var names []string
+	for _, name := range SiteDomains(site) {
+		if name != alias {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, " ")
+}
@@ -0,0 +1,30 @@
+package nginx
+
+import "testing"
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		san  string
+		name string
+		want bool
+	}{
+		{"example.com", "example.com", true},
+		{"Example.COM", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "api.example.com", true},
+		{"*.example.com", "API.Example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", "*.example.com", true},
+		{"*.example.com", "api.example.org", false},
+		{"*.example.com", ".example.com", false},
+		{"api.*.com", "api.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.san+" "+tt.name, func(t *testing.T) {
+			if got := Covers(tt.san, tt.name); got != tt.want {
+				t.Fatalf("Covers(%q, %q) = %v, want %v", tt.san, tt.name, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package nginx
+
+import (
+	"fmt"
+	"nginx_configure/model"
+	"strconv"
+	"strings"
+)
+
+// SetupGRPC proxies gRPC over HTTP/2 with grpc_pass.
+const SetupGRPC = "gRPC"
+
+// DefaultMaxMessageSize is offered for new gRPC sites. nginx's own default
+// of 1m rejects most uploads and long client streams.
+const DefaultMaxMessageSize = "64m"
+
+// grpcErrors maps the HTTP errors nginx produces itself to gRPC status codes,
+// following the gRPC HTTP to gRPC status mapping. Clients only understand the
+// grpc-status trailer, not an HTML error page.
+var grpcErrors = []struct {
+	HTTP    int
+	Status  int
+	Message string
+}{
+	{400, 13, "internal"},
+	{401, 16, "unauthenticated"},
+	{403, 7, "permission denied"},
+	{404, 12, "unimplemented"},
+	{413, 8, "message too large"},
+	{429, 14, "unavailable"},
+	{500, 13, "internal"},
+	{502, 14, "unavailable"},
+	{503, 14, "unavailable"},
+	{504, 4, "deadline exceeded"},
+}
+
+// ValidateGRPC checks that a gRPC site either uses SSL or explicitly accepts h2c.
+func ValidateGRPC(site model.Site) error {
+	if site.Setup != SetupGRPC {
+		return nil
+	}
+	if site.CType != "SSL" && !site.GRPC.H2C {
+		return fmt.Errorf("gRPC needs SSL; without it clients must use h2c (cleartext HTTP/2), which has to be acknowledged")
+	}
+	if size := site.GRPC.MaxMessageSize; size != "" && !sizePattern.MatchString(size) {
+		return fmt.Errorf("the max message size needs a size such as 64m, got %q", size)
+	}
+	return nil
+}
+
+// http2OnDirective reports whether nginx takes `http2 on;` (1.25.1 and later)
+// rather than the http2 parameter of listen. An unknown version gets the new form.
+func http2OnDirective(version string) bool {
+	var parts [3]int
+	for i, part := range strings.SplitN(version, ".", 3) {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return true
+		}
+		parts[i] = n
+	}
+	if parts[0] != 1 {
+		return parts[0] > 1
+	}
+	if parts[1] != 25 {
+		return parts[1] > 25
+	}
+	return parts[2] >= 1
+}
+
+// grpcBlock renders the server body of a gRPC site.
+func grpcBlock(site model.Site) string {
+	scheme := "grpc"
+	if site.GRPC.BackendTLS {
+		scheme = "grpcs"
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\tlocation / {\n")
+	sb.WriteString(fmt.Sprintf("\t\tgrpc_pass %s://%s;\n\n", scheme, site.Name))
+	sb.WriteString("\t\tgrpc_set_header Host $host;\n")
+	sb.WriteString("\t\tgrpc_set_header X-Real-IP $remote_addr;\n")
+	sb.WriteString("\t\tgrpc_set_header X-Forwarded-For $proxy_add_x_forwarded_for;\n")
+	sb.WriteString("\t\tgrpc_set_header X-Forwarded-Proto $scheme;\n")
+	sb.WriteString(clientCertRequestHeaders(site, "grpc"))
+	if tuning := locationTuning(site.Tuning, "grpc"); tuning != "" {
+		sb.WriteString("\n" + tuning)
+	}
+	sb.WriteString("\n")
+	for _, e := range grpcErrors {
+		sb.WriteString(fmt.Sprintf("\t\terror_page %d = /error%dgrpc;\n", e.HTTP, e.HTTP))
+	}
+	sb.WriteString("\t}")
+
+	for _, e := range grpcErrors {
+		sb.WriteString(fmt.Sprintf("\n\n\tlocation = /error%dgrpc {\n", e.HTTP))
+		sb.WriteString("\t\tinternal;\n")
+		sb.WriteString("\t\tdefault_type application/grpc;\n")
+		sb.WriteString(fmt.Sprintf("\t\tadd_header grpc-status %d;\n", e.Status))
+		sb.WriteString(fmt.Sprintf("\t\tadd_header grpc-message \"%s\";\n", e.Message))
+		sb.WriteString("\t\treturn 204;\n")
+		sb.WriteString("\t}")
+	}
+	return sb.String()
+}
@@ -0,0 +1,74 @@
+package nginx
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// BuildInfo is what `nginx -V` reports about the installed binary.
+type BuildInfo struct {
+	Version string
+	OpenSSL string
+	Modules []string
+}
+
+// Inspect runs `nginx -V` and parses its output. An empty BuildInfo means nginx is not installed.
+func Inspect() BuildInfo {
+	if _, err := exec.LookPath("nginx"); err != nil {
+		return BuildInfo{}
+	}
+	// nginx prints its build information to stderr.
+	out, err := exec.Command("nginx", "-V").CombinedOutput()
+	if err != nil {
+		return BuildInfo{}
+	}
+	return ParseBuildInfo(string(out))
+}
+
+// ParseBuildInfo extracts the version, OpenSSL build and compiled modules from `nginx -V` output.
+func ParseBuildInfo(output string) BuildInfo {
+	var info BuildInfo
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "nginx version:"):
+			version := strings.TrimSpace(strings.TrimPrefix(line, "nginx version:"))
+			info.Version = strings.TrimPrefix(version, "nginx/")
+		case strings.HasPrefix(line, "built with "):
+			info.OpenSSL = strings.TrimPrefix(line, "built with ")
+		case strings.HasPrefix(line, "configure arguments:"):
+			for _, arg := range strings.Fields(strings.TrimPrefix(line, "configure arguments:")) {
+				if module := moduleFromArg(arg); module != "" {
+					info.Modules = append(info.Modules, module)
+				}
+			}
+		}
+	}
+	return info
+}
+
+// moduleFromArg returns the module name of a configure argument such as
+// --with-http_ssl_module or --add-dynamic-module=/path/njs/nginx.
+func moduleFromArg(arg string) string {
+	name, value, _ := strings.Cut(arg, "=")
+	switch {
+	case name == "--add-module" || name == "--add-dynamic-module":
+		module := filepath.Base(strings.TrimSuffix(value, "/"))
+		if module == "nginx" {
+			// njs ships its nginx glue in a directory called "nginx".
+			module = filepath.Base(filepath.Dir(strings.TrimSuffix(value, "/")))
+		}
+		if name == "--add-dynamic-module" {
+			module += " (dynamic)"
+		}
+		return module
+	case strings.HasPrefix(name, "--with-") && (strings.HasSuffix(name, "_module") || name == "--with-stream" || name == "--with-mail"):
+		module := strings.TrimSuffix(strings.TrimPrefix(name, "--with-"), "_module")
+		if value == "dynamic" {
+			module += " (dynamic)"
+		}
+		return module
+	}
+	return ""
+}
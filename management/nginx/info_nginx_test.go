@@ -0,0 +1,54 @@
+package nginx
+
+import (
+	"strings"
+	"testing"
+)
+
+const ubuntuBuild = `nginx version: nginx/1.24.0 (Ubuntu)
+built with OpenSSL 3.0.13 30 Jan 2024
+TLS SNI support enabled
+configure arguments: --with-cc-opt='-g -O2' --prefix=/usr/share/nginx --with-http_ssl_module --with-http_v2_module --with-stream=dynamic --with-stream_ssl_module --with-mail=dynamic --add-dynamic-module=/build/nginx/debian/modules/http-geoip2 --add-module=/build/njs/nginx/`
+
+func TestParseBuildInfo(t *testing.T) {
+	info := ParseBuildInfo(ubuntuBuild)
+	if info.Version != "1.24.0 (Ubuntu)" {
+		t.Errorf("got version %q", info.Version)
+	}
+	if info.OpenSSL != "OpenSSL 3.0.13 30 Jan 2024" {
+		t.Errorf("got OpenSSL %q", info.OpenSSL)
+	}
+	want := []string{"http_ssl", "http_v2", "stream (dynamic)", "stream_ssl", "mail (dynamic)", "http-geoip2 (dynamic)", "njs"}
+	if strings.Join(info.Modules, ",") != strings.Join(want, ",") {
+		t.Errorf("got modules %q, want %q", info.Modules, want)
+	}
+}
+
+func TestParseBuildInfoEmpty(t *testing.T) {
+	info := ParseBuildInfo("bash: nginx: command not found\n")
+	if info.Version != "" || info.OpenSSL != "" || len(info.Modules) != 0 {
+		t.Fatalf("got %+v, want an empty BuildInfo", info)
+	}
+}
+
+func TestModuleFromArg(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"--with-http_ssl_module", "http_ssl"},
+		{"--with-http_xslt_module=dynamic", "http_xslt (dynamic)"},
+		{"--with-stream", "stream"},
+		{"--add-module=/src/headers-more", "headers-more"},
+		{"--add-dynamic-module=/src/njs/nginx", "njs (dynamic)"},
+		{"--with-threads", ""},
+		{"--prefix=/etc/nginx", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			if got := moduleFromArg(tt.arg); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,16 +1,236 @@
 package nginx
 
 import (
+	"encoding/json"
+	"fmt"
 	tea "github.com/charmbracelet/bubbletea"
 	"nginx_configure/common"
+	"nginx_configure/model"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
 )
 
-func Install() tea.Cmd {
-	return tea.Sequence(
-		common.LogMessage("Updating package list...", common.Gold),
-		common.RunCommandWithLogs("apt-get update -y"),
-		common.LogMessage("Installing nginx...", common.Gold),
-		common.RunCommandWithLogs("apt-get install nginx -y"),
-		common.LogMessage("All is done.", common.Green),
+const (
+	nginxKeyring     = "/usr/share/keyrings/nginx-archive-keyring.gpg"
+	nginxSourcesList = "/etc/apt/sources.list.d/nginx.list"
+	nginxAptPin      = "/etc/apt/preferences.d/99nginx"
+)
+
+// modulePattern matches the package names accepted for extra modules. They
+// end up in a shell command.
+var modulePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.+-]*$`)
+
+// InstallRecordPath is where the last install choice is stored.
+var InstallRecordPath = filepath.Join(common.StateBasePath, "install.json")
+
+func Install(install model.Install) tea.Cmd {
+	return common.RunSteps(InstallSteps(install), "All is done.")
+}
+
+// InstallSteps returns the steps that install nginx as described by install
+// and record the choice for later reinstalls.
+func InstallSteps(install model.Install) []common.Step {
+	var steps []common.Step
+
+	if install.Channel == model.InstallStable || install.Channel == model.InstallMainline {
+		steps = append(steps,
+			common.CommandStep("Installing repository prerequisites...", "apt-get install -y curl gnupg2 ca-certificates lsb-release"),
+			common.CommandStep("Importing the nginx.org signing key...", "curl -fsSL https://nginx.org/keys/nginx_signing.key | gpg --dearmor --yes -o "+nginxKeyring),
+			common.Step{
+				Title: fmt.Sprintf("Adding the nginx.org %s repository...", install.Channel),
+				Run:   func() ([]string, error) { return addRepository(install.Channel) },
+			},
+		)
+	} else {
+		steps = append(steps, common.Step{
+			Title: "Removing the nginx.org repository if present...",
+			Run:   removeRepository,
+		})
+	}
+
+	steps = append(steps,
+		common.CommandStep("Updating package list...", "apt-get update -y"),
+		common.Step{
+			Title: "Installing nginx...",
+			Run:   func() ([]string, error) { return installPackages(install) },
+		},
+		common.Step{
+			Title: "Saving install record...",
+			Run: func() ([]string, error) {
+				if err := SaveInstall(install); err != nil {
+					return nil, err
+				}
+				return []string{"Install record saved to " + InstallRecordPath}, nil
+			},
+		},
 	)
+
+	return steps
+}
+
+// addRepository writes the apt source and pin for the given nginx.org channel.
+func addRepository(channel string) ([]string, error) {
+	release, err := common.OSRelease()
+	if err != nil {
+		return nil, fmt.Errorf("error reading /etc/os-release: %v", err)
+	}
+	distro, codename := release["ID"], release["VERSION_CODENAME"]
+	if (distro != "ubuntu" && distro != "debian") || codename == "" {
+		return nil, fmt.Errorf("nginx.org packages are only set up for Debian and Ubuntu, found %s", distro)
+	}
+
+	path := "packages"
+	if channel == model.InstallMainline {
+		path = "packages/mainline"
+	}
+	source := fmt.Sprintf("deb [signed-by=%s] http://nginx.org/%s/%s %s nginx\n", nginxKeyring, path, distro, codename)
+	if err := os.WriteFile(nginxSourcesList, []byte(source), 0644); err != nil {
+		return nil, err
+	}
+
+	// Prefer nginx.org packages over the ones shipped by the distribution.
+	pin := "Package: *\nPin: origin nginx.org\nPin: release o=nginx\nPin-Priority: 900\n"
+	if err := os.WriteFile(nginxAptPin, []byte(pin), 0644); err != nil {
+		return nil, err
+	}
+	return []string{"Repository added: " + strings.TrimSpace(source)}, nil
+}
+
+// removeRepository drops a previously added nginx.org source so the distro package is used.
+func removeRepository() ([]string, error) {
+	var out []string
+	for _, path := range []string{nginxSourcesList, nginxAptPin} {
+		if common.FileExists(path) {
+			if err := os.Remove(path); err != nil {
+				return out, err
+			}
+			out = append(out, "Removed "+path)
+		}
+	}
+	return out, nil
+}
+
+// installPackages installs nginx and the extra modules, pinning the version if
+// one was given.
+func installPackages(install model.Install) ([]string, error) {
+	packages, held, out, err := installSpecs(install)
+	if err != nil {
+		return out, err
+	}
+	_ = common.RunCommand("apt-mark unhold " + strings.Join(held, " "))
+
+	cmd := "apt-get install -y " + strings.Join(packages, " ")
+	if install.Version != "" {
+		cmd += " --allow-downgrades"
+	}
+	lines, err := common.RunCommandOutput(cmd)
+	out = append(out, lines...)
+	if err != nil {
+		return out, err
+	}
+
+	if install.Version != "" {
+		if err := common.RunCommand("apt-mark hold " + strings.Join(held, " ")); err != nil {
+			return out, fmt.Errorf("error holding nginx version: %v", err)
+		}
+		out = append(out, strings.Join(held, ", ")+" held at the pinned version.")
+	}
+	return out, nil
+}
+
+// installSpecs returns the apt-get install arguments for nginx and its extra
+// modules and the package names to hold. A pinned version resolves every
+// module to its build for that nginx version, since nginx refuses to load
+// modules built for another one.
+func installSpecs(install model.Install) ([]string, []string, []string, error) {
+	var modules, out []string
+	for _, module := range install.Modules {
+		pkg := ModulePackage(install.Channel, module)
+		if !modulePattern.MatchString(pkg) {
+			return nil, nil, nil, fmt.Errorf("%q is not a valid module package name", module)
+		}
+		modules = append(modules, pkg)
+	}
+	held := append([]string{"nginx"}, modules...)
+	if install.Version == "" {
+		return held, held, nil, nil
+	}
+
+	version, err := ResolveVersion("nginx", install.Version)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	packages := []string{"nginx=" + version}
+	out = append(out, "Pinning nginx to "+version)
+
+	// Module builds are versioned <nginx-version>+<module-version> or
+	// share the nginx version outright.
+	upstream, _, _ := strings.Cut(version, "-")
+	for _, pkg := range modules {
+		moduleVersion, err := ResolveVersion(pkg, version)
+		if err != nil {
+			moduleVersion, err = ResolveVersion(pkg, upstream)
+		}
+		if err != nil {
+			return nil, nil, out, fmt.Errorf("no build of %s for nginx %s: %v", pkg, upstream, err)
+		}
+		packages = append(packages, pkg+"="+moduleVersion)
+		out = append(out, "Pinning "+pkg+" to "+moduleVersion)
+	}
+	return packages, held, out, nil
+}
+
+// ModulePackage maps a short module name such as "njs" or "geoip" to its
+// nginx.org package name. Distribution package names are used as given.
+func ModulePackage(channel string, module string) string {
+	if channel == model.InstallDistro || strings.HasPrefix(module, "nginx-module-") {
+		return module
+	}
+	return "nginx-module-" + module
+}
+
+// ResolveVersion turns a version prefix such as "1.26.2" into the full
+// package version known to apt, e.g. "1.26.2-1~jammy".
+func ResolveVersion(pkg string, want string) (string, error) {
+	out, err := exec.Command("apt-cache", "madison", pkg).Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 2 {
+			continue
+		}
+		version := strings.TrimSpace(fields[1])
+		if version == want || strings.HasPrefix(version, want+"-") || strings.HasPrefix(version, want+"+") {
+			return version, nil
+		}
+	}
+	return "", fmt.Errorf("version %s of %s is not available", want, pkg)
+}
+
+// SaveInstall stores the install choice so a reinstall can reproduce it.
+func SaveInstall(install model.Install) error {
+	if err := os.MkdirAll(filepath.Dir(InstallRecordPath), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(install, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(InstallRecordPath, data, 0644)
+}
+
+// LoadInstall reads the last install choice, falling back to the distro package.
+func LoadInstall() model.Install {
+	install := model.Install{Channel: model.InstallDistro}
+	data, err := os.ReadFile(InstallRecordPath)
+	if err != nil {
+		return install
+	}
+	_ = json.Unmarshal(data, &install)
+	return install
 }
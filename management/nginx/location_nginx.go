@@ -0,0 +1,383 @@
+package nginx
+
+import (
+	"fmt"
+	"nginx_configure/management/pki"
+	"nginx_configure/model"
+	"regexp"
+	"strings"
+)
+
+var (
+	poolNamePattern   = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+)
+
+// PoolUpstream is the name of the upstream block rendered for a pool. Upstream
+// names are shared by every config, so the site name is part of it.
+func PoolUpstream(site string, pool string) string {
+	return site + "_" + pool
+}
+
+// ParsePool parses a pool spec: a name, a colon and comma separated servers, e.g.
+//
+//	api: 10.0.0.5:8000 weight=2, 10.0.0.6:8000
+func ParsePool(spec string) (model.Pool, error) {
+	name, servers, found := strings.Cut(spec, ":")
+	pool := model.Pool{Name: strings.TrimSpace(name)}
+	if !found || !poolNamePattern.MatchString(pool.Name) {
+		return pool, fmt.Errorf("expected a pool name (letters, digits, - and _) followed by a colon, e.g. api: 10.0.0.5:8000")
+	}
+	for _, serverSpec := range strings.Split(servers, ",") {
+		if strings.TrimSpace(serverSpec) == "" {
+			continue
+		}
+		server, err := ParseUpstreamServer(serverSpec)
+		if err != nil {
+			return pool, err
+		}
+		pool.Servers = append(pool.Servers, server)
+	}
+	if err := ValidateUpstreams("", pool.Servers, model.Balancing{}); err != nil {
+		return pool, fmt.Errorf("pool %s: %v", pool.Name, err)
+	}
+	return pool, nil
+}
+
+// FormatPool renders a pool back into the spec accepted by ParsePool.
+func FormatPool(pool model.Pool) string {
+	var servers []string
+	for _, server := range pool.Servers {
+		servers = append(servers, FormatUpstreamServer(server))
+	}
+	return pool.Name + ": " + strings.Join(servers, ", ")
+}
+
+// ParseLocation parses a location spec: the path followed by options, e.g.
+//
+//	/api/ pool=api strip_prefix header=X-Api-Version:2
+//	/ws websocket pool=realtime
+//	~ ^/old/(.*)$ rewrite=^/old/(.*)$->/new/$1
+//	/assets/ root=/var/www/assets strip_prefix add_header=Cache-Control:max-age=3600
+//	/login pool=auth limit=5r/m:3
+//	/admin/ allow=10.0.0.0/8,192.168.0.0/16 auth=admins
+//
+// The path may be preceded by "=" for an exact match or "~" for a regex.
+func ParseLocation(spec string) (model.Location, error) {
+	fields := strings.Fields(spec)
+	var location model.Location
+	if len(fields) > 0 {
+		switch fields[0] {
+		case "=":
+			location.Match = model.MatchExact
+			fields = fields[1:]
+		case "~":
+			location.Match = model.MatchRegex
+			fields = fields[1:]
+		}
+	}
+	if len(fields) == 0 {
+		return location, fmt.Errorf("empty location")
+	}
+	location.Path = fields[0]
+
+	for _, option := range fields[1:] {
+		name, value, hasValue := strings.Cut(option, "=")
+		switch name {
+		case "pool", "root", "rewrite", "header", "add_header", "limit", "allow", "deny", "auth":
+			if value == "" {
+				return location, fmt.Errorf("%s needs a value, e.g. %s=...", name, name)
+			}
+		}
+		switch name {
+		case "pool":
+			location.Pool = value
+		case "root":
+			location.Root = value
+		case "rewrite":
+			regex, replacement, found := strings.Cut(value, "->")
+			if !found || regex == "" || replacement == "" {
+				return location, fmt.Errorf("rewrite needs regex->replacement, e.g. rewrite=^/old/(.*)$->/new/$1")
+			}
+			location.Rewrite = regex + " " + replacement
+		case "header", "add_header":
+			headerName, headerValue, found := strings.Cut(value, ":")
+			if !found {
+				return location, fmt.Errorf("%s needs Name:Value, got %q", name, option)
+			}
+			location.Headers = append(location.Headers, model.Header{Name: headerName, Value: headerValue, Response: name == "add_header"})
+		case "limit":
+			location.Limit = value
+		case "allow", "deny":
+			addresses, err := ParseAddresses(value)
+			if err != nil {
+				return location, err
+			}
+			if name == "allow" {
+				location.Allow = append(location.Allow, addresses...)
+			} else {
+				location.Deny = append(location.Deny, addresses...)
+			}
+		case "auth":
+			location.Auth = value
+		case "strip_prefix", "websocket":
+			if hasValue {
+				return location, fmt.Errorf("%s does not take a value", name)
+			}
+			if name == "strip_prefix" {
+				location.StripPrefix = true
+			} else {
+				location.Websocket = true
+			}
+		default:
+			return location, fmt.Errorf("unknown location option %q, use pool, root, strip_prefix, rewrite, websocket, header, add_header, limit, allow, deny or auth", option)
+		}
+	}
+	return location, ValidateLocation(location)
+}
+
+// FormatLocation renders a location back into the spec accepted by ParseLocation.
+func FormatLocation(location model.Location) string {
+	var parts []string
+	switch location.Match {
+	case model.MatchExact:
+		parts = append(parts, "=")
+	case model.MatchRegex:
+		parts = append(parts, "~")
+	}
+	parts = append(parts, location.Path)
+	if location.Pool != "" {
+		parts = append(parts, "pool="+location.Pool)
+	}
+	if location.Root != "" {
+		parts = append(parts, "root="+location.Root)
+	}
+	if location.StripPrefix {
+		parts = append(parts, "strip_prefix")
+	}
+	if location.Rewrite != "" {
+		regex, replacement, _ := strings.Cut(location.Rewrite, " ")
+		parts = append(parts, "rewrite="+regex+"->"+replacement)
+	}
+	if location.Websocket {
+		parts = append(parts, "websocket")
+	}
+	for _, header := range location.Headers {
+		name := "header"
+		if header.Response {
+			name = "add_header"
+		}
+		parts = append(parts, name+"="+header.Name+":"+header.Value)
+	}
+	if location.Limit != "" {
+		parts = append(parts, "limit="+location.Limit)
+	}
+	if len(location.Allow) > 0 {
+		parts = append(parts, "allow="+strings.Join(location.Allow, ","))
+	}
+	if len(location.Deny) > 0 {
+		parts = append(parts, "deny="+strings.Join(location.Deny, ","))
+	}
+	if location.Auth != "" {
+		parts = append(parts, "auth="+location.Auth)
+	}
+	return strings.Join(parts, " ")
+}
+
+// ValidateLocation checks a location on its own.
+func ValidateLocation(location model.Location) error {
+	if location.Path == "" || strings.ContainsAny(location.Path, "{};\"'") {
+		return fmt.Errorf("%q is not a valid location path", location.Path)
+	}
+	if location.Match == model.MatchRegex {
+		if _, err := regexp.Compile(location.Path); err != nil {
+			return fmt.Errorf("%s: %v", location.Path, err)
+		}
+		if location.StripPrefix {
+			return fmt.Errorf("%s: strip_prefix only works on prefix and exact locations, use rewrite for regex locations", location.Path)
+		}
+	} else if !strings.HasPrefix(location.Path, "/") {
+		return fmt.Errorf("%s: the path must start with /", location.Path)
+	}
+
+	if location.Root != "" {
+		if !strings.HasPrefix(location.Root, "/") || strings.ContainsAny(location.Root, "{};\"' ") {
+			return fmt.Errorf("%s: root must be an absolute directory", location.Path)
+		}
+		if location.Pool != "" {
+			return fmt.Errorf("%s: a location either serves files (root) or proxies (pool), not both", location.Path)
+		}
+		if location.Websocket {
+			return fmt.Errorf("%s: websocket needs a proxied location", location.Path)
+		}
+		if location.Rewrite != "" {
+			return fmt.Errorf("%s: rewrite needs a proxied location", location.Path)
+		}
+	}
+	if location.Rewrite != "" {
+		regex, replacement, _ := strings.Cut(location.Rewrite, " ")
+		if _, err := regexp.Compile(regex); err != nil {
+			return fmt.Errorf("%s: rewrite: %v", location.Path, err)
+		}
+		if strings.ContainsAny(location.Rewrite, "{};\"'") || strings.Contains(replacement, " ") {
+			return fmt.Errorf("%s: rewrite must not contain spaces, quotes or ; { }", location.Path)
+		}
+		if location.StripPrefix {
+			return fmt.Errorf("%s: use either strip_prefix or rewrite", location.Path)
+		}
+	}
+	if location.Limit != "" {
+		if _, _, _, err := ParseLimit(location.Limit); err != nil {
+			return fmt.Errorf("%s: %v", location.Path, err)
+		}
+	}
+	for _, address := range append(append([]string{}, location.Allow...), location.Deny...) {
+		if err := validateAddress(address); err != nil {
+			return fmt.Errorf("%s: %v", location.Path, err)
+		}
+	}
+	if location.Auth != "" && location.Auth != "off" {
+		if err := pki.ValidateHtpasswdName(location.Auth); err != nil {
+			return fmt.Errorf("%s: %v", location.Path, err)
+		}
+	}
+	for _, header := range location.Headers {
+		if !headerNamePattern.MatchString(header.Name) {
+			return fmt.Errorf("%s: %q is not a valid header name", location.Path, header.Name)
+		}
+		if strings.ContainsAny(header.Value, "\"\n;{}") {
+			return fmt.Errorf("%s: header %s must not contain quotes or ; { }", location.Path, header.Name)
+		}
+		if !header.Response && location.Root != "" {
+			return fmt.Errorf("%s: request headers need a proxied location, use add_header for response headers", location.Path)
+		}
+	}
+	return nil
+}
+
+// ValidateLocations checks the locations of a site against each other and its pools.
+func ValidateLocations(site model.Site) error {
+	pools := make(map[string]bool)
+	for _, pool := range site.Pools {
+		if pools[pool.Name] {
+			return fmt.Errorf("pool %s is defined twice", pool.Name)
+		}
+		pools[pool.Name] = true
+	}
+	seen := make(map[string]bool)
+	for _, location := range site.Locations {
+		if err := ValidateLocation(location); err != nil {
+			return err
+		}
+		key := location.Match + " " + location.Path
+		if location.Match == "" {
+			key = model.MatchPrefix + " " + location.Path
+		}
+		if seen[key] {
+			return fmt.Errorf("location %s is defined twice", location.Path)
+		}
+		seen[key] = true
+		if location.Pool != "" && !pools[location.Pool] {
+			return fmt.Errorf("%s: there is no pool named %s", location.Path, location.Pool)
+		}
+	}
+	return nil
+}
+
+// SiteLocations returns the locations of a site, or the single proxy
+// location every site had before locations could be configured.
+func SiteLocations(site model.Site) []model.Location {
+	if len(site.Locations) > 0 {
+		return site.Locations
+	}
+	return []model.Location{{Path: "/", Websocket: site.Setup == "Websocket"}}
+}
+
+// renderLocation renders one location block.
+func renderLocation(site model.Site, index int, location model.Location) string {
+	var sb strings.Builder
+	switch location.Match {
+	case model.MatchExact:
+		sb.WriteString(fmt.Sprintf("\tlocation = %s {\n", location.Path))
+	case model.MatchRegex:
+		sb.WriteString(fmt.Sprintf("\tlocation ~ %s {\n", location.Path))
+	default:
+		sb.WriteString(fmt.Sprintf("\tlocation %s {\n", location.Path))
+	}
+
+	if location.Root != "" {
+		if location.StripPrefix {
+			// alias replaces the location path, its trailing slash has to match.
+			alias := strings.TrimSuffix(location.Root, "/")
+			if strings.HasSuffix(location.Path, "/") {
+				alias += "/"
+			}
+			sb.WriteString(fmt.Sprintf("\t\talias %s;\n", alias))
+		} else {
+			sb.WriteString(fmt.Sprintf("\t\troot %s;\n", location.Root))
+		}
+		sb.WriteString("\t\ttry_files $uri $uri/ =404;\n")
+		sb.WriteString(locationLimit(site, index, location))
+		sb.WriteString(locationAccess(site, location))
+		writeResponseHeaders(&sb, site, location)
+		sb.WriteString("\t}")
+		return sb.String()
+	}
+
+	if location.StripPrefix {
+		prefix := regexp.QuoteMeta(strings.TrimSuffix(location.Path, "/"))
+		sb.WriteString(fmt.Sprintf("\t\trewrite ^%s/?(.*)$ /$1 break;\n", prefix))
+	} else if location.Rewrite != "" {
+		sb.WriteString(fmt.Sprintf("\t\trewrite %s break;\n", location.Rewrite))
+	}
+
+	upstream := site.Name
+	if location.Pool != "" {
+		upstream = PoolUpstream(site.Name, location.Pool)
+	}
+	sb.WriteString(fmt.Sprintf("\t\tproxy_pass http://%s;\n", upstream))
+	sb.WriteString(locationLimit(site, index, location))
+	sb.WriteString(locationAccess(site, location))
+	sb.WriteString("\n")
+
+	if location.Websocket {
+		sb.WriteString("\t\tproxy_http_version 1.1;\n")
+		sb.WriteString("\t\tproxy_set_header Upgrade $http_upgrade;\n")
+		sb.WriteString("\t\tproxy_set_header Connection \"upgrade\";\n\n")
+	} else if site.Tuning.Keepalive > 0 {
+		// Upstream keepalive needs HTTP/1.1 and must not forward the client's Connection header.
+		sb.WriteString("\t\tproxy_http_version 1.1;\n")
+		sb.WriteString("\t\tproxy_set_header Connection \"\";\n\n")
+	}
+
+	sb.WriteString("\t\tproxy_set_header Host $host;\n\n")
+	sb.WriteString("\t\tproxy_set_header X-Real-IP $remote_addr;\n")
+	sb.WriteString("\t\tproxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;\n")
+	sb.WriteString("\t\tproxy_set_header X-Forwarded-Proto $scheme;\n")
+	sb.WriteString(clientCertRequestHeaders(site, "proxy"))
+	for _, header := range location.Headers {
+		if !header.Response {
+			sb.WriteString(fmt.Sprintf("\t\tproxy_set_header %s \"%s\";\n", header.Name, header.Value))
+		}
+	}
+	writeResponseHeaders(&sb, site, location)
+
+	if tuning := locationTuning(site.Tuning, "proxy"); tuning != "" {
+		sb.WriteString("\n" + tuning)
+	}
+	sb.WriteString("\t}")
+	return sb.String()
+}
+
+func writeResponseHeaders(sb *strings.Builder, site model.Site, location model.Location) {
+	written := false
+	for _, header := range location.Headers {
+		if header.Response {
+			sb.WriteString(fmt.Sprintf("\t\tadd_header %s \"%s\" always;\n", header.Name, header.Value))
+			written = true
+		}
+	}
+	if written {
+		sb.WriteString(locationSecurityHeaders(site))
+	}
+}
@@ -0,0 +1,94 @@
+package nginx
+
+import (
+	"nginx_configure/model"
+	"strings"
+	"testing"
+)
+
+func TestParseLocation(t *testing.T) {
+	tests := []string{
+		"/api/ pool=api strip_prefix header=X-Api-Version:2",
+		"/ws websocket pool=realtime",
+		"~ ^/old/(.*)$ rewrite=^/old/(.*)$->/new/$1",
+		"/assets/ root=/var/www/assets strip_prefix add_header=Cache-Control:max-age=3600",
+		"/login pool=auth limit=5r/m:3",
+		"/admin/ allow=10.0.0.0/8,192.168.0.0/16 auth=admins",
+		"= /healthz deny=all",
+	}
+	for _, spec := range tests {
+		t.Run(spec, func(t *testing.T) {
+			location, err := ParseLocation(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := ParseLocation(FormatLocation(location))
+			if err != nil {
+				t.Fatalf("formatted as %q: %v", FormatLocation(location), err)
+			}
+			if FormatLocation(again) != FormatLocation(location) {
+				t.Fatalf("round trip changed %q to %q", FormatLocation(location), FormatLocation(again))
+			}
+		})
+	}
+}
+
+func TestParseLocationFields(t *testing.T) {
+	location, err := ParseLocation("/assets/ root=/var/www/assets strip_prefix add_header=Cache-Control:max-age=3600 add_header=X-Env:prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Match != "" || location.Path != "/assets/" || location.Root != "/var/www/assets" || !location.StripPrefix {
+		t.Fatalf("got %+v", location)
+	}
+	want := []model.Header{
+		{Name: "Cache-Control", Value: "max-age=3600", Response: true},
+		{Name: "X-Env", Value: "prod", Response: true},
+	}
+	if len(location.Headers) != len(want) {
+		t.Fatalf("got headers %+v, want %+v", location.Headers, want)
+	}
+	for i := range want {
+		if location.Headers[i] != want[i] {
+			t.Fatalf("got headers %+v, want %+v", location.Headers, want)
+		}
+	}
+
+	location, err = ParseLocation("~ ^/old/(.*)$ rewrite=^/old/(.*)$->/new/$1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Match != model.MatchRegex || location.Rewrite != "^/old/(.*)$ /new/$1" {
+		t.Fatalf("got %+v", location)
+	}
+}
+
+func TestParseLocationErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"", "empty location"},
+		{"=", "empty location"},
+		{"/api/ pool=", "pool needs a value"},
+		{"/old rewrite=^/old", "rewrite needs regex->replacement"},
+		{"/api/ header=X-Api-Version", "header needs Name:Value"},
+		{"/api/ strip_prefix=yes", "strip_prefix does not take a value"},
+		{"/admin/ allow=10.0.0.0/33", "is not an address or CIDR"},
+		{"/api/ cache=on", "unknown location option"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := ParseLocation(tt.spec)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseLocationRequestHeaderNeedsProxy(t *testing.T) {
+	if _, err := ParseLocation("/assets/ root=/var/www/assets header=X-Env:prod"); err == nil {
+		t.Fatal("accepted a request header on a location serving files")
+	}
+}
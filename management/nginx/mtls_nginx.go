@@ -0,0 +1,163 @@
+package nginx
+
+import (
+	"fmt"
+	"nginx_configure/common"
+	"nginx_configure/management/pki"
+	"nginx_configure/model"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Client certificate verification modes.
+const (
+	VerifyOn       = "on"
+	VerifyOptional = "optional"
+)
+
+// DefaultClientAuth is the verification a site starts with once a CA is chosen.
+var DefaultClientAuth = model.ClientAuth{Verify: VerifyOn, Depth: 1, ForwardHeaders: true}
+
+// clientCertHeaders are the request headers carrying the client certificate to the upstream.
+var clientCertHeaders = []model.Header{
+	{Name: "X-SSL-Client-Verify", Value: "$ssl_client_verify"},
+	{Name: "X-SSL-Client-DN", Value: "$ssl_client_s_dn"},
+	{Name: "X-SSL-Client-Serial", Value: "$ssl_client_serial"},
+}
+
+// ClientAuthField is one value of the client certificate verification that can be edited on its own.
+type ClientAuthField struct {
+	Label string
+	Hint  string
+	Get   func(c model.ClientAuth) string
+	Set   func(c *model.ClientAuth, value string) error
+}
+
+// ClientAuthFields are the editable client certificate values in the order they are shown.
+var ClientAuthFields = []ClientAuthField{
+	{
+		Label: "Verify client",
+		Hint:  "on rejects requests without a valid certificate, optional lets the upstream decide using X-SSL-Client-Verify",
+		Get:   func(c model.ClientAuth) string { return c.Verify },
+		Set: func(c *model.ClientAuth, value string) error {
+			if value != VerifyOn && value != VerifyOptional {
+				return fmt.Errorf("verify must be on or optional, got %q", value)
+			}
+			c.Verify = value
+			return nil
+		},
+	},
+	{
+		Label: "Verify depth",
+		Hint:  "1 when clients are signed by the CA directly, more for intermediate CAs",
+		Get:   func(c model.ClientAuth) string { return strconv.Itoa(c.Depth) },
+		Set: func(c *model.ClientAuth, value string) error {
+			depth, err := strconv.Atoi(value)
+			if err != nil || depth < 1 || depth > 10 {
+				return fmt.Errorf("the verify depth must be a number from 1 to 10, got %q", value)
+			}
+			c.Depth = depth
+			return nil
+		},
+	},
+	{
+		Label: "Forward DN and serial to the upstream",
+		Hint:  "yes or no; sends X-SSL-Client-Verify, X-SSL-Client-DN and X-SSL-Client-Serial",
+		Get: func(c model.ClientAuth) string {
+			if c.ForwardHeaders {
+				return "yes"
+			}
+			return "no"
+		},
+		Set: func(c *model.ClientAuth, value string) error {
+			switch strings.ToLower(value) {
+			case "yes", "y":
+				c.ForwardHeaders = true
+			case "no", "n":
+				c.ForwardHeaders = false
+			default:
+				return fmt.Errorf("please answer yes or no")
+			}
+			return nil
+		},
+	},
+}
+
+// ClientCAs lists the CAs client certificates can be verified against: the
+// private CA of this tool and the Cloudflare origin-pull CA first, then the
+// certificates in certBasePath.
+func ClientCAs(certBasePath string) []string {
+	cas := []string{model.ClientCAPrivate, model.ClientCACloudflare}
+	matches, _ := filepath.Glob(filepath.Join(certBasePath, "*.crt"))
+	for _, match := range matches {
+		cas = append(cas, strings.TrimSuffix(filepath.Base(match), ".crt"))
+	}
+	return cas
+}
+
+// ClientCAPath is the file ssl_client_certificate points at for a CA name.
+func ClientCAPath(certBasePath string, ca string) string {
+	switch ca {
+	case model.ClientCAPrivate:
+		return pki.CACertPath
+	case model.ClientCACloudflare:
+		return OriginPullCAPath
+	}
+	return filepath.Join(certBasePath, ca+".crt")
+}
+
+// ValidateClientAuth checks the client certificate verification of a site.
+func ValidateClientAuth(certBasePath string, site model.Site) error {
+	auth := site.ClientAuth
+	if auth.CA == "" {
+		return nil
+	}
+	if site.CType != "SSL" {
+		return fmt.Errorf("client certificates need an SSL site")
+	}
+	if auth.Verify != VerifyOn && auth.Verify != VerifyOptional {
+		return fmt.Errorf("verify must be on or optional, got %q", auth.Verify)
+	}
+	if auth.Depth < 1 {
+		return fmt.Errorf("the verify depth must be at least 1")
+	}
+	if auth.CA == model.ClientCAPrivate || auth.CA == model.ClientCACloudflare {
+		return nil
+	}
+	if path := ClientCAPath(certBasePath, auth.CA); !common.FileExists(path) {
+		return fmt.Errorf("the client CA %s does not exist", path)
+	}
+	return nil
+}
+
+// clientAuthDirectives renders the server level client certificate verification.
+func clientAuthDirectives(certBasePath string, site model.Site) string {
+	auth := site.ClientAuth
+	if auth.CA == "" {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("\n\n\tssl_client_certificate %s;", ClientCAPath(certBasePath, auth.CA)))
+	sb.WriteString(fmt.Sprintf("\n\tssl_verify_client %s;", auth.Verify))
+	sb.WriteString(fmt.Sprintf("\n\tssl_verify_depth %d;", auth.Depth))
+	return sb.String()
+}
+
+// clientCertRequestHeaders renders the headers passing the client certificate
+// to the upstream with the given module (proxy or grpc). Without ForwardHeaders
+// they are set empty, which strips them, so clients cannot forge them.
+func clientCertRequestHeaders(site model.Site, module string) string {
+	if site.ClientAuth.CA == "" {
+		return ""
+	}
+	var sb strings.Builder
+	for _, header := range clientCertHeaders {
+		value := header.Value
+		if !site.ClientAuth.ForwardHeaders {
+			value = `""`
+		}
+		sb.WriteString(fmt.Sprintf("\t\t%s_set_header %s %s;\n", module, header.Name, value))
+	}
+	return sb.String()
+}
@@ -0,0 +1,187 @@
+package nginx
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"nginx_configure/common"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// OriginPullCAURL publishes the CA Cloudflare signs the client certificate
+// with that it presents to origins when Authenticated Origin Pulls is on.
+const OriginPullCAURL = "https://developers.cloudflare.com/ssl/static/authenticated_origin_pull_ca.pem"
+
+// OriginPullCAPath is the copy of the origin-pull CA sites verify Cloudflare against.
+var OriginPullCAPath = filepath.Join(CDNRangesBasePath, "cloudflare-origin-pull-ca.pem")
+
+const originPullCommonName = "origin-pull.cloudflare.net"
+
+// originPullCA is the copy of OriginPullCAURL shipped with the binary, written
+// on first use so configuring a site does not depend on reaching Cloudflare.
+//
+//go:embed cloudflare_origin_pull_ca.pem
+var originPullCA []byte
+
+var certNamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// ImportedCert describes a certificate copied into the cert base path.
+type ImportedCert struct {
+	Name     string
+	Domains  []string
+	KeyType  string
+	NotAfter time.Time
+	// OriginCA is set for certificates issued by the Cloudflare Origin CA.
+	OriginCA bool
+}
+
+// ImportCert copies a PEM certificate and its private key into certBasePath as
+// name.crt and name.key after checking that they belong together.
+func ImportCert(certBasePath string, name string, certFile string, keyFile string) (ImportedCert, error) {
+	if !certNamePattern.MatchString(name) {
+		return ImportedCert{}, fmt.Errorf("%q is not a valid certificate name, use letters, digits and . _ -", name)
+	}
+	certPath, keyPath := filepath.Join(certBasePath, name+".crt"), filepath.Join(certBasePath, name+".key")
+	for _, path := range []string{certPath, keyPath} {
+		if common.FileExists(path) {
+			return ImportedCert{}, fmt.Errorf("%s already exists, choose another name", path)
+		}
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return ImportedCert{}, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return ImportedCert{}, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return ImportedCert{}, fmt.Errorf("the certificate and key do not form a pair: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return ImportedCert{}, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return ImportedCert{}, fmt.Errorf("the certificate expired on %s", leaf.NotAfter.Format("2006-01-02"))
+	}
+
+	if err := os.MkdirAll(certBasePath, 0755); err != nil {
+		return ImportedCert{}, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return ImportedCert{}, err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		os.Remove(keyPath)
+		return ImportedCert{}, err
+	}
+	keyType, err := CertKeyType(certPath)
+	if err != nil {
+		keyType = "unknown key"
+	}
+	return ImportedCert{
+		Name:     name,
+		Domains:  leaf.DNSNames,
+		KeyType:  keyType,
+		NotAfter: leaf.NotAfter,
+		OriginCA: common.OriginCA(certPath),
+	}, nil
+}
+
+// OriginCAWarning explains what an Origin CA certificate means for a site.
+func OriginCAWarning(name string) []string {
+	return []string{
+		name + " is issued by the Cloudflare Origin CA. Browsers do not trust it, so the site only works proxied by Cloudflare with SSL mode Full (strict).",
+		"Turn on Authenticated Origin Pulls to accept only requests from Cloudflare: choose Cloudflare origin pulls as the client certificate CA of the site.",
+	}
+}
+
+// EnsureOriginPullCA writes the embedded Cloudflare origin-pull CA unless a
+// valid copy exists. refresh downloads the current one from Cloudflare instead.
+// Without a valid embedded copy it is downloaded as well.
+func EnsureOriginPullCA(refresh bool) ([]string, error) {
+	if !refresh {
+		if checkOriginPullCA(OriginPullCAPath) == nil {
+			return nil, nil
+		}
+		if parseOriginPullCA(originPullCA) == nil {
+			if err := writeOriginPullCA(originPullCA); err != nil {
+				return nil, err
+			}
+			return []string{"Saved the bundled Cloudflare origin-pull CA to " + OriginPullCAPath}, nil
+		}
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(OriginPullCAURL)
+	if err != nil {
+		if !refresh {
+			return nil, fmt.Errorf("this build has no valid bundled Cloudflare origin-pull CA and downloading it failed: %v", err)
+		}
+		return nil, fmt.Errorf("downloading the Cloudflare origin-pull CA failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", OriginPullCAURL, resp.Status)
+	}
+	if err := parseOriginPullCA(body); err != nil {
+		return nil, fmt.Errorf("%s: %v", OriginPullCAURL, err)
+	}
+	if err := writeOriginPullCA(body); err != nil {
+		return nil, err
+	}
+	return []string{"Saved the Cloudflare origin-pull CA to " + OriginPullCAPath}, nil
+}
+
+// writeOriginPullCA replaces OriginPullCAPath with data in one rename.
+func writeOriginPullCA(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(OriginPullCAPath), 0755); err != nil {
+		return err
+	}
+	tmp := OriginPullCAPath + ".new"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, OriginPullCAPath)
+}
+
+// checkOriginPullCA checks that path holds the Cloudflare origin-pull CA.
+func checkOriginPullCA(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return parseOriginPullCA(data)
+}
+
+// parseOriginPullCA checks that data is the PEM of the Cloudflare origin-pull CA.
+func parseOriginPullCA(data []byte) error {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("not a PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if !cert.IsCA || !strings.EqualFold(cert.Subject.CommonName, originPullCommonName) {
+		return fmt.Errorf("not the Cloudflare origin-pull CA (%s)", cert.Subject.CommonName)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("the origin-pull CA expired on %s", cert.NotAfter.Format("2006-01-02"))
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package nginx
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+// TestEmbeddedOriginPullCA keeps a placeholder or a wrong file from being
+// bundled in place of the Cloudflare origin-pull CA.
+func TestEmbeddedOriginPullCA(t *testing.T) {
+	block, _ := pem.Decode(originPullCA)
+	if block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("cloudflare_origin_pull_ca.pem holds no PEM certificate, copy it from %s", OriginPullCAURL)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != originPullCommonName || !cert.IsCA {
+		t.Fatalf("got %q (CA %v), want the CA %s", cert.Subject.CommonName, cert.IsCA, originPullCommonName)
+	}
+	if err := parseOriginPullCA(originPullCA); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,399 @@
+package nginx
+
+import (
+	"fmt"
+	"nginx_configure/common"
+	"nginx_configure/model"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LimitZonesPath holds the limit_req_zone, limit_conn_zone and map blocks of
+// every site. Zones are defined in the http context, which every conf.d file
+// shares, so they are rendered into one file from the stored sites.
+var LimitZonesPath = "/etc/nginx/nginx_configure_limits.conf"
+
+const limitZoneSize = "10m"
+
+var (
+	ratePattern      = regexp.MustCompile(`^[1-9][0-9]*r/[sm]$`)
+	httpBlockStart   = regexp.MustCompile(`^http\s*\{`)
+	zoneNameReplacer = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// ProtectionField is one value of the protection section that can be edited on its own.
+type ProtectionField struct {
+	Label string
+	Hint  string
+	Get   func(p model.Protection) string
+	Set   func(p *model.Protection, value string) error
+}
+
+// ProtectionFields are the editable protection values in the order they are shown.
+var ProtectionFields = []ProtectionField{
+	{
+		Label: "Request rate per client",
+		Hint:  "e.g. 10r/s or 300r/m, or off",
+		Get:   func(p model.Protection) string { return offIfEmpty(p.Rate) },
+		Set: func(p *model.Protection, value string) error {
+			if value == "" || value == "off" {
+				p.Rate = ""
+				return nil
+			}
+			if !ratePattern.MatchString(value) {
+				return fmt.Errorf("the rate must be requests per second or minute, e.g. 10r/s or 300r/m, got %q", value)
+			}
+			p.Rate = value
+			return nil
+		},
+	},
+	{
+		Label: "Burst",
+		Hint:  "requests queued above the rate, optionally followed by nodelay to serve them at once, e.g. 20 nodelay",
+		Get: func(p model.Protection) string {
+			value := strconv.Itoa(p.Burst)
+			if p.NoDelay {
+				value += " nodelay"
+			}
+			return value
+		},
+		Set: func(p *model.Protection, value string) error {
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				p.Burst, p.NoDelay = 0, false
+				return nil
+			}
+			burst, err := strconv.Atoi(fields[0])
+			if err != nil || burst < 0 {
+				return fmt.Errorf("the burst must be a number, got %q", fields[0])
+			}
+			noDelay := false
+			if len(fields) == 2 && fields[1] == "nodelay" {
+				noDelay = true
+			} else if len(fields) > 1 {
+				return fmt.Errorf("only nodelay may follow the burst")
+			}
+			p.Burst, p.NoDelay = burst, noDelay
+			return nil
+		},
+	},
+	{
+		Label: "Connections per client",
+		Hint:  "concurrent connections, e.g. 20, or off",
+		Get: func(p model.Protection) string {
+			if p.Connections == 0 {
+				return "off"
+			}
+			return strconv.Itoa(p.Connections)
+		},
+		Set: func(p *model.Protection, value string) error {
+			if value == "" || value == "off" {
+				p.Connections = 0
+				return nil
+			}
+			connections, err := strconv.Atoi(value)
+			if err != nil || connections < 1 {
+				return fmt.Errorf("the connection limit must be a positive number, got %q", value)
+			}
+			p.Connections = connections
+			return nil
+		},
+	},
+	{
+		Label: "Client key",
+		Hint:  "remote_addr, header <Name> (e.g. header X-Forwarded-For) or api_key <Header> (clients without the key are limited by address)",
+		Get: func(p model.Protection) string {
+			switch p.Key {
+			case model.LimitByHeader, model.LimitByAPIKey:
+				return p.Key + " " + p.Header
+			}
+			return model.LimitByAddress
+		},
+		Set: func(p *model.Protection, value string) error {
+			fields := strings.Fields(value)
+			if len(fields) == 0 || (fields[0] == model.LimitByAddress && len(fields) == 1) {
+				p.Key, p.Header = "", ""
+				return nil
+			}
+			switch fields[0] {
+			case model.LimitByHeader, model.LimitByAPIKey:
+				header := "X-API-Key"
+				if len(fields) == 2 {
+					header = fields[1]
+				} else if len(fields) != 1 || fields[0] == model.LimitByHeader {
+					return fmt.Errorf("%s needs one header name, e.g. %s X-Forwarded-For", fields[0], fields[0])
+				}
+				if !headerNamePattern.MatchString(header) {
+					return fmt.Errorf("%q is not a valid header name", header)
+				}
+				p.Key, p.Header = fields[0], header
+				return nil
+			}
+			return fmt.Errorf("the client key must be remote_addr, header <Name> or api_key <Header>, got %q", value)
+		},
+	},
+	{
+		Label: "Response when limited",
+		Hint:  "status code, optionally followed by the body, e.g. 429 Too many requests, try again later",
+		Get: func(p model.Protection) string {
+			return strings.TrimSpace(strconv.Itoa(limitStatus(p)) + " " + p.Message)
+		},
+		Set: func(p *model.Protection, value string) error {
+			code, message, _ := strings.Cut(strings.TrimSpace(value), " ")
+			if code == "" {
+				p.Status, p.Message = 0, ""
+				return nil
+			}
+			status, err := strconv.Atoi(code)
+			if err != nil || status < 400 || status > 599 {
+				return fmt.Errorf("the status must be between 400 and 599, got %q", code)
+			}
+			message = strings.TrimSpace(message)
+			if strings.ContainsAny(message, "\"\n{}") {
+				return fmt.Errorf("the body must not contain double quotes or { }")
+			}
+			p.Status, p.Message = status, message
+			return nil
+		},
+	},
+}
+
+// Protected reports whether a site limits requests or connections.
+func Protected(site model.Site) bool {
+	return site.Protection.Rate != "" || site.Protection.Connections > 0
+}
+
+func limitStatus(p model.Protection) int {
+	if p.Status == 0 {
+		return 429
+	}
+	return p.Status
+}
+
+// ParseLimit parses a location limit override: "off" or RATE[:BURST][:nodelay], e.g. 5r/s:10:nodelay.
+func ParseLimit(spec string) (rate string, burst int, noDelay bool, err error) {
+	if spec == "off" {
+		return "off", 0, false, nil
+	}
+	parts := strings.Split(spec, ":")
+	rate = parts[0]
+	if !ratePattern.MatchString(rate) {
+		return "", 0, false, fmt.Errorf("limit needs off or RATE[:BURST][:nodelay], e.g. limit=5r/s:10:nodelay, got %q", spec)
+	}
+	for _, part := range parts[1:] {
+		if part == "nodelay" {
+			noDelay = true
+			continue
+		}
+		if burst, err = strconv.Atoi(part); err != nil || burst < 0 {
+			return "", 0, false, fmt.Errorf("limit needs off or RATE[:BURST][:nodelay], e.g. limit=5r/s:10:nodelay, got %q", spec)
+		}
+	}
+	return rate, burst, noDelay, nil
+}
+
+// zoneName returns a limit zone or variable name derived from the site name.
+func zoneName(site string, suffix string) string {
+	return zoneNameReplacer.ReplaceAllString(site, "_") + "_" + suffix
+}
+
+// limitKey returns the variable requests are counted by.
+func limitKey(site model.Site) string {
+	switch site.Protection.Key {
+	case model.LimitByHeader:
+		return "$http_" + strings.ReplaceAll(strings.ToLower(site.Protection.Header), "-", "_")
+	case model.LimitByAPIKey:
+		return "$" + zoneName(site.Name, "limit_key")
+	}
+	return "$binary_remote_addr"
+}
+
+// RenderZones renders the http level zone definitions of the given sites.
+func RenderZones(sites []model.Site) string {
+	var sb strings.Builder
+	sb.WriteString("# Rate and connection limit zones managed by nginx_configure.\n")
+	sb.WriteString("# This file is rendered from the stored sites, changes are overwritten.\n")
+	for _, site := range sites {
+		if !Protected(site) || site.Setup == SetupStream {
+			continue
+		}
+		p := site.Protection
+		key := limitKey(site)
+		sb.WriteString(fmt.Sprintf("\n# %s\n", site.Name))
+		if p.Key == model.LimitByAPIKey {
+			header := "$http_" + strings.ReplaceAll(strings.ToLower(p.Header), "-", "_")
+			sb.WriteString(fmt.Sprintf("map %s %s {\n    \"\" $binary_remote_addr;\n    default %s;\n}\n", header, key, header))
+		}
+		if p.Rate != "" {
+			sb.WriteString(fmt.Sprintf("limit_req_zone %s zone=%s:%s rate=%s;\n", key, zoneName(site.Name, "req"), limitZoneSize, p.Rate))
+		}
+		if p.Connections > 0 {
+			sb.WriteString(fmt.Sprintf("limit_conn_zone %s zone=%s:%s;\n", key, zoneName(site.Name, "conn"), limitZoneSize))
+		}
+		for i, location := range SiteLocations(site) {
+			if location.Limit == "" || location.Limit == "off" {
+				continue
+			}
+			rate, _, _, _ := ParseLimit(location.Limit)
+			sb.WriteString(fmt.Sprintf("limit_req_zone %s zone=%s:%s rate=%s;\n", key, zoneName(site.Name, "loc"+strconv.Itoa(i)), limitZoneSize, rate))
+		}
+	}
+	return sb.String()
+}
+
+// protectionDirectives renders the server level limits of a site.
+func protectionDirectives(site model.Site) string {
+	if !Protected(site) {
+		return ""
+	}
+	p := site.Protection
+	status := limitStatus(p)
+	var sb strings.Builder
+	sb.WriteString("\n")
+	if p.Rate != "" {
+		sb.WriteString("\n\t" + limitReqDirective(zoneName(site.Name, "req"), p.Burst, p.NoDelay))
+		sb.WriteString(fmt.Sprintf("\n\tlimit_req_status %d;", status))
+	}
+	if p.Connections > 0 {
+		sb.WriteString(fmt.Sprintf("\n\tlimit_conn %s %d;", zoneName(site.Name, "conn"), p.Connections))
+		sb.WriteString(fmt.Sprintf("\n\tlimit_conn_status %d;", status))
+	}
+	if p.Message != "" {
+		limited := "@" + zoneName(site.Name, "limited")
+		sb.WriteString(fmt.Sprintf("\n\terror_page %d %s;", status, limited))
+		sb.WriteString(fmt.Sprintf("\n\n\tlocation %s {", limited))
+		sb.WriteString("\n\t\tdefault_type text/plain;")
+		sb.WriteString(fmt.Sprintf("\n\t\treturn %d \"%s\";", status, p.Message))
+		sb.WriteString("\n\t}")
+	}
+	return sb.String()
+}
+
+func limitReqDirective(zone string, burst int, noDelay bool) string {
+	directive := "limit_req zone=" + zone
+	if burst > 0 {
+		directive += fmt.Sprintf(" burst=%d", burst)
+	}
+	if noDelay {
+		directive += " nodelay"
+	}
+	return directive + ";"
+}
+
+// locationLimit renders the limit override of a location. nginx cannot turn
+// an inherited limit off, so "off" only logs what would have been limited.
+func locationLimit(site model.Site, index int, location model.Location) string {
+	if !Protected(site) || location.Limit == "" {
+		return ""
+	}
+	if location.Limit == "off" {
+		var sb strings.Builder
+		if site.Protection.Rate != "" {
+			sb.WriteString("\t\tlimit_req_dry_run on;\n")
+		}
+		if site.Protection.Connections > 0 {
+			sb.WriteString("\t\tlimit_conn_dry_run on;\n")
+		}
+		return sb.String()
+	}
+	_, burst, noDelay, _ := ParseLimit(location.Limit)
+	return "\t\t" + limitReqDirective(zoneName(site.Name, "loc"+strconv.Itoa(index)), burst, noDelay) + "\n"
+}
+
+// ValidateProtection checks the protection section of a site.
+func ValidateProtection(site model.Site) error {
+	if !Protected(site) {
+		for _, location := range site.Locations {
+			if location.Limit != "" {
+				return fmt.Errorf("%s: limit overrides need a request rate or connection limit on the site", location.Path)
+			}
+		}
+		return nil
+	}
+	p := site.Protection
+	if p.Rate != "" && !ratePattern.MatchString(p.Rate) {
+		return fmt.Errorf("the rate must be requests per second or minute, e.g. 10r/s, got %q", p.Rate)
+	}
+	if (p.Burst > 0 || p.NoDelay) && p.Rate == "" {
+		return fmt.Errorf("burst and nodelay need a request rate")
+	}
+	if (p.Key == model.LimitByHeader || p.Key == model.LimitByAPIKey) && p.Header == "" {
+		return fmt.Errorf("limiting by %s needs a header name", p.Key)
+	}
+	return nil
+}
+
+// sitesWithZones returns the stored sites with site replacing its stored definition.
+func sitesWithZones(configsBasePath string, updated []model.Site) []model.Site {
+	replaced := make(map[string]model.Site)
+	for _, site := range updated {
+		replaced[site.Name] = site
+	}
+	var sites []model.Site
+	for _, name := range Sites(configsBasePath) {
+		if site, ok := replaced[name]; ok {
+			sites = append(sites, site)
+			delete(replaced, name)
+		} else if site, ok := LoadSite(name); ok {
+			sites = append(sites, site)
+		}
+	}
+	for _, site := range updated {
+		if _, ok := replaced[site.Name]; ok {
+			sites = append(sites, site)
+		}
+	}
+	return sites
+}
+
+// WriteZones renders the zones of the stored sites, with updated replacing
+// their stored definitions, and makes sure nginx.conf includes them. It
+// returns the previous content of every changed file for rolling back; nothing
+// is written when no site is protected and there is no zones file yet.
+func WriteZones(configsBasePath string, updated []model.Site) (map[string][]byte, error) {
+	originals := make(map[string][]byte)
+	sites := sitesWithZones(configsBasePath, updated)
+	needed := false
+	for _, site := range sites {
+		needed = needed || Protected(site)
+	}
+	if !needed && !common.FileExists(LimitZonesPath) {
+		return originals, nil
+	}
+
+	original, _ := os.ReadFile(LimitZonesPath)
+	originals[LimitZonesPath] = original
+	if err := os.WriteFile(LimitZonesPath, []byte(RenderZones(sites)), 0644); err != nil {
+		return originals, err
+	}
+	conf, changed, err := ensureZonesInclude()
+	if changed {
+		originals[common.NginxConfPath] = conf
+	}
+	return originals, err
+}
+
+// ensureZonesInclude adds the include of LimitZonesPath at the top of the http
+// block of nginx.conf. It returns the previous content and whether it changed.
+func ensureZonesInclude() ([]byte, bool, error) {
+	original, err := os.ReadFile(common.NginxConfPath)
+	if err != nil {
+		return nil, false, err
+	}
+	include := "include " + LimitZonesPath + ";"
+	if strings.Contains(string(original), include) {
+		return original, false, nil
+	}
+	lines := strings.Split(string(original), "\n")
+	for i, line := range lines {
+		if httpBlockStart.MatchString(line) {
+			updated := append([]string{}, lines[:i+1]...)
+			updated = append(updated, "    "+include)
+			updated = append(updated, lines[i+1:]...)
+			return original, true, os.WriteFile(common.NginxConfPath, []byte(strings.Join(updated, "\n")), 0644)
+		}
+	}
+	return original, false, fmt.Errorf("no http block found in %s to include %s from", common.NginxConfPath, LimitZonesPath)
+}
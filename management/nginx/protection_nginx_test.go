@@ -0,0 +1,81 @@
+package nginx
+
+import (
+	"nginx_configure/model"
+	"strings"
+	"testing"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		spec    string
+		rate    string
+		burst   int
+		noDelay bool
+		ok      bool
+	}{
+		{"off", "off", 0, false, true},
+		{"5r/s", "5r/s", 0, false, true},
+		{"5r/m:3", "5r/m", 3, false, true},
+		{"10r/s:20:nodelay", "10r/s", 20, true, true},
+		{"10r/s:nodelay", "10r/s", 0, true, true},
+		{"", "", 0, false, false},
+		{"5/s", "", 0, false, false},
+		{"5r/h", "", 0, false, false},
+		{"5r/s:-1", "", 0, false, false},
+		{"5r/s:many", "", 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			rate, burst, noDelay, err := ParseLimit(tt.spec)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got error %v, want ok=%v", err, tt.ok)
+			}
+			if rate != tt.rate || burst != tt.burst || noDelay != tt.noDelay {
+				t.Fatalf("got %q %d %v, want %q %d %v", rate, burst, noDelay, tt.rate, tt.burst, tt.noDelay)
+			}
+		})
+	}
+}
+
+func TestRenderZones(t *testing.T) {
+	sites := []model.Site{
+		{
+			Name:       "shop.example.com",
+			Protection: model.Protection{Rate: "10r/s", Connections: 20},
+			Locations: []model.Location{
+				{Path: "/"},
+				{Path: "/login", Limit: "5r/m:3"},
+				{Path: "/health", Limit: "off"},
+			},
+		},
+		{
+			Name:       "api",
+			Protection: model.Protection{Key: model.LimitByAPIKey, Header: "X-Api-Key", Rate: "100r/m"},
+		},
+		{
+			Name:       "by-header",
+			Protection: model.Protection{Key: model.LimitByHeader, Header: "X-Forwarded-For", Connections: 5},
+		},
+		{Name: "open"},
+		{Name: "tcp", Setup: SetupStream, Protection: model.Protection{Rate: "1r/s"}},
+	}
+	zones := RenderZones(sites)
+	for _, want := range []string{
+		"limit_req_zone $binary_remote_addr zone=shop_example_com_req:10m rate=10r/s;",
+		"limit_conn_zone $binary_remote_addr zone=shop_example_com_conn:10m;",
+		"limit_req_zone $binary_remote_addr zone=shop_example_com_loc1:10m rate=5r/m;",
+		"map $http_x_api_key $api_limit_key {\n    \"\" $binary_remote_addr;\n    default $http_x_api_key;\n}",
+		"limit_req_zone $api_limit_key zone=api_req:10m rate=100r/m;",
+		"limit_conn_zone $http_x_forwarded_for zone=by_header_conn:10m;",
+	} {
+		if !strings.Contains(zones, want) {
+			t.Errorf("missing %q in\n%s", want, zones)
+		}
+	}
+	for _, unwanted := range []string{"shop_example_com_loc2", "# open", "# tcp"} {
+		if strings.Contains(zones, unwanted) {
+			t.Errorf("unexpected %q in\n%s", unwanted, zones)
+		}
+	}
+}
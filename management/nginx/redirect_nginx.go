@@ -0,0 +1,138 @@
+package nginx
+
+import (
+	"fmt"
+	"nginx_configure/model"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ACMERoot is the webroot the ACME challenge is served from, e.g. for
+// certbot certonly --webroot -w /var/www/acme-challenge.
+const ACMERoot = "/var/www/acme-challenge"
+
+// RedirectCodes are the status codes the HTTP server can redirect with.
+var RedirectCodes = []int{301, 302, 307, 308}
+
+// RedirectCode returns the status code of the HTTP to HTTPS redirect.
+func RedirectCode(redirect model.Redirect) int {
+	if redirect.Code == 0 {
+		return 301
+	}
+	return redirect.Code
+}
+
+// RedirectCodeLabel describes a redirect status code.
+func RedirectCodeLabel(code int) string {
+	switch code {
+	case 302:
+		return "302 Found (temporary)"
+	case 307:
+		return "307 Temporary Redirect (keeps the method)"
+	case 308:
+		return "308 Permanent Redirect (keeps the method)"
+	}
+	return "301 Moved Permanently"
+}
+
+// NextRedirectCode returns the code following code in RedirectCodes.
+func NextRedirectCode(code int) int {
+	for i, c := range RedirectCodes {
+		if c == code {
+			return RedirectCodes[(i+1)%len(RedirectCodes)]
+		}
+	}
+	return RedirectCodes[0]
+}
+
+// ValidateRedirect checks the redirect options of a site.
+func ValidateRedirect(site model.Site) error {
+	code := RedirectCode(site.Redirect)
+	valid := false
+	for _, c := range RedirectCodes {
+		valid = valid || c == code
+	}
+	if !valid {
+		return fmt.Errorf("the redirect status must be one of 301, 302, 307 or 308, got %d", code)
+	}
+	if site.Redirect.SkipHTTP && site.Redirect.ACME {
+		return fmt.Errorf("the ACME challenge needs the HTTP server")
+	}
+	if site.CType == "SSL" && !site.Redirect.SkipHTTP && site.HttpPort == site.HttpsPort {
+		return fmt.Errorf("the HTTP and HTTPS ports must differ, or leave out the HTTP server")
+	}
+	return nil
+}
+
+// httpsAuthority returns host with the HTTPS port appended unless it is 443.
+func httpsAuthority(host string, httpsPort string) string {
+	if httpsPort == "" || httpsPort == "443" {
+		return host
+	}
+	return host + ":" + httpsPort
+}
+
+// httpsURL is the redirect target of the HTTP server. $host has no port, so
+// a non-standard HTTPS port is added explicitly.
+func httpsURL(host string, httpsPort string) string {
+	return "https://" + httpsAuthority(host, httpsPort) + "$request_uri"
+}
+
+// redirectServer renders the plain HTTP server of an SSL site.
+func redirectServer(site model.Site) string {
+	if site.Redirect.SkipHTTP {
+		return ""
+	}
+	code := strconv.Itoa(RedirectCode(site.Redirect))
+	var sb strings.Builder
+	sb.WriteString("# HTTP block: Redirect all HTTP traffic to HTTPS\n")
+	sb.WriteString("server {\n")
+	sb.WriteString(fmt.Sprintf("\tlisten %s;\n", site.HttpPort))
+	sb.WriteString(fmt.Sprintf("\tserver_name %s;\n", strings.Join(SiteDomains(site), " ")))
+	if site.Redirect.ACME {
+		sb.WriteString("\n\tlocation ^~ /.well-known/acme-challenge/ {\n")
+		sb.WriteString(fmt.Sprintf("\t\troot %s;\n", ACMERoot))
+		sb.WriteString("\t\tdefault_type \"text/plain\";\n")
+		sb.WriteString("\t\ttry_files $uri =404;\n")
+		sb.WriteString("\t}\n\n")
+		sb.WriteString("\tlocation / {\n")
+		sb.WriteString(fmt.Sprintf("\t\treturn %s %s;\n", code, httpsURL("$host", site.HttpsPort)))
+		sb.WriteString("\t}\n")
+	} else {
+		sb.WriteString(fmt.Sprintf("\treturn %s %s;\n", code, httpsURL("$host", site.HttpsPort)))
+	}
+	sb.WriteString("}\n\n")
+	return sb.String()
+}
+
+// ensureACMERoot creates the ACME webroot for sites serving the challenge.
+func ensureACMERoot(site model.Site) error {
+	if !site.Redirect.ACME {
+		return nil
+	}
+	return os.MkdirAll(ACMERoot+"/.well-known/acme-challenge", 0755)
+}
+
+// sitePorts returns the TCP ports a site listens on besides 80 and 443.
+func sitePorts(site model.Site) []string {
+	var ports []string
+	add := func(port string) {
+		if port == "" || port == "80" || port == "443" {
+			return
+		}
+		for _, p := range ports {
+			if p == port {
+				return
+			}
+		}
+		ports = append(ports, port)
+	}
+	if site.CType != "SSL" || !site.Redirect.SkipHTTP {
+		add(site.HttpPort)
+	}
+	if site.CType == "SSL" {
+		add(site.HttpsPort)
+	}
+	return ports
+}
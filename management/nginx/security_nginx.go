@@ -0,0 +1,373 @@
+package nginx
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"nginx_configure/common"
+	"nginx_configure/model"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultSecurity is what new SSL sites start from: nosniff, same origin
+// framing and a conservative referrer policy. HSTS is off until it is turned
+// on, since browsers keep refusing plain HTTP for the whole max-age.
+var DefaultSecurity = model.Security{
+	FrameOptions:       "SAMEORIGIN",
+	ContentTypeOptions: true,
+	ReferrerPolicy:     "strict-origin-when-cross-origin",
+	Resolver:           "1.1.1.1 8.8.8.8",
+}
+
+// hstsPreloadMinAge is the smallest max-age accepted by the HSTS preload list.
+const hstsPreloadMinAge = 31536000
+
+var (
+	referrerPolicies = []string{
+		"no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin",
+		"same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url",
+	}
+	cspDirectivePattern = regexp.MustCompile(`^[a-z-]+(\s+\S+)*$`)
+	permissionPattern   = regexp.MustCompile(`^[a-z-]+=(\*|\(\s*([^()"]*)\))$`)
+)
+
+// SecurityField is one value of the security headers that can be edited on its own.
+type SecurityField struct {
+	Label string
+	Hint  string
+	Get   func(s model.Security) string
+	Set   func(s *model.Security, value string) error
+}
+
+// SecurityFields are the editable security values in the order they are shown.
+var SecurityFields = []SecurityField{
+	{
+		Label: "Strict-Transport-Security (HSTS)",
+		Hint:  "off, or max-age in seconds followed by includeSubDomains and/or preload; try 300 before 31536000 (a year)",
+		Get: func(s model.Security) string {
+			if s.HSTSMaxAge == 0 {
+				return "off"
+			}
+			value := strconv.Itoa(s.HSTSMaxAge)
+			if s.HSTSIncludeSubdomains {
+				value += " includeSubDomains"
+			}
+			if s.HSTSPreload {
+				value += " preload"
+			}
+			return value
+		},
+		Set: func(s *model.Security, value string) error {
+			fields := strings.Fields(value)
+			if len(fields) == 0 || fields[0] == "off" {
+				s.HSTSMaxAge, s.HSTSIncludeSubdomains, s.HSTSPreload = 0, false, false
+				return nil
+			}
+			maxAge, err := strconv.Atoi(strings.TrimPrefix(fields[0], "max-age="))
+			if err != nil || maxAge < 1 {
+				return fmt.Errorf("HSTS needs a max-age in seconds, e.g. 31536000, got %q", fields[0])
+			}
+			sub, preload := false, false
+			for _, flag := range fields[1:] {
+				switch strings.ToLower(flag) {
+				case "includesubdomains":
+					sub = true
+				case "preload":
+					preload = true
+				default:
+					return fmt.Errorf("unknown HSTS flag %q, use includeSubDomains or preload", flag)
+				}
+			}
+			if preload && (!sub || maxAge < hstsPreloadMinAge) {
+				return fmt.Errorf("HSTS preload needs includeSubDomains and a max-age of at least %d", hstsPreloadMinAge)
+			}
+			s.HSTSMaxAge, s.HSTSIncludeSubdomains, s.HSTSPreload = maxAge, sub, preload
+			return nil
+		},
+	},
+	{
+		Label: "OCSP stapling",
+		Hint:  "on followed by DNS resolvers, e.g. on 1.1.1.1 8.8.8.8, or off; needs the issuer chain next to the certificate",
+		Get: func(s model.Security) string {
+			if !s.OCSPStapling {
+				return "off"
+			}
+			return strings.TrimSpace("on " + s.Resolver)
+		},
+		Set: func(s *model.Security, value string) error {
+			fields := strings.Fields(value)
+			if len(fields) == 0 || fields[0] == "off" {
+				s.OCSPStapling = false
+				return nil
+			}
+			if fields[0] != "on" {
+				return fmt.Errorf("OCSP stapling must be on or off, got %q", fields[0])
+			}
+			if len(fields) == 1 {
+				return fmt.Errorf("OCSP stapling needs at least one DNS resolver, e.g. on 1.1.1.1")
+			}
+			for _, resolver := range fields[1:] {
+				if net.ParseIP(strings.Trim(resolver, "[]")) == nil {
+					return fmt.Errorf("%q is not an IP address", resolver)
+				}
+			}
+			s.OCSPStapling, s.Resolver = true, strings.Join(fields[1:], " ")
+			return nil
+		},
+	},
+	{
+		Label: "X-Frame-Options",
+		Hint:  "DENY, SAMEORIGIN or off",
+		Get:   func(s model.Security) string { return offIfEmpty(s.FrameOptions) },
+		Set: func(s *model.Security, value string) error {
+			switch strings.ToUpper(value) {
+			case "", "OFF":
+				s.FrameOptions = ""
+			case "DENY", "SAMEORIGIN":
+				s.FrameOptions = strings.ToUpper(value)
+			default:
+				return fmt.Errorf("X-Frame-Options must be DENY, SAMEORIGIN or off, got %q", value)
+			}
+			return nil
+		},
+	},
+	{
+		Label: "X-Content-Type-Options",
+		Hint:  "nosniff or off",
+		Get: func(s model.Security) string {
+			if s.ContentTypeOptions {
+				return "nosniff"
+			}
+			return "off"
+		},
+		Set: func(s *model.Security, value string) error {
+			switch value {
+			case "", "off":
+				s.ContentTypeOptions = false
+			case "nosniff", "on":
+				s.ContentTypeOptions = true
+			default:
+				return fmt.Errorf("X-Content-Type-Options must be nosniff or off, got %q", value)
+			}
+			return nil
+		},
+	},
+	{
+		Label: "Referrer-Policy",
+		Hint:  strings.Join(referrerPolicies, ", ") + " or off",
+		Get:   func(s model.Security) string { return offIfEmpty(s.ReferrerPolicy) },
+		Set: func(s *model.Security, value string) error {
+			value = strings.ToLower(value)
+			if value == "" || value == "off" {
+				s.ReferrerPolicy = ""
+				return nil
+			}
+			for _, policy := range referrerPolicies {
+				if policy == value {
+					s.ReferrerPolicy = value
+					return nil
+				}
+			}
+			return fmt.Errorf("unknown Referrer-Policy %q", value)
+		},
+	},
+	{
+		Label: "Permissions-Policy",
+		Hint:  "comma separated features, e.g. camera=(), microphone=(), geolocation=(self), or off",
+		Get:   func(s model.Security) string { return offIfEmpty(s.PermissionsPolicy) },
+		Set: func(s *model.Security, value string) error {
+			if value == "" || value == "off" {
+				s.PermissionsPolicy = ""
+				return nil
+			}
+			var features []string
+			for _, feature := range strings.Split(value, ",") {
+				feature = strings.TrimSpace(feature)
+				if !permissionPattern.MatchString(feature) {
+					return fmt.Errorf("%q is not a feature=(allowlist) pair, e.g. camera=() or geolocation=(self)", feature)
+				}
+				features = append(features, feature)
+			}
+			s.PermissionsPolicy = strings.Join(features, ", ")
+			return nil
+		},
+	},
+	{
+		Label: "Content-Security-Policy",
+		Hint:  "; separated directives, e.g. default-src 'self'; img-src 'self' data:, or off",
+		Get:   func(s model.Security) string { return offIfEmpty(s.CSP) },
+		Set: func(s *model.Security, value string) error {
+			if value == "" || value == "off" {
+				s.CSP = ""
+				return nil
+			}
+			if strings.ContainsAny(value, "\"\n{}") {
+				return fmt.Errorf("the CSP must not contain double quotes or { }")
+			}
+			var directives []string
+			for _, directive := range strings.Split(value, ";") {
+				directive = strings.Join(strings.Fields(directive), " ")
+				if directive == "" {
+					continue
+				}
+				if !cspDirectivePattern.MatchString(directive) {
+					return fmt.Errorf("%q is not a CSP directive", directive)
+				}
+				directives = append(directives, directive)
+			}
+			if len(directives) == 0 {
+				return fmt.Errorf("the CSP needs at least one directive")
+			}
+			s.CSP = strings.Join(directives, "; ")
+			return nil
+		},
+	},
+}
+
+func offIfEmpty(value string) string {
+	if value == "" {
+		return "off"
+	}
+	return value
+}
+
+// ChainPath finds the issuer chain of a certificate in certBasePath, used as
+// ssl_trusted_certificate for OCSP stapling. A certificate file that already
+// holds the chain (fullchain) is returned itself.
+func ChainPath(certBasePath string, certName string) (string, error) {
+	for _, name := range []string{certName + ".chain.crt", certName + ".chain.pem", certName + "-chain.pem", certName + ".ca-bundle", certName + ".ca-bundle.crt"} {
+		if path := filepath.Join(certBasePath, name); common.FileExists(path) {
+			return path, nil
+		}
+	}
+	certPath := filepath.Join(certBasePath, certName+".crt")
+	if countCertificates(certPath) > 1 {
+		return certPath, nil
+	}
+	return "", fmt.Errorf("no issuer chain found for %s; put it in %s as %s.chain.crt or use a fullchain certificate", certName, certBasePath, certName)
+}
+
+func countCertificates(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "-----BEGIN CERTIFICATE-----" {
+			count++
+		}
+	}
+	return count
+}
+
+// ValidateSecurity checks the security settings that depend on the certificate.
+func ValidateSecurity(certBasePath string, site model.Site) error {
+	if site.CType != "SSL" || !site.Security.OCSPStapling {
+		return nil
+	}
+	_, err := ChainPath(certBasePath, site.CertName)
+	return err
+}
+
+// securityHeaderLines returns the add_header directives of the security headers.
+func securityHeaderLines(s model.Security) []string {
+	var lines []string
+	header := func(name string, value string) {
+		lines = append(lines, fmt.Sprintf("add_header %s \"%s\" always;", name, value))
+	}
+	if s.HSTSMaxAge > 0 {
+		value := fmt.Sprintf("max-age=%d", s.HSTSMaxAge)
+		if s.HSTSIncludeSubdomains {
+			value += "; includeSubDomains"
+		}
+		if s.HSTSPreload {
+			value += "; preload"
+		}
+		header("Strict-Transport-Security", value)
+	}
+	if s.FrameOptions != "" {
+		header("X-Frame-Options", s.FrameOptions)
+	}
+	if s.ContentTypeOptions {
+		header("X-Content-Type-Options", "nosniff")
+	}
+	if s.ReferrerPolicy != "" {
+		header("Referrer-Policy", s.ReferrerPolicy)
+	}
+	if s.PermissionsPolicy != "" {
+		header("Permissions-Policy", s.PermissionsPolicy)
+	}
+	if s.CSP != "" {
+		header("Content-Security-Policy", s.CSP)
+	}
+	return lines
+}
+
+// siteSecurityHeaders returns the security headers of a site, none without SSL.
+func siteSecurityHeaders(site model.Site) []string {
+	if site.CType != "SSL" {
+		return nil
+	}
+	return securityHeaderLines(site.Security)
+}
+
+// securityDirectives renders the server level security headers and OCSP stapling.
+func securityDirectives(certBasePath string, site model.Site) string {
+	var sb strings.Builder
+	if site.Security.OCSPStapling {
+		sb.WriteString("\n\n\tssl_stapling on;")
+		sb.WriteString("\n\tssl_stapling_verify on;")
+		// Without a chain file nginx falls back to the chain in ssl_certificate.
+		if chain, err := ChainPath(certBasePath, site.CertName); err == nil {
+			sb.WriteString(fmt.Sprintf("\n\tssl_trusted_certificate %s;", chain))
+		}
+		sb.WriteString(fmt.Sprintf("\n\tresolver %s valid=300s;", site.Security.Resolver))
+		sb.WriteString("\n\tresolver_timeout 5s;")
+	}
+	lines := siteSecurityHeaders(site)
+	if len(lines) > 0 {
+		sb.WriteString("\n")
+	}
+	for _, line := range lines {
+		sb.WriteString("\n\t" + line)
+	}
+	return sb.String()
+}
+
+// locationSecurityHeaders repeats the security headers inside a location that
+// sets its own add_header, because nginx then drops the server level ones.
+func locationSecurityHeaders(site model.Site) string {
+	var sb strings.Builder
+	for _, line := range siteSecurityHeaders(site) {
+		sb.WriteString("\t\t" + line + "\n")
+	}
+	return sb.String()
+}
+
+// SecuritySummary lists the security related directives found in a config
+// file, for configs generated by any version of this tool or by hand.
+func SecuritySummary(configPath string) ([]string, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		for _, prefix := range []string{"add_header Strict-Transport-Security", "add_header X-Frame-Options", "add_header X-Content-Type-Options", "add_header Referrer-Policy", "add_header Permissions-Policy", "add_header Content-Security-Policy", "ssl_stapling ", "ssl_trusted_certificate", "resolver "} {
+			if strings.HasPrefix(line, prefix) && !seen[line] {
+				seen[line] = true
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines, nil
+}
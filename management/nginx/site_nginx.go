@@ -0,0 +1,293 @@
+package nginx
+
+import (
+	"encoding/json"
+	"fmt"
+	"nginx_configure/common"
+	"nginx_configure/management/pki"
+	"nginx_configure/model"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SitesBasePath keeps the definition of every site generated by this tool,
+// so a site can be changed and rendered again without re-running the wizard.
+var SitesBasePath = filepath.Join(common.StateBasePath, "sites")
+
+// SaveSite stores the definition of a site.
+func SaveSite(site model.Site) error {
+	if err := os.MkdirAll(SitesBasePath, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(site, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(SitesBasePath, site.Name+".json"), data, 0644)
+}
+
+// LoadSite reads a stored site definition. It returns false for configs not
+// generated by this tool (or generated before definitions were stored).
+func LoadSite(name string) (model.Site, bool) {
+	var site model.Site
+	data, err := os.ReadFile(filepath.Join(SitesBasePath, name+".json"))
+	if err != nil {
+		return site, false
+	}
+	if err := json.Unmarshal(data, &site); err != nil {
+		return site, false
+	}
+	return site, true
+}
+
+// Sites returns the names of the config files in configsBasePath and
+// StreamsBasePath without the .conf suffix.
+func Sites(configsBasePath string) []string {
+	files, _ := filepath.Glob(filepath.Join(configsBasePath, "*.conf"))
+	streams, _ := filepath.Glob(filepath.Join(StreamsBasePath, "*.conf"))
+	files = append(files, streams...)
+	var names []string
+	for _, file := range files {
+		names = append(names, strings.TrimSuffix(filepath.Base(file), ".conf"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RewriteSites renders stored sites again after their definition changed,
+// checks the result with `nginx -t` and reloads nginx. Every file is put back
+// when the check fails, and the definitions are only saved on success.
+func RewriteSites(configsBasePath string, certBasePath string, sites []model.Site) ([]string, error) {
+	var out []string
+	for _, site := range sites {
+		if NeedsDHParam(site) {
+			dh, err := common.RunCommandOutput(DHParamCommand())
+			out = append(out, dh...)
+			if err != nil {
+				return out, fmt.Errorf("generating %s failed: %v", DHParamPath, err)
+			}
+			break
+		}
+	}
+	for _, site := range sites {
+		if site.ClientAuth.CA == model.ClientCAPrivate && !pki.CAExists() {
+			if _, _, err := pki.EnsureCA(); err != nil {
+				return out, fmt.Errorf("creating the client CA failed: %v", err)
+			}
+			out = append(out, "Created the private client CA in "+pki.CABasePath)
+			break
+		}
+	}
+
+	for _, site := range sites {
+		if site.ClientAuth.CA == model.ClientCACloudflare {
+			ca, err := EnsureOriginPullCA(false)
+			out = append(out, ca...)
+			if err != nil {
+				return out, err
+			}
+			break
+		}
+	}
+
+	for _, site := range sites {
+		if err := ensureACMERoot(site); err != nil {
+			return out, err
+		}
+	}
+
+	originals, err := WriteZones(configsBasePath, sites)
+	restore := func() {
+		for path, content := range originals {
+			if content == nil {
+				// The file did not exist before.
+				os.Remove(path)
+				continue
+			}
+			os.WriteFile(path, content, 0644)
+		}
+	}
+	if err != nil {
+		restore()
+		return out, fmt.Errorf("writing the limit zones failed: %v", err)
+	}
+	for _, site := range sites {
+		path, content := filepath.Join(configsBasePath, site.Name+".conf"), Render(certBasePath, site)
+		if site.Setup == SetupStream {
+			path, content = filepath.Join(StreamsBasePath, site.Name+".conf"), RenderStream(site)
+		}
+		original, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			restore()
+			return out, err
+		}
+		originals[path] = original
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			restore()
+			return out, err
+		}
+		out = append(out, "Rewrote "+path)
+	}
+
+	reload, err := TestAndReload()
+	out = append(out, reload...)
+	if err != nil {
+		restore()
+		return append(out, "The previous configs were restored."), err
+	}
+	for _, site := range sites {
+		if err := SaveSite(site); err != nil {
+			return out, fmt.Errorf("configs reloaded, but saving the definition of %s failed: %v", site.Name, err)
+		}
+	}
+	return out, nil
+}
+
+// StoredSites returns every stored site definition, sorted by name.
+func StoredSites() []model.Site {
+	files, _ := filepath.Glob(filepath.Join(SitesBasePath, "*.json"))
+	sort.Strings(files)
+	var sites []model.Site
+	for _, file := range files {
+		if site, ok := LoadSite(strings.TrimSuffix(filepath.Base(file), ".json")); ok {
+			sites = append(sites, site)
+		}
+	}
+	return sites
+}
+
+// RestoreSites renders every stored site into a fresh /etc/nginx, e.g. after
+// nginx was reinstalled, and reloads nginx. The default configs of the package
+// are removed first, as Configure does.
+func RestoreSites(configsBasePath string, certBasePath string) ([]string, error) {
+	sites := StoredSites()
+	if len(sites) == 0 {
+		return []string{"No stored site definitions, nothing to render."}, nil
+	}
+	var out []string
+	for _, path := range DefaultConfigs {
+		if common.FileExists(path) {
+			if err := os.Remove(path); err != nil {
+				return out, err
+			}
+			out = append(out, "Removed the default configuration at "+path)
+		}
+	}
+	if err := os.MkdirAll(configsBasePath, 0755); err != nil {
+		return out, err
+	}
+	for _, site := range sites {
+		if site.Setup != SetupStream {
+			continue
+		}
+		if err := os.MkdirAll(StreamsBasePath, 0755); err != nil {
+			return out, err
+		}
+		if _, _, err := EnsureStreamInclude(); err != nil {
+			return out, err
+		}
+		break
+	}
+	rewritten, err := RewriteSites(configsBasePath, certBasePath, sites)
+	return append(out, rewritten...), err
+}
+
+// FirewallCommands returns the ufw commands that open the ports of the sites.
+// Web ports of sites letting only their CDN in are not opened to everyone, even
+// when another site listens on them too, since ufw rules are host wide.
+func FirewallCommands(sites []model.Site) []string {
+	restricted := make(map[string]bool)
+	var cmds []string
+	for _, site := range sites {
+		provider, ok := FindCDNProvider(site.Access.CDN)
+		if !ok || !site.Access.CDNFirewall || site.Setup == SetupStream {
+			continue
+		}
+		ranges, err := CDNRanges(provider)
+		if err != nil {
+			ranges = provider.Ranges
+		}
+		for _, port := range cdnPorts(site) {
+			restricted[port] = true
+		}
+		cmds = append(cmds, cdnFirewallCommands(site, ranges, nil)...)
+	}
+
+	var public []string
+	seen := make(map[string]bool)
+	add := func(rule string) {
+		port, _, _ := strings.Cut(rule, "/")
+		if !seen[rule] && !restricted[port] {
+			seen[rule] = true
+			public = append(public, "ufw allow "+rule)
+		}
+	}
+	for _, port := range []string{"80", "443"} {
+		add(port + "/tcp")
+	}
+	for _, site := range sites {
+		if site.Setup == SetupStream {
+			add(site.Stream.Port + "/" + site.Stream.Protocol)
+			continue
+		}
+		for _, port := range sitePorts(site) {
+			add(port + "/tcp")
+		}
+	}
+	return append(public, cmds...)
+}
+
+// FirewallWarnings explains which sites lose public access because another
+// site on the same port lets only its CDN in.
+func FirewallWarnings(sites []model.Site) []string {
+	restricted := make(map[string]string)
+	for _, site := range sites {
+		if _, ok := FindCDNProvider(site.Access.CDN); ok && site.Access.CDNFirewall && site.Setup != SetupStream {
+			for _, port := range cdnPorts(site) {
+				restricted[port] = site.Name
+			}
+		}
+	}
+	var warnings []string
+	for _, site := range sites {
+		if site.Access.CDNFirewall || site.Setup == SetupStream {
+			continue
+		}
+		for _, port := range cdnPorts(site) {
+			if owner, ok := restricted[port]; ok {
+				warnings = append(warnings, fmt.Sprintf("Warning: %s lets only its CDN in on port %s, so %s is not reachable from other clients on that port. ufw rules apply to the whole host.", owner, port, site.Name))
+			}
+		}
+	}
+	return warnings
+}
+
+// UpgradeTLSProfiles moves every stored SSL site using the profile from to
+// the profile to. from "" selects sites without a profile. Configs without a
+// stored definition cannot be rendered again and are listed as skipped.
+func UpgradeTLSProfiles(configsBasePath string, certBasePath string, from string, to string) ([]string, error) {
+	if _, ok := FindTLSProfile(to); !ok {
+		return nil, fmt.Errorf("unknown TLS profile %q", to)
+	}
+	var sites []model.Site
+	var out []string
+	for _, name := range Sites(configsBasePath) {
+		site, ok := LoadSite(name)
+		if !ok {
+			out = append(out, "Skipped "+name+": it was not generated by nginx_configure.")
+			continue
+		}
+		if site.CType != "SSL" || site.TLSProfile != from {
+			continue
+		}
+		site.TLSProfile = to
+		sites = append(sites, site)
+	}
+	if len(sites) == 0 {
+		return append(out, "No SSL site uses that profile."), nil
+	}
+	rewritten, err := RewriteSites(configsBasePath, certBasePath, sites)
+	return append(out, rewritten...), err
+}
@@ -0,0 +1,101 @@
+package nginx
+
+import (
+	"fmt"
+	"nginx_configure/model"
+	"strings"
+)
+
+// SetupStatic is the setup that serves files instead of proxying to an upstream.
+const SetupStatic = "Static site"
+
+// DefaultStatic is what a new static site starts from.
+var DefaultStatic = model.Static{
+	Index:       "index.html index.htm",
+	CacheAssets: true,
+	Gzip:        true,
+}
+
+// hashedAssets matches build outputs such as app.3f2a9c1e.js or index-BqJ3kz9a.css.
+const hashedAssets = `"[.-][0-9A-Za-z_-]{8,}\.(?:js|mjs|css|map|woff2?|ttf|otf|eot|png|jpe?g|gif|svg|webp|avif|ico)$"`
+
+// gzipTypes are compressed in addition to text/html, which nginx always compresses.
+const gzipTypes = "text/plain text/css text/xml application/javascript application/json application/xml application/manifest+json image/svg+xml"
+
+// ValidateDocumentRoot checks a document root picked or entered for a static site.
+func ValidateDocumentRoot(root string) error {
+	if !strings.HasPrefix(root, "/") {
+		return fmt.Errorf("%q: the document root must be an absolute path", root)
+	}
+	if strings.ContainsAny(root, " \t;{}\"'") {
+		return fmt.Errorf("%q: the document root must not contain spaces, quotes or ; { }", root)
+	}
+	return nil
+}
+
+// ValidateIndex checks the list of index files.
+func ValidateIndex(index string) error {
+	if len(strings.Fields(index)) == 0 {
+		return fmt.Errorf("at least one index file is needed, e.g. index.html")
+	}
+	if strings.ContainsAny(index, ";{}\"'") {
+		return fmt.Errorf("index files must not contain quotes or ; { }")
+	}
+	return nil
+}
+
+// StaticToggle is one on/off option of a static site.
+type StaticToggle struct {
+	Label string
+	Field func(s *model.Static) *bool
+}
+
+// StaticToggles are the on/off options in the order they are shown.
+var StaticToggles = []StaticToggle{
+	{"SPA fallback (unknown paths serve /index.html)", func(s *model.Static) *bool { return &s.SPA }},
+	{"Long cache for hashed assets (app.3f2a9c1e.js)", func(s *model.Static) *bool { return &s.CacheAssets }},
+	{"Gzip", func(s *model.Static) *bool { return &s.Gzip }},
+	{"Directory listing (autoindex)", func(s *model.Static) *bool { return &s.Autoindex }},
+}
+
+// staticBlock renders the server body of a static site.
+func staticBlock(site model.Site) string {
+	static := site.Static
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("\troot %s;\n", static.Root))
+	sb.WriteString(fmt.Sprintf("\tindex %s;\n", strings.Join(strings.Fields(static.Index), " ")))
+
+	if static.Gzip {
+		sb.WriteString("\n\tgzip on;\n")
+		sb.WriteString("\tgzip_vary on;\n")
+		sb.WriteString("\tgzip_comp_level 5;\n")
+		sb.WriteString("\tgzip_min_length 256;\n")
+		sb.WriteString(fmt.Sprintf("\tgzip_types %s;\n", gzipTypes))
+	}
+
+	sb.WriteString("\n\tlocation / {\n")
+	if static.SPA {
+		sb.WriteString("\t\ttry_files $uri $uri/ /index.html;\n")
+	} else {
+		sb.WriteString("\t\ttry_files $uri $uri/ =404;\n")
+	}
+	if static.Autoindex {
+		sb.WriteString("\t\tautoindex on;\n")
+	}
+	sb.WriteString("\t}")
+
+	if static.CacheAssets {
+		sb.WriteString(fmt.Sprintf("\n\n\tlocation ~* %s {\n", hashedAssets))
+		sb.WriteString("\t\ttry_files $uri =404;\n")
+		sb.WriteString("\t\tadd_header Cache-Control \"public, max-age=31536000, immutable\" always;\n")
+		sb.WriteString(locationSecurityHeaders(site))
+		sb.WriteString("\t\taccess_log off;\n")
+		sb.WriteString("\t}")
+		// The entry page names the current hashes, so browsers must revalidate it.
+		sb.WriteString("\n\n\tlocation = /index.html {\n")
+		sb.WriteString("\t\tadd_header Cache-Control \"no-cache\" always;\n")
+		sb.WriteString(locationSecurityHeaders(site))
+		sb.WriteString("\t}")
+	}
+	return sb.String()
+}
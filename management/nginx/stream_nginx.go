@@ -0,0 +1,210 @@
+package nginx
+
+import (
+	"fmt"
+	tea "github.com/charmbracelet/bubbletea"
+	"nginx_configure/common"
+	"nginx_configure/model"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SetupStream proxies TCP or UDP with the stream module instead of HTTP.
+const SetupStream = "Stream proxy"
+
+// StreamsBasePath holds the stream proxy configs. They cannot live in conf.d,
+// which is included inside the http block, so common.NginxConfPath includes them.
+var StreamsBasePath = "/etc/nginx/streams.d"
+
+var streamBlockStart = regexp.MustCompile(`^stream\s*\{`)
+
+// streamInclude is the include line placed in the top level stream block.
+func streamInclude() string {
+	return "include " + filepath.Join(StreamsBasePath, "*.conf") + ";"
+}
+
+// ConfigPath returns the config file of a site, which is in StreamsBasePath
+// for stream proxies and in configsBasePath otherwise.
+func ConfigPath(configsBasePath string, name string) string {
+	streamPath := filepath.Join(StreamsBasePath, name+".conf")
+	if common.FileExists(streamPath) {
+		return streamPath
+	}
+	return filepath.Join(configsBasePath, name+".conf")
+}
+
+// ParseStreamListen parses a listen spec such as 5432, 5432/tcp or 53/udp.
+func ParseStreamListen(spec string) (model.Stream, error) {
+	port, protocol, found := strings.Cut(strings.TrimSpace(spec), "/")
+	stream := model.Stream{Port: port, Protocol: model.StreamTCP}
+	if found {
+		stream.Protocol = strings.ToLower(protocol)
+	}
+	if stream.Protocol != model.StreamTCP && stream.Protocol != model.StreamUDP {
+		return stream, fmt.Errorf("the protocol must be tcp or udp, got %q", protocol)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return stream, fmt.Errorf("port must be between 1 and 65535, got %q", port)
+	}
+	return stream, nil
+}
+
+// ValidateStream checks the upstream servers and balancing of a stream proxy.
+// The stream module has no ip_hash and needs a port on every server.
+func ValidateStream(site model.Site) error {
+	if site.Balancing.Method == model.BalanceIPHash {
+		return fmt.Errorf("stream proxies have no ip_hash, use hash by key with $remote_addr instead")
+	}
+	for _, server := range site.Upstreams {
+		if err := ValidateAppAddress(server.Address); err != nil {
+			return err
+		}
+	}
+	if t := site.Stream.Timeout; t != "" && !timePattern.MatchString(t) {
+		return fmt.Errorf("the timeout needs a time such as 10m, got %q", t)
+	}
+	return ValidateUpstreams(site.Setup, site.Upstreams, site.Balancing)
+}
+
+// RenderStream builds the config of a stream proxy. The file is included
+// inside the top level stream block of nginx.conf.
+func RenderStream(site model.Site) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("# Stream proxy %s, included inside the stream block of nginx.conf\n", site.Name))
+	sb.WriteString(upstreamBlock(site.Name, BalancingDirective(site.Setup, site.Balancing), site.Upstreams, model.Tuning{}))
+	sb.WriteString("\n\nserver {\n")
+	if site.Stream.Protocol == model.StreamUDP {
+		sb.WriteString(fmt.Sprintf("\tlisten %s udp;\n", site.Stream.Port))
+	} else {
+		sb.WriteString(fmt.Sprintf("\tlisten %s;\n", site.Stream.Port))
+	}
+	sb.WriteString(fmt.Sprintf("\tproxy_pass %s;\n", site.Name))
+	sb.WriteString("\tproxy_connect_timeout 5s;\n")
+	if site.Stream.Timeout != "" {
+		sb.WriteString(fmt.Sprintf("\tproxy_timeout %s;\n", site.Stream.Timeout))
+	}
+	if site.Stream.Protocol == model.StreamUDP {
+		// Request/response protocols such as DNS answer once per datagram.
+		sb.WriteString("\tproxy_responses 1;\n")
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// StreamModuleAvailable checks that nginx was built with the stream module
+// and, when it is a dynamic module, that it is loaded.
+func StreamModuleAvailable() error {
+	info := Inspect()
+	for _, module := range info.Modules {
+		if module == "stream" {
+			return nil
+		}
+		if module == "stream (dynamic)" {
+			loaded, _ := filepath.Glob("/etc/nginx/modules-enabled/*stream*")
+			conf, _ := os.ReadFile(common.NginxConfPath)
+			if len(loaded) > 0 || strings.Contains(string(conf), "ngx_stream_module.so") {
+				return nil
+			}
+			return fmt.Errorf("the stream module is not loaded, install it with: apt-get install -y libnginx-mod-stream")
+		}
+	}
+	if info.Version == "" {
+		return fmt.Errorf("nginx is not installed")
+	}
+	return fmt.Errorf("this nginx build has no stream module, install nginx from nginx.org or the libnginx-mod-stream package")
+}
+
+// EnsureStreamInclude makes nginx.conf include StreamsBasePath from a top
+// level stream block. An existing stream block gets the include added, since
+// nginx allows only one. It returns the previous content for rolling back and
+// whether the file was changed.
+func EnsureStreamInclude() ([]byte, bool, error) {
+	original, err := os.ReadFile(common.NginxConfPath)
+	if err != nil {
+		return nil, false, err
+	}
+	content := string(original)
+	if strings.Contains(content, streamInclude()) {
+		return original, false, nil
+	}
+
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		// Only an unindented block is at the top level.
+		if streamBlockStart.MatchString(line) {
+			updated := append([]string{}, lines[:i+1]...)
+			updated = append(updated, "    "+streamInclude())
+			updated = append(updated, lines[i+1:]...)
+			return original, true, os.WriteFile(common.NginxConfPath, []byte(strings.Join(updated, "\n")), 0644)
+		}
+	}
+	content = strings.TrimRight(content, "\n") + "\n\n# TCP/UDP proxies managed by nginx_configure\nstream {\n    " + streamInclude() + "\n}\n"
+	return original, true, os.WriteFile(common.NginxConfPath, []byte(content), 0644)
+}
+
+// ConfigureStream writes a stream proxy, hooks the streams directory into
+// nginx.conf, checks and reloads nginx and opens the port in the firewall.
+// nginx.conf and the new file are rolled back when `nginx -t` fails, and the
+// definition is only stored once nginx reloaded.
+func ConfigureStream(site model.Site) tea.Cmd {
+	configPath := filepath.Join(StreamsBasePath, site.Name+".conf")
+	var originalConf []byte
+	confChanged := false
+
+	steps := []common.Step{
+		{
+			Title: "Checking the nginx stream module...",
+			Run: func() ([]string, error) {
+				return nil, StreamModuleAvailable()
+			},
+		},
+		{
+			Title: "Writing " + configPath + "...",
+			Run: func() ([]string, error) {
+				if err := os.MkdirAll(StreamsBasePath, 0755); err != nil {
+					return nil, err
+				}
+				return nil, os.WriteFile(configPath, []byte(RenderStream(site)), 0644)
+			},
+		},
+		{
+			Title: "Including " + StreamsBasePath + " from " + common.NginxConfPath + "...",
+			Run: func() ([]string, error) {
+				var err error
+				originalConf, confChanged, err = EnsureStreamInclude()
+				if !confChanged {
+					return []string{"Already included."}, err
+				}
+				return nil, err
+			},
+		},
+		{
+			Title: "Testing nginx configuration...",
+			Run: func() ([]string, error) {
+				out, err := common.RunCommandOutput("nginx -t")
+				if err == nil {
+					return out, nil
+				}
+				os.Remove(configPath)
+				if confChanged {
+					os.WriteFile(common.NginxConfPath, originalConf, 0644)
+				}
+				return append(out, "The new config was removed and nginx.conf restored."), fmt.Errorf("nginx -t failed")
+			},
+		},
+		common.CommandStep("Reloading nginx...", "systemctl reload nginx"),
+		{
+			Title: "Saving the site definition...",
+			Run: func() ([]string, error) {
+				return nil, SaveSite(site)
+			},
+		},
+		common.CommandStep("Enabling nginx service to automatically start after reboot...", "systemctl enable nginx"),
+		common.CommandStep("Allowing "+site.Stream.Port+"/"+site.Stream.Protocol+"...", "ufw allow "+site.Stream.Port+"/"+site.Stream.Protocol),
+	}
+	return common.RunSteps(steps, "Stream proxy "+site.Name+" is listening on "+site.Stream.Port+"/"+site.Stream.Protocol+".")
+}
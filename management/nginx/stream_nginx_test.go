@@ -0,0 +1,35 @@
+package nginx
+
+import (
+	"nginx_configure/model"
+	"testing"
+)
+
+func TestParseStreamListen(t *testing.T) {
+	tests := []struct {
+		spec string
+		want model.Stream
+		ok   bool
+	}{
+		{"5432", model.Stream{Port: "5432", Protocol: model.StreamTCP}, true},
+		{" 5432/tcp ", model.Stream{Port: "5432", Protocol: model.StreamTCP}, true},
+		{"53/UDP", model.Stream{Port: "53", Protocol: model.StreamUDP}, true},
+		{"65535/udp", model.Stream{Port: "65535", Protocol: model.StreamUDP}, true},
+		{"53/sctp", model.Stream{}, false},
+		{"0", model.Stream{}, false},
+		{"65536/tcp", model.Stream{}, false},
+		{"postgres", model.Stream{}, false},
+		{"", model.Stream{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			stream, err := ParseStreamListen(tt.spec)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %+v, %v, want ok=%v", stream, err, tt.ok)
+			}
+			if tt.ok && stream != tt.want {
+				t.Fatalf("got %+v, want %+v", stream, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package nginx
+
+import (
+	"fmt"
+	"nginx_configure/model"
+	"strings"
+)
+
+// DHParamPath holds the Diffie-Hellman parameters used by the old profile.
+var DHParamPath = "/etc/nginx/dhparam.pem"
+
+// TLSProfile is a set of TLS settings following the Mozilla server side TLS guidelines.
+type TLSProfile struct {
+	Name        string
+	Description string
+	Protocols   string
+	// Ciphers is empty when only TLS 1.3 is allowed, its suites are not configurable.
+	Ciphers             string
+	PreferServerCiphers bool
+	Curves              string
+	DHParam             bool
+}
+
+const (
+	intermediateCiphers = "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384:DHE-RSA-CHACHA20-POLY1305"
+	oldCiphers          = intermediateCiphers + ":ECDHE-ECDSA-AES128-SHA256:ECDHE-RSA-AES128-SHA256:ECDHE-ECDSA-AES128-SHA:ECDHE-RSA-AES128-SHA:ECDHE-ECDSA-AES256-SHA384:ECDHE-RSA-AES256-SHA384:ECDHE-ECDSA-AES256-SHA:ECDHE-RSA-AES256-SHA:DHE-RSA-AES128-SHA256:DHE-RSA-AES256-SHA256:AES128-GCM-SHA256:AES256-GCM-SHA384:AES128-SHA256:AES256-SHA256:AES128-SHA:AES256-SHA:DES-CBC3-SHA:@SECLEVEL=0"
+)
+
+// TLSProfiles lists the profiles in the order they are offered.
+var TLSProfiles = []TLSProfile{
+	{
+		Name:        model.TLSModern,
+		Description: "TLS 1.3 only, for clients from 2019 on",
+		Protocols:   "TLSv1.3",
+		Curves:      "X25519:prime256v1:secp384r1",
+	},
+	{
+		Name:        model.TLSIntermediate,
+		Description: "TLS 1.2 and 1.3, recommended for most sites",
+		Protocols:   "TLSv1.2 TLSv1.3",
+		Ciphers:     intermediateCiphers,
+		Curves:      "X25519:prime256v1:secp384r1",
+	},
+	{
+		Name:                model.TLSOld,
+		Description:         "TLS 1.0 to 1.3, only for very old clients, generates dhparam",
+		Protocols:           "TLSv1 TLSv1.1 TLSv1.2 TLSv1.3",
+		Ciphers:             oldCiphers,
+		PreferServerCiphers: true,
+		Curves:              "X25519:prime256v1:secp384r1",
+		DHParam:             true,
+	},
+}
+
+// FindTLSProfile returns the profile with the given name.
+func FindTLSProfile(name string) (TLSProfile, bool) {
+	for _, profile := range TLSProfiles {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return TLSProfile{}, false
+}
+
+// tlsDirectives renders the TLS settings of an HTTPS server. Sites without a
+// profile keep the settings every site had before profiles existed.
+func tlsDirectives(name string) string {
+	profile, ok := FindTLSProfile(name)
+	if !ok {
+		return "\n\tssl_protocols TLSv1.2 TLSv1.3;\n\tssl_ciphers HIGH:!aNULL:!MD5;"
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("\n\t# Mozilla %s profile", profile.Name))
+	sb.WriteString(fmt.Sprintf("\n\tssl_protocols %s;", profile.Protocols))
+	if profile.Ciphers != "" {
+		sb.WriteString(fmt.Sprintf("\n\tssl_ciphers %s;", profile.Ciphers))
+	}
+	if profile.PreferServerCiphers {
+		sb.WriteString("\n\tssl_prefer_server_ciphers on;")
+	} else {
+		sb.WriteString("\n\tssl_prefer_server_ciphers off;")
+	}
+	sb.WriteString(fmt.Sprintf("\n\tssl_ecdh_curve %s;", profile.Curves))
+	if profile.DHParam {
+		sb.WriteString(fmt.Sprintf("\n\tssl_dhparam %s;", DHParamPath))
+	}
+	sb.WriteString("\n\tssl_session_timeout 1d;")
+	sb.WriteString("\n\tssl_session_cache shared:MozSSL:10m;")
+	sb.WriteString("\n\tssl_session_tickets off;")
+	return sb.String()
+}
+
+// DHParamCommand generates the dhparam file unless it exists. It takes a
+// while, so it is only run for sites using a profile that needs it.
+func DHParamCommand() string {
+	return fmt.Sprintf("test -s %s || openssl dhparam -out %s 2048", DHParamPath, DHParamPath)
+}
+
+// NeedsDHParam reports whether a site's profile uses dhparam.
+func NeedsDHParam(site model.Site) bool {
+	profile, ok := FindTLSProfile(site.TLSProfile)
+	return ok && profile.DHParam && site.CType == "SSL"
+}
@@ -0,0 +1,189 @@
+package nginx
+
+import (
+	"fmt"
+	"nginx_configure/model"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var sizePattern = regexp.MustCompile(`^\d+[kKmMgG]?$`)
+
+// nextUpstreamConditions are the values accepted by proxy_next_upstream.
+var nextUpstreamConditions = map[string]bool{
+	"error": true, "timeout": true, "invalid_header": true,
+	"http_500": true, "http_502": true, "http_503": true, "http_504": true,
+	"http_403": true, "http_404": true, "http_429": true,
+	"non_idempotent": true, "off": true,
+}
+
+// TuningPresets lists the preset names in the order they are offered.
+var TuningPresets = []string{"None", "API", "File upload", "Long-polling/SSE", "Custom"}
+
+// TuningPreset returns the values of a named preset.
+func TuningPreset(name string) model.Tuning {
+	switch name {
+	case "API":
+		return model.Tuning{
+			Preset:            name,
+			Keepalive:         32,
+			ConnectTimeout:    "5s",
+			ReadTimeout:       "120s",
+			SendTimeout:       "120s",
+			Buffering:         "on",
+			ClientMaxBodySize: "10m",
+			NextUpstream:      "error timeout http_502 http_503",
+		}
+	case "File upload":
+		return model.Tuning{
+			Preset:            name,
+			Keepalive:         16,
+			ConnectTimeout:    "10s",
+			ReadTimeout:       "300s",
+			SendTimeout:       "300s",
+			Buffering:         "on",
+			RequestBuffering:  "off",
+			ClientMaxBodySize: "1g",
+			NextUpstream:      "error",
+		}
+	case "Long-polling/SSE":
+		return model.Tuning{
+			Preset:            name,
+			Keepalive:         32,
+			ConnectTimeout:    "5s",
+			ReadTimeout:       "3600s",
+			SendTimeout:       "3600s",
+			Buffering:         "off",
+			ClientMaxBodySize: "1m",
+			NextUpstream:      "error timeout",
+		}
+	case "Custom":
+		return model.Tuning{Preset: name}
+	}
+	return model.Tuning{}
+}
+
+// TuningField is one value of the tuning section that can be edited on its own.
+type TuningField struct {
+	Label string
+	Hint  string
+	Get   func(t model.Tuning) string
+	Set   func(t *model.Tuning, value string) error
+}
+
+// TuningFields are the editable tuning values in the order they are shown.
+var TuningFields = []TuningField{
+	{
+		Label: "Upstream keepalive connections",
+		Hint:  "number of idle connections kept per worker, 0 disables keepalive",
+		Get: func(t model.Tuning) string {
+			return strconv.Itoa(t.Keepalive)
+		},
+		Set: func(t *model.Tuning, value string) error {
+			if value == "" {
+				t.Keepalive = 0
+				return nil
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("keepalive needs a number, got %q", value)
+			}
+			t.Keepalive = n
+			return nil
+		},
+	},
+	timeField("Proxy connect timeout", func(t *model.Tuning) *string { return &t.ConnectTimeout }),
+	timeField("Proxy read timeout", func(t *model.Tuning) *string { return &t.ReadTimeout }),
+	timeField("Proxy send timeout", func(t *model.Tuning) *string { return &t.SendTimeout }),
+	switchField("Response buffering (proxy_buffering)", func(t *model.Tuning) *string { return &t.Buffering }),
+	switchField("Request buffering (proxy_request_buffering)", func(t *model.Tuning) *string { return &t.RequestBuffering }),
+	{
+		Label: "client_max_body_size",
+		Hint:  "e.g. 10m or 1g, 0 disables the limit, empty keeps the default 1m",
+		Get:   func(t model.Tuning) string { return t.ClientMaxBodySize },
+		Set: func(t *model.Tuning, value string) error {
+			if value != "" && !sizePattern.MatchString(value) {
+				return fmt.Errorf("client_max_body_size needs a size such as 10m, got %q", value)
+			}
+			t.ClientMaxBodySize = value
+			return nil
+		},
+	},
+	{
+		Label: "proxy_next_upstream",
+		Hint:  "e.g. error timeout http_502 http_503, or off",
+		Get:   func(t model.Tuning) string { return t.NextUpstream },
+		Set: func(t *model.Tuning, value string) error {
+			fields := strings.Fields(value)
+			for _, condition := range fields {
+				if !nextUpstreamConditions[condition] {
+					return fmt.Errorf("unknown proxy_next_upstream condition %q", condition)
+				}
+				if condition == "off" && len(fields) > 1 {
+					return fmt.Errorf("off cannot be combined with other conditions")
+				}
+			}
+			t.NextUpstream = strings.Join(fields, " ")
+			return nil
+		},
+	},
+}
+
+func timeField(label string, field func(t *model.Tuning) *string) TuningField {
+	return TuningField{
+		Label: label,
+		Hint:  "e.g. 5s, 120s or 1h, empty keeps the default 60s",
+		Get:   func(t model.Tuning) string { return *field(&t) },
+		Set: func(t *model.Tuning, value string) error {
+			if value != "" && !timePattern.MatchString(value) {
+				return fmt.Errorf("%s needs a time such as 60s, got %q", label, value)
+			}
+			*field(t) = value
+			return nil
+		},
+	}
+}
+
+func switchField(label string, field func(t *model.Tuning) *string) TuningField {
+	return TuningField{
+		Label: label,
+		Hint:  "on or off, empty keeps the default on",
+		Get:   func(t model.Tuning) string { return *field(&t) },
+		Set: func(t *model.Tuning, value string) error {
+			if value != "" && value != "on" && value != "off" {
+				return fmt.Errorf("%s must be on or off, got %q", label, value)
+			}
+			*field(t) = value
+			return nil
+		},
+	}
+}
+
+// serverTuning renders the server level tuning directives.
+func serverTuning(t model.Tuning) string {
+	if t.ClientMaxBodySize == "" {
+		return ""
+	}
+	return fmt.Sprintf("\n\tclient_max_body_size %s;", t.ClientMaxBodySize)
+}
+
+// locationTuning renders the tuning directives of a location block for the
+// proxy or grpc module. gRPC has no response or request buffering switches.
+func locationTuning(t model.Tuning, module string) string {
+	var sb strings.Builder
+	directive := func(name string, value string) {
+		if value != "" {
+			sb.WriteString(fmt.Sprintf("\t\t%s_%s %s;\n", module, name, value))
+		}
+	}
+	directive("connect_timeout", t.ConnectTimeout)
+	directive("read_timeout", t.ReadTimeout)
+	directive("send_timeout", t.SendTimeout)
+	if module == "proxy" {
+		directive("buffering", t.Buffering)
+		directive("request_buffering", t.RequestBuffering)
+	}
+	directive("next_upstream", t.NextUpstream)
+	return sb.String()
+}
@@ -0,0 +1,430 @@
+package nginx
+
+import (
+	"fmt"
+	"net"
+	"nginx_configure/common"
+	"nginx_configure/model"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+	timePattern     = regexp.MustCompile(`^\d+(ms|s|m|h|d)?$`)
+)
+
+// ParseUpstreamServer parses a server spec in nginx syntax without the
+// leading "server" and trailing ";", e.g.
+//
+//	10.0.0.1:8000 weight=3 max_fails=2 fail_timeout=10s backup
+func ParseUpstreamServer(spec string) (model.UpstreamServer, error) {
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(spec), ";"))
+	if len(fields) == 0 {
+		return model.UpstreamServer{}, fmt.Errorf("empty server")
+	}
+
+	server := model.UpstreamServer{Address: fields[0]}
+	if err := ValidateUpstreamAddress(server.Address); err != nil {
+		return server, err
+	}
+
+	for _, option := range fields[1:] {
+		name, value, hasValue := strings.Cut(option, "=")
+		switch name {
+		case "weight", "max_fails", "max_conns":
+			n, err := strconv.Atoi(value)
+			if !hasValue || err != nil || n < 0 {
+				return server, fmt.Errorf("%s needs a number, got %q", name, option)
+			}
+			if name == "weight" && n < 1 {
+				return server, fmt.Errorf("weight must be at least 1, got %q", option)
+			}
+			switch name {
+			case "weight":
+				server.Weight = n
+			case "max_fails":
+				server.MaxFails = &n
+			case "max_conns":
+				server.MaxConns = n
+			}
+		case "fail_timeout":
+			if !hasValue || !timePattern.MatchString(value) {
+				return server, fmt.Errorf("fail_timeout needs a time such as 10s or 1m, got %q", option)
+			}
+			server.FailTimeout = value
+		case "backup", "down":
+			if hasValue {
+				return server, fmt.Errorf("%s does not take a value", name)
+			}
+			if name == "backup" {
+				server.Backup = true
+			} else {
+				server.Down = true
+			}
+		default:
+			return server, fmt.Errorf("unknown server option %q, use weight, max_fails, fail_timeout, max_conns, backup or down", option)
+		}
+	}
+	return server, nil
+}
+
+// ValidateUpstreamAddress accepts host[:port], [ipv6][:port] and unix:/path.
+func ValidateUpstreamAddress(address string) error {
+	if strings.HasPrefix(address, "unix:") {
+		if !strings.HasPrefix(strings.TrimPrefix(address, "unix:"), "/") {
+			return fmt.Errorf("%s: unix sockets need an absolute path, e.g. unix:/run/app.sock", address)
+		}
+		return nil
+	}
+
+	host, port := address, ""
+	if strings.HasPrefix(address, "[") {
+		end := strings.Index(address, "]")
+		if end < 0 {
+			return fmt.Errorf("%s: missing ] after the IPv6 address", address)
+		}
+		host = address[1:end]
+		rest := address[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return fmt.Errorf("%s: expected :port after ]", address)
+			}
+			port = rest[1:]
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("%s: %s is not an IPv6 address", address, host)
+		}
+	} else {
+		if strings.Count(address, ":") > 1 {
+			return fmt.Errorf("%s: IPv6 addresses must be written in brackets, e.g. [%s]:8000", address, address)
+		}
+		if h, p, found := strings.Cut(address, ":"); found {
+			host, port = h, p
+		}
+		if net.ParseIP(host) == nil && !hostnamePattern.MatchString(host) {
+			return fmt.Errorf("%s: %q is not a valid IP address or host name", address, host)
+		}
+	}
+
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("%s: port must be between 1 and 65535", address)
+		}
+	}
+	return nil
+}
+
+// FormatUpstreamServer renders a server back into the spec accepted by ParseUpstreamServer.
+func FormatUpstreamServer(server model.UpstreamServer) string {
+	parts := []string{server.Address}
+	if server.Weight > 0 {
+		parts = append(parts, fmt.Sprintf("weight=%d", server.Weight))
+	}
+	if server.MaxFails != nil {
+		parts = append(parts, fmt.Sprintf("max_fails=%d", *server.MaxFails))
+	}
+	if server.FailTimeout != "" {
+		parts = append(parts, "fail_timeout="+server.FailTimeout)
+	}
+	if server.MaxConns > 0 {
+		parts = append(parts, fmt.Sprintf("max_conns=%d", server.MaxConns))
+	}
+	if server.Backup {
+		parts = append(parts, "backup")
+	}
+	if server.Down {
+		parts = append(parts, "down")
+	}
+	return strings.Join(parts, " ")
+}
+
+// ValidateUpstreams checks the servers as a whole against the balancing method.
+func ValidateUpstreams(setup string, servers []model.UpstreamServer, balancing model.Balancing) error {
+	if len(servers) == 0 {
+		return fmt.Errorf("at least one upstream server is needed")
+	}
+	method := balancing.Method
+	if method == "" && setup == "Websocket" {
+		method = model.BalanceIPHash
+	}
+	active := 0
+	for _, server := range servers {
+		if server.Backup && (method == model.BalanceIPHash || method == model.BalanceHash || method == model.BalanceRandomTwo) {
+			return fmt.Errorf("%s: backup servers cannot be used with %s balancing", server.Address, method)
+		}
+		if !server.Backup && !server.Down {
+			active++
+		}
+	}
+	if active == 0 {
+		return fmt.Errorf("at least one server must be neither backup nor down")
+	}
+	return nil
+}
+
+// UpstreamBlock is an upstream block found in a config file.
+type UpstreamBlock struct {
+	Name string
+	// Method is the balancing method declared in the block, "" for round robin.
+	Method  string
+	Servers []model.UpstreamServer
+}
+
+var (
+	upstreamStart = regexp.MustCompile(`^\s*upstream\s+(\S+)\s*\{\s*$`)
+	serverLine    = regexp.MustCompile(`^(\s*)server\s+(.+?);\s*$`)
+)
+
+// ReadUpstreams parses the upstream blocks of a config file.
+func ReadUpstreams(configPath string) ([]UpstreamBlock, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []UpstreamBlock
+	var current *UpstreamBlock
+	for _, line := range strings.Split(string(data), "\n") {
+		if current == nil {
+			if match := upstreamStart.FindStringSubmatch(line); match != nil {
+				blocks = append(blocks, UpstreamBlock{Name: match[1]})
+				current = &blocks[len(blocks)-1]
+			}
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "}":
+			current = nil
+		case strings.HasPrefix(trimmed, "ip_hash"):
+			current.Method = model.BalanceIPHash
+		case strings.HasPrefix(trimmed, "hash "):
+			current.Method = model.BalanceHash
+		case strings.HasPrefix(trimmed, "random"):
+			current.Method = model.BalanceRandomTwo
+		case strings.HasPrefix(trimmed, "least_conn"):
+			current.Method = model.BalanceLeastConn
+		default:
+			if match := serverLine.FindStringSubmatch(line); match != nil {
+				server, err := ParseUpstreamServer(match[2])
+				if err != nil {
+					return nil, fmt.Errorf("upstream %s: %v", current.Name, err)
+				}
+				current.Servers = append(current.Servers, server)
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// replaceUpstreamServers rewrites the server lines of the named upstream
+// blocks in content and leaves every other line untouched.
+func replaceUpstreamServers(content string, blocks []UpstreamBlock) string {
+	servers := make(map[string][]model.UpstreamServer)
+	for _, block := range blocks {
+		servers[block.Name] = block.Servers
+	}
+
+	var out []string
+	current := ""
+	written := false
+	indent := "    "
+	for _, line := range strings.Split(content, "\n") {
+		if current == "" {
+			if match := upstreamStart.FindStringSubmatch(line); match != nil {
+				if _, ok := servers[match[1]]; ok {
+					current, written = match[1], false
+				}
+			}
+			out = append(out, line)
+			continue
+		}
+
+		emit := func() {
+			for _, server := range servers[current] {
+				out = append(out, fmt.Sprintf("%sserver %s;", indent, FormatUpstreamServer(server)))
+			}
+			written = true
+		}
+		if match := serverLine.FindStringSubmatch(line); match != nil {
+			if !written {
+				indent = match[1]
+				emit()
+			}
+			continue
+		}
+		if strings.TrimSpace(line) == "}" {
+			if !written {
+				emit()
+			}
+			current = ""
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
+
+// ApplyUpstreams writes new server lists into a site's config, checks it with
+// `nginx -t` and reloads nginx gracefully. A config that fails the test is
+// rolled back. The stored site definition is updated as well.
+func ApplyUpstreams(configsBasePath string, site string, blocks []UpstreamBlock) ([]string, error) {
+	for _, block := range blocks {
+		if err := ValidateUpstreams("", block.Servers, model.Balancing{Method: block.Method}); err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", block.Name, err)
+		}
+	}
+
+	configPath := ConfigPath(configsBasePath, site)
+	original, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	updated := replaceUpstreamServers(string(original), blocks)
+	if err := os.WriteFile(configPath, []byte(updated), 0644); err != nil {
+		return nil, err
+	}
+
+	out, err := TestAndReload()
+	if err != nil {
+		if restoreErr := os.WriteFile(configPath, original, 0644); restoreErr != nil {
+			return out, fmt.Errorf("%v; restoring the previous config also failed: %v", err, restoreErr)
+		}
+		return append(out, "The previous config was restored."), err
+	}
+
+	if stored, ok := LoadSite(site); ok {
+		for _, block := range blocks {
+			if block.Name == site {
+				stored.Upstreams = block.Servers
+			}
+			for i, pool := range stored.Pools {
+				if block.Name == PoolUpstream(site, pool.Name) {
+					stored.Pools[i].Servers = block.Servers
+				}
+			}
+		}
+		if err := SaveSite(stored); err != nil {
+			return out, fmt.Errorf("config reloaded, but saving the site definition failed: %v", err)
+		}
+	}
+	return out, nil
+}
+
+// TestAndReload runs `nginx -t` and, when it passes, `nginx -s reload`, which
+// lets running workers finish their requests.
+func TestAndReload() ([]string, error) {
+	out, err := common.RunCommandOutput("nginx -t")
+	if err != nil {
+		return out, fmt.Errorf("nginx -t failed")
+	}
+	reload, err := common.RunCommandOutput("nginx -s reload")
+	out = append(out, reload...)
+	if err != nil {
+		return out, fmt.Errorf("nginx -s reload failed")
+	}
+	return append(out, "nginx reloaded."), nil
+}
+
+// FindUpstreamServer returns the block and server index of address in blocks.
+func FindUpstreamServer(blocks []UpstreamBlock, address string) (int, int, bool) {
+	for b, block := range blocks {
+		for s, server := range block.Servers {
+			if server.Address == address {
+				return b, s, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// Changes accepted by ChangeUpstreamServer.
+const (
+	UpstreamDrain   = "drain"
+	UpstreamEnable  = "enable"
+	UpstreamBackup  = "backup"
+	UpstreamPrimary = "primary"
+	UpstreamRemove  = "remove"
+	UpstreamAdd     = "add"
+)
+
+// ChangeUpstreamServer applies one change to a server of a site and reloads
+// nginx. Drain marks the server down so nginx stops sending it new requests,
+// enable clears down again. For add, spec is a full server spec that is
+// appended to the upstream named block (or the site's first upstream when
+// block is empty); for every other change spec is the server address, looked
+// up in block or, when block is empty, in the one upstream that has it.
+func ChangeUpstreamServer(configsBasePath string, site string, block string, change string, spec string) ([]string, error) {
+	blocks, err := ReadUpstreams(ConfigPath(configsBasePath, site))
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("%s has no upstream block", site)
+	}
+
+	if change == UpstreamAdd {
+		server, err := ParseUpstreamServer(spec)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, found := FindUpstreamServer(blocks, server.Address); found {
+			return nil, fmt.Errorf("%s is already an upstream server of %s", server.Address, site)
+		}
+		b := -1
+		for i := range blocks {
+			if block == "" || blocks[i].Name == block {
+				b = i
+				break
+			}
+		}
+		if b < 0 {
+			return nil, fmt.Errorf("%s has no upstream named %s", site, block)
+		}
+		blocks[b].Servers = append(blocks[b].Servers, server)
+		return ApplyUpstreams(configsBasePath, site, blocks)
+	}
+
+	var matches []string
+	b, s := -1, -1
+	for i := range blocks {
+		if block != "" && blocks[i].Name != block {
+			continue
+		}
+		for j, server := range blocks[i].Servers {
+			if server.Address == spec {
+				matches = append(matches, blocks[i].Name)
+				b, s = i, j
+			}
+		}
+	}
+	if len(matches) == 0 {
+		if block != "" {
+			return nil, fmt.Errorf("%s is not a server of the upstream %s of %s", spec, block, site)
+		}
+		return nil, fmt.Errorf("%s is not an upstream server of %s", spec, site)
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("%s is a server of the upstreams %s of %s, name the upstream to change", spec, strings.Join(matches, ", "), site)
+	}
+	server := &blocks[b].Servers[s]
+	switch change {
+	case UpstreamDrain:
+		server.Down = true
+	case UpstreamEnable:
+		server.Down = false
+	case UpstreamBackup:
+		server.Backup = true
+	case UpstreamPrimary:
+		server.Backup = false
+	case UpstreamRemove:
+		blocks[b].Servers = append(blocks[b].Servers[:s], blocks[b].Servers[s+1:]...)
+	default:
+		return nil, fmt.Errorf("unknown change %q", change)
+	}
+	return ApplyUpstreams(configsBasePath, site, blocks)
+}
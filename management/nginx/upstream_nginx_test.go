@@ -0,0 +1,99 @@
+package nginx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUpstreamServer(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"10.0.0.1:8000", "10.0.0.1:8000"},
+		{"  app.internal:8080;  ", "app.internal:8080"},
+		{"10.0.0.1:8000 weight=3 max_fails=2 fail_timeout=10s max_conns=100 backup", "10.0.0.1:8000 weight=3 max_fails=2 fail_timeout=10s max_conns=100 backup"},
+		{"10.0.0.1 max_fails=0 down", "10.0.0.1 max_fails=0 down"},
+		{"10.0.0.1 fail_timeout=1m weight=2", "10.0.0.1 weight=2 fail_timeout=1m"},
+		{"10.0.0.1:99999 weight=2", ""},
+		{"[2001:db8::1]:443 weight=1", "[2001:db8::1]:443 weight=1"},
+		{"unix:/run/app.sock", "unix:/run/app.sock"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			server, err := ParseUpstreamServer(tt.spec)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("accepted %q as %+v", tt.spec, server)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := FormatUpstreamServer(server); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			again, err := ParseUpstreamServer(FormatUpstreamServer(server))
+			if err != nil || FormatUpstreamServer(again) != tt.want {
+				t.Fatalf("round trip of %q gave %q, %v", tt.want, FormatUpstreamServer(again), err)
+			}
+		})
+	}
+}
+
+func TestParseUpstreamServerErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"", "empty server"},
+		{"10.0.0.1 weight=0", "weight must be at least 1"},
+		{"10.0.0.1 weight", "weight needs a number"},
+		{"10.0.0.1 max_fails=-1", "max_fails needs a number"},
+		{"10.0.0.1 max_conns=many", "max_conns needs a number"},
+		{"10.0.0.1 fail_timeout=soon", "fail_timeout needs a time"},
+		{"10.0.0.1 backup=yes", "backup does not take a value"},
+		{"10.0.0.1 slow_start=30s", "unknown server option"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := ParseUpstreamServer(tt.spec)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateUpstreamAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		ok      bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.1:8000", true},
+		{"app-1.example.com:443", true},
+		{"[::1]", true},
+		{"[2001:db8::1]:8080", true},
+		{"unix:/run/php/php-fpm.sock", true},
+		{"unix:run/app.sock", false},
+		{"2001:db8::1", false},
+		{"[2001:db8::1", false},
+		{"[2001:db8::1]8080", false},
+		{"[10.0.0.1]:80", false},
+		{"10.0.0.1:0", false},
+		{"10.0.0.1:65536", false},
+		{"10.0.0.1:http", false},
+		{"bad_host:80", false},
+		{"-app:80", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := ValidateUpstreamAddress(tt.address)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
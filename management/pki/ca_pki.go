@@ -0,0 +1,219 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"nginx_configure/common"
+	"os"
+	"path/filepath"
+	"regexp"
+	"software.sslmate.com/src/go-pkcs12"
+	"time"
+)
+
+// CABasePath holds the private CA of this tool and the client certificates it issued.
+var CABasePath = filepath.Join(common.StateBasePath, "ca")
+
+// CACertPath is the CA certificate nginx verifies client certificates against.
+var CACertPath = filepath.Join(CABasePath, "ca.crt")
+
+var (
+	caKeyPath       = filepath.Join(CABasePath, "ca.key")
+	clientsBasePath = filepath.Join(CABasePath, "clients")
+	clientName      = regexp.MustCompile(`^[a-zA-Z0-9._@-]+$`)
+)
+
+const caLifetime = 10 * 365 * 24 * time.Hour
+
+// Client is a client certificate issued by the private CA.
+type Client struct {
+	Name     string
+	Serial   string
+	NotAfter time.Time
+	// Path is the PKCS#12 file holding the key, the certificate and the CA.
+	Path string
+	// Password protects the PKCS#12 file.
+	Password string
+}
+
+// CAExists reports whether the private CA has been created.
+func CAExists() bool {
+	return common.FileExists(CACertPath) && common.FileExists(caKeyPath)
+}
+
+// EnsureCA creates the private CA unless it exists and returns its certificate and key.
+func EnsureCA() (*x509.Certificate, crypto.Signer, error) {
+	if CAExists() {
+		return loadCA()
+	}
+	if err := os.MkdirAll(CABasePath, 0700); err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "nginx_configure client CA " + hostname, Organization: []string{"nginx_configure"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(caKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(CACertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+func loadCA() (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(CACertPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%s is not a PEM certificate", CACertPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(caKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%s is not a PEM key", caKeyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s cannot sign certificates", caKeyPath)
+	}
+	return cert, signer, nil
+}
+
+// ValidateClientName checks the name a client certificate is issued for. It
+// becomes the common name and the file name.
+func ValidateClientName(name string) error {
+	if !clientName.MatchString(name) {
+		return fmt.Errorf("%q is not a valid client name, use letters, digits and . _ @ -", name)
+	}
+	return nil
+}
+
+// IssueClient issues a client certificate for name that is valid for the
+// given number of days and writes it as a PKCS#12 file into the clients
+// directory. An empty password generates one.
+func IssueClient(name string, days int, password string) (Client, error) {
+	if err := ValidateClientName(name); err != nil {
+		return Client{}, err
+	}
+	if days < 1 {
+		return Client{}, fmt.Errorf("a client certificate must be valid for at least one day")
+	}
+	caCert, caKey, err := EnsureCA()
+	if err != nil {
+		return Client{}, fmt.Errorf("preparing the CA: %v", err)
+	}
+	if password == "" {
+		if password, err = newPassword(); err != nil {
+			return Client{}, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Client{}, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return Client{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: caCert.Subject.Organization},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, days),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return Client{}, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return Client{}, err
+	}
+	pfx, err := pkcs12.Modern.Encode(key, cert, []*x509.Certificate{caCert}, password)
+	if err != nil {
+		return Client{}, err
+	}
+
+	if err := os.MkdirAll(clientsBasePath, 0700); err != nil {
+		return Client{}, err
+	}
+	client := Client{
+		Name:     name,
+		Serial:   fmt.Sprintf("%X", cert.SerialNumber),
+		NotAfter: cert.NotAfter,
+		Path:     filepath.Join(clientsBasePath, fmt.Sprintf("%s-%X.p12", name, cert.SerialNumber)),
+		Password: password,
+	}
+	if err := os.WriteFile(client.Path, pfx, 0600); err != nil {
+		return Client{}, err
+	}
+	// Keep the certificate next to the bundle so issued serials can be looked up.
+	certPath := filepath.Join(clientsBasePath, fmt.Sprintf("%s-%X.crt", name, cert.SerialNumber))
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return Client{}, err
+	}
+	return client, nil
+}
+
+// newSerial returns a random 128 bit certificate serial number.
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func newPassword() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,184 @@
+package pki
+
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"nginx_configure/common"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// HtpasswdBasePath holds the htpasswd files used for basic auth, one per name.
+var HtpasswdBasePath = "/etc/nginx/htpasswd"
+
+var (
+	htpasswdName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+	htpasswdUser = regexp.MustCompile(`^[^:\s]+$`)
+)
+
+// HtpasswdPath returns the path of the htpasswd file name.
+func HtpasswdPath(name string) string {
+	return filepath.Join(HtpasswdBasePath, name)
+}
+
+// ValidateHtpasswdName checks the name of an htpasswd file.
+func ValidateHtpasswdName(name string) error {
+	if !htpasswdName.MatchString(name) || name == "off" {
+		return fmt.Errorf("%q is not a valid htpasswd file name, use letters, digits and . _ -", name)
+	}
+	return nil
+}
+
+// HtpasswdFiles returns the names of the htpasswd files.
+func HtpasswdFiles() []string {
+	entries, _ := os.ReadDir(HtpasswdBasePath)
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// Users returns the user names in the htpasswd file name, sorted.
+func Users(name string) ([]string, error) {
+	entries, err := readHtpasswd(name)
+	if err != nil {
+		return nil, err
+	}
+	return common.ExtractKeys(entries), nil
+}
+
+// SetUser adds a user to the htpasswd file name or replaces their password,
+// hashed with bcrypt. The file is created when missing. An empty password
+// generates one. It returns the password and whether the user was new.
+func SetUser(name string, username string, password string) (string, bool, error) {
+	if !htpasswdUser.MatchString(username) {
+		return "", false, fmt.Errorf("%q is not a valid user name, it must not contain : or spaces", username)
+	}
+	entries, err := readHtpasswd(name)
+	if err != nil && !os.IsNotExist(err) {
+		return "", false, err
+	}
+	if entries == nil {
+		entries = make(map[string]string)
+	}
+	if password == "" {
+		if password, err = newPassword(); err != nil {
+			return "", false, err
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", false, err
+	}
+	_, exists := entries[username]
+	entries[username] = string(hash)
+	return password, !exists, writeHtpasswd(name, entries)
+}
+
+// RemoveUser deletes a user from the htpasswd file name.
+func RemoveUser(name string, username string) error {
+	entries, err := readHtpasswd(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[username]; !ok {
+		return fmt.Errorf("%s has no user %s", HtpasswdPath(name), username)
+	}
+	delete(entries, username)
+	return writeHtpasswd(name, entries)
+}
+
+// readHtpasswd reads the hashes of an htpasswd file by user name.
+func readHtpasswd(name string) (map[string]string, error) {
+	if err := ValidateHtpasswdName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(HtpasswdPath(name))
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		username, hash, found := strings.Cut(strings.TrimSpace(line), ":")
+		if found && !strings.HasPrefix(username, "#") {
+			entries[username] = hash
+		}
+	}
+	return entries, nil
+}
+
+// writeHtpasswd writes the file readable by root and the group nginx workers run as.
+func writeHtpasswd(name string, entries map[string]string) error {
+	if err := os.MkdirAll(HtpasswdBasePath, 0755); err != nil {
+		return err
+	}
+	var sb strings.Builder
+	for _, username := range common.ExtractKeys(entries) {
+		sb.WriteString(username + ":" + entries[username] + "\n")
+	}
+	path := HtpasswdPath(name)
+	gid, ok := nginxGroup()
+	mode := os.FileMode(0640)
+	if !ok {
+		mode = 0644
+	}
+	if err := os.WriteFile(path, []byte(sb.String()), mode); err != nil {
+		return err
+	}
+	if ok {
+		if err := os.Chown(path, 0, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, mode)
+}
+
+// nginxGroup returns the group id nginx workers run as: the group of the user
+// directive in nginx.conf, or www-data or nginx on Debian or RHEL based
+// systems when there is none.
+func nginxGroup() (int, bool) {
+	names := []string{"www-data", "nginx"}
+	if group, ok := nginxConfGroup(); ok {
+		names = []string{group}
+	}
+	for _, name := range names {
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			continue
+		}
+		gid, err := strconv.Atoi(group.Gid)
+		if err == nil {
+			return gid, true
+		}
+	}
+	return 0, false
+}
+
+// nginxConfGroup reads the group from the user directive of common.NginxConfPath,
+// "user <name> [group];". nginx uses the group named like the user when the
+// group is left out.
+func nginxConfGroup() (string, bool) {
+	data, err := os.ReadFile(common.NginxConfPath)
+	if err != nil {
+		return "", false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(line), ";"))
+		if len(fields) < 2 || fields[0] != "user" {
+			continue
+		}
+		if len(fields) > 2 {
+			return fields[2], true
+		}
+		return fields[1], true
+	}
+	return "", false
+}
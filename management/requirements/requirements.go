@@ -0,0 +1,256 @@
+package requirements
+
+import (
+	"fmt"
+	tea "github.com/charmbracelet/bubbletea"
+	"nginx_configure/common"
+	"nginx_configure/management/firewall"
+	"nginx_configure/management/nginx"
+	"nginx_configure/management/pki"
+	"nginx_configure/model"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Plan is an orchestrated flow: a summary shown before confirmation, the
+// steps to run and a report of what was installed, removed or preserved.
+type Plan struct {
+	Summary []string
+	Steps   []common.Step
+
+	installed []string
+	removed   []string
+	preserved []string
+}
+
+// Run executes the plan and ends with its report.
+func (p Plan) Run() tea.Cmd {
+	return common.RunStepsWithReport(p.Steps, p.report)
+}
+
+func (p Plan) report(failed string) common.LogData {
+	var logs []common.LogItem
+	section := func(title string, items []string, color common.Color) {
+		if len(items) == 0 {
+			return
+		}
+		logs = append(logs, common.LogItem{Msg: title, Color: color})
+		for _, item := range items {
+			logs = append(logs, common.LogItem{Msg: "  " + item, Color: common.White})
+		}
+	}
+
+	logs = append(logs, common.LogItem{Msg: "Report:", Color: common.Gold})
+	if failed != "" {
+		logs = append(logs, common.LogItem{Msg: "Stopped after a failed step: " + failed + " Nothing after it was run.", Color: common.Red})
+		section("Planned to install:", p.installed, common.Gold)
+		section("Planned to remove:", p.removed, common.Gold)
+	} else {
+		section("Installed:", p.installed, common.Green)
+		section("Removed:", p.removed, common.Green)
+	}
+	section("Preserved:", p.preserved, common.Blue)
+
+	if failed == "" {
+		// Show what is actually on the box now.
+		if info := nginx.Inspect(); info.Version != "" {
+			logs = append(logs, common.LogItem{Msg: "Nginx " + info.Version + " is installed.", Color: common.White})
+		}
+		if firewall.Installed() {
+			logs = append(logs, common.LogItem{Msg: "ufw is installed.", Color: common.White})
+		}
+		logs = append(logs, common.LogItem{Msg: "All is done.", Color: common.Green})
+	}
+	return common.LogData{Messages: logs}
+}
+
+// Install installs whatever of nginx and ufw is missing and keeps what is already there.
+func Install() Plan {
+	var p Plan
+	record := nginx.LoadInstall()
+
+	if info := nginx.Inspect(); info.Version != "" {
+		p.Summary = append(p.Summary, "Nginx "+info.Version+" is already installed and will be kept.")
+		p.preserved = append(p.preserved, "nginx "+info.Version)
+	} else {
+		p.Summary = append(p.Summary, "Nginx will be installed from "+describeInstall(record)+".")
+		p.Steps = append(p.Steps, nginx.InstallSteps(record)...)
+		p.installed = append(p.installed, "nginx ("+describeInstall(record)+")")
+	}
+
+	if firewall.Installed() {
+		p.Summary = append(p.Summary, "ufw is already installed and will be kept with its rules.")
+		p.preserved = append(p.preserved, "ufw and its rules")
+	} else {
+		p.Summary = append(p.Summary, "ufw will be installed and "+strings.Join(firewall.DefaultPorts, ", ")+" allowed.")
+		p.Steps = append(p.Steps, firewall.InstallSteps()...)
+		p.installed = append(p.installed, "ufw (allowing "+strings.Join(firewall.DefaultPorts, ", ")+")")
+	}
+
+	if common.FileExists(common.CertBasePath) {
+		p.preserved = append(p.preserved, "certificates in "+common.CertBasePath)
+	} else {
+		p.Summary = append(p.Summary, common.CertBasePath+" will be created.")
+		p.Steps = append(p.Steps, ensureCertBasePath())
+		p.installed = append(p.installed, "certificate directory "+common.CertBasePath)
+	}
+
+	if len(p.Steps) == 0 {
+		p.Summary = append(p.Summary, "Everything is already installed, nothing to do.")
+	}
+	return p
+}
+
+// Reinstall archives the current setup, then removes and reinstalls nginx and
+// ufw. nginx comes back from the recorded channel and version, the stored
+// sites are rendered again and their ports reopened. Certificates are kept.
+func Reinstall(configsBasePath string, certBasePath string) Plan {
+	var p Plan
+	record := nginx.LoadInstall()
+	archivePath := nginx.NewArchivePath()
+	removal := nginx.PreviewDelete(configsBasePath)
+	sites := nginx.StoredSites()
+	unstored := len(removal.Sites) - len(sites)
+	if unstored < 0 {
+		unstored = 0
+	}
+
+	p.Summary = append(p.Summary, "/etc/nginx, "+common.CertBasePath+", "+common.StateBasePath+" and the certificates the configs reference will be archived to "+archivePath+".")
+	p.Steps = append(p.Steps, nginx.ArchiveStep(archivePath))
+	p.preserved = append(p.preserved, "archive "+archivePath)
+
+	if nginx.Inspect().Version != "" {
+		p.Summary = append(p.Summary, fmt.Sprintf("Nginx (%s) and /etc/nginx with %d generated site(s) will be removed.", strings.Join(removal.Packages, ", "), len(removal.Sites)))
+		p.Steps = append(p.Steps, nginx.DeleteSteps(configsBasePath)...)
+		p.removed = append(p.removed, fmt.Sprintf("nginx and /etc/nginx (%d generated site(s))", len(removal.Sites)))
+	}
+	p.Summary = append(p.Summary, "Nginx will be installed from "+describeInstall(record)+".")
+	p.Steps = append(p.Steps, nginx.InstallSteps(record)...)
+	p.installed = append(p.installed, "nginx ("+describeInstall(record)+")")
+
+	if common.FileExists(pki.HtpasswdBasePath) {
+		p.Summary = append(p.Summary, "The htpasswd files in "+pki.HtpasswdBasePath+" will be restored from the archive.")
+		p.Steps = append(p.Steps, common.CommandStep("Restoring "+pki.HtpasswdBasePath+" from the archive...",
+			"tar -xzf "+archivePath+" -C / "+strings.TrimPrefix(pki.HtpasswdBasePath, "/")))
+		p.preserved = append(p.preserved, "htpasswd files in "+pki.HtpasswdBasePath+" (restored from the archive)")
+	}
+	if len(sites) > 0 {
+		p.Summary = append(p.Summary, fmt.Sprintf("%d site(s) will be rendered again from their definitions in %s.", len(sites), nginx.SitesBasePath))
+		p.Steps = append(p.Steps, common.Step{
+			Title: "Rendering the stored sites...",
+			Run:   func() ([]string, error) { return nginx.RestoreSites(configsBasePath, certBasePath) },
+		})
+		p.installed = append(p.installed, fmt.Sprintf("%d site(s) rendered again from %s", len(sites), nginx.SitesBasePath))
+	}
+	if unstored > 0 {
+		p.Summary = append(p.Summary, fmt.Sprintf("%d config(s) without a stored definition will not come back; they are only in the archive.", unstored))
+	}
+
+	if firewall.Installed() {
+		p.Summary = append(p.Summary, "ufw will be removed; its rules are reset.")
+		p.Steps = append(p.Steps, firewall.DeleteSteps()...)
+		p.removed = append(p.removed, "ufw and its rules")
+	}
+	rules := nginx.FirewallCommands(sites)
+	if firewall.Active() {
+		rules = append(rules, "ufw --force enable")
+	}
+	p.Summary = append(p.Summary, "ufw will be installed and "+strings.Join(firewall.DefaultPorts, ", ")+" allowed, together with the ports of the sites.")
+	p.Steps = append(p.Steps, firewall.InstallSteps()...)
+	p.Steps = append(p.Steps, common.Step{
+		Title: "Allowing the ports of the sites...",
+		Run:   func() ([]string, error) { return common.RunCommandsOutput(rules) },
+	})
+	p.installed = append(p.installed, "ufw (allowing "+strings.Join(firewall.DefaultPorts, ", ")+" and the ports of the sites)")
+
+	certs := certificateFiles()
+	p.Summary = append(p.Summary, fmt.Sprintf("%d certificate file(s) in %s will be kept.", len(certs), common.CertBasePath))
+	p.Steps = append(p.Steps, ensureCertBasePath())
+	p.preserved = append(p.preserved, "certificates in "+common.CertBasePath)
+
+	return p
+}
+
+// Uninstall archives the current setup and then removes nginx, ufw, the
+// certificates and the install record. Earlier archives are kept.
+func Uninstall(configsBasePath string) Plan {
+	var p Plan
+	archivePath := nginx.NewArchivePath()
+	removal := nginx.PreviewDelete(configsBasePath)
+
+	p.Summary = append(p.Summary, "/etc/nginx, "+common.CertBasePath+", "+common.StateBasePath+" and the certificates the configs reference will be archived to "+archivePath+".")
+	p.Steps = append(p.Steps, nginx.ArchiveStep(archivePath))
+	p.preserved = append(p.preserved, "archives in "+filepath.Dir(archivePath))
+
+	if nginx.Inspect().Version != "" {
+		p.Summary = append(p.Summary, fmt.Sprintf("Nginx (%s) and /etc/nginx with %d generated site(s) will be removed.", strings.Join(removal.Packages, ", "), len(removal.Sites)))
+		p.Steps = append(p.Steps, nginx.DeleteSteps(configsBasePath)...)
+		p.removed = append(p.removed, fmt.Sprintf("nginx and /etc/nginx (%d generated site(s))", len(removal.Sites)))
+	}
+
+	if firewall.Installed() {
+		p.Summary = append(p.Summary, "ufw and /etc/ufw will be removed.")
+		p.Steps = append(p.Steps, firewall.DeleteSteps()...)
+		p.removed = append(p.removed, "ufw and its rules")
+	}
+
+	certs := certificateFiles()
+	if len(certs) > 0 {
+		p.Summary = append(p.Summary, fmt.Sprintf("%d certificate file(s) in %s will be deleted:", len(certs), common.CertBasePath))
+		for _, cert := range certs {
+			p.Summary = append(p.Summary, "  "+cert)
+		}
+		p.Steps = append(p.Steps, common.Step{
+			Title: "Removing all ssl certificates...",
+			Run: func() ([]string, error) {
+				for _, cert := range certs {
+					if err := os.Remove(cert); err != nil {
+						return nil, err
+					}
+				}
+				return nil, nil
+			},
+		})
+		p.removed = append(p.removed, fmt.Sprintf("%d certificate file(s)", len(certs)))
+	}
+
+	if common.FileExists(nginx.InstallRecordPath) {
+		p.Summary = append(p.Summary, "The install record "+nginx.InstallRecordPath+" will be deleted.")
+		p.Steps = append(p.Steps, common.Step{
+			Title: "Removing install record...",
+			Run:   func() ([]string, error) { return nil, os.Remove(nginx.InstallRecordPath) },
+		})
+		p.removed = append(p.removed, "install record")
+	}
+
+	return p
+}
+
+func describeInstall(install model.Install) string {
+	text := install.Channel
+	if install.Version != "" {
+		text += ", pinned " + install.Version
+	}
+	if len(install.Modules) > 0 {
+		text += ", modules " + strings.Join(install.Modules, " ")
+	}
+	return text
+}
+
+func ensureCertBasePath() common.Step {
+	return common.Step{
+		Title: "Ensuring " + common.CertBasePath + " exists...",
+		Run:   func() ([]string, error) { return nil, os.MkdirAll(common.CertBasePath, 0755) },
+	}
+}
+
+// certificateFiles lists the certificate and key files in CertBasePath.
+func certificateFiles() []string {
+	var files []string
+	for _, ext := range []string{"*.crt", "*.pem", "*.cer", "*.key"} {
+		matches, _ := filepath.Glob(filepath.Join(common.CertBasePath, ext))
+		files = append(files, matches...)
+	}
+	return files
+}
@@ -50,3 +50,323 @@ package model
 //	//-------------------------
 //	Logs []common.LogMsg
 //}
+
+// Install describes how nginx was installed so that it can be reproduced later.
+type Install struct {
+	// Channel is one of InstallDistro, InstallStable or InstallMainline.
+	Channel string `json:"channel"`
+	// Version is the package version pinned at install time, empty means latest.
+	Version string `json:"version"`
+	// Modules holds the extra module packages installed next to nginx.
+	Modules []string `json:"modules"`
+}
+
+const (
+	InstallDistro   = "distro"
+	InstallStable   = "stable"
+	InstallMainline = "mainline"
+)
+
+// Site is everything needed to generate one site config.
+type Site struct {
+	Name      string           `json:"name"`
+	Setup     string           `json:"setup"`
+	Upstreams []UpstreamServer `json:"upstreams"`
+	Balancing Balancing        `json:"balancing"`
+	CType     string           `json:"ctype"`
+	CertName  string           `json:"cert_name"`
+	// TLSProfile is one of the TLS* profile names, empty keeps the original fixed settings.
+	TLSProfile string `json:"tls_profile,omitempty"`
+	// Domain is the server_name of SSL sites, the names of Domains separated by spaces.
+	Domain string `json:"domain"`
+	// Domains are the server names of SSL sites, the certificate's SANs or extra names.
+	Domains []string `json:"domains,omitempty"`
+	// Canonical is the name its www or apex counterpart in Domains redirects to, empty for none.
+	Canonical string      `json:"canonical,omitempty"`
+	ServerIp  string      `json:"server_ip"`
+	HttpPort  string      `json:"http_port"`
+	HttpsPort string      `json:"https_port"`
+	Tuning    Tuning      `json:"tuning"`
+	Health    HealthCheck `json:"health,omitempty"`
+	// Pools are extra upstream blocks that locations can route to.
+	Pools []Pool `json:"pools,omitempty"`
+	// Locations replace the single `location /` proxying to the site upstream.
+	Locations []Location `json:"locations,omitempty"`
+	// Static is used instead of the upstream for "Static site" setups.
+	Static Static `json:"static,omitempty"`
+	// App is used instead of the upstream for PHP-FPM and uWSGI setups.
+	App App `json:"app,omitempty"`
+	// GRPC holds the options of gRPC setups.
+	GRPC GRPC `json:"grpc,omitempty"`
+	// Stream holds the listener of TCP/UDP stream proxies.
+	Stream Stream `json:"stream,omitempty"`
+	// Security holds the security headers and OCSP stapling of SSL sites.
+	Security Security `json:"security,omitempty"`
+	// ClientAuth requires client certificates on SSL sites (mutual TLS).
+	ClientAuth ClientAuth `json:"client_auth,omitempty"`
+	// Redirect configures the plain HTTP server of SSL sites.
+	Redirect Redirect `json:"redirect,omitempty"`
+	// ExtraCerts are certificates served next to CertName.
+	ExtraCerts []SiteCert `json:"extra_certs,omitempty"`
+	// Protection limits requests and connections per client.
+	Protection Protection `json:"protection,omitempty"`
+	// Access restricts the site by client address and basic auth.
+	Access Access `json:"access,omitempty"`
+}
+
+// Access restricts which clients reach a site.
+type Access struct {
+	// Allow and Deny are addresses or CIDRs. With Allow set every other client is denied.
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// AuthFile is the name of an htpasswd file managed by the tool, empty disables basic auth.
+	AuthFile  string `json:"auth_file,omitempty"`
+	AuthRealm string `json:"auth_realm,omitempty"`
+	// Satisfy is "any" to let clients in by address or password, empty requires both.
+	Satisfy string `json:"satisfy,omitempty"`
+	// RealIPFrom are the proxies, e.g. a CDN or load balancer, whose RealIPHeader
+	// is trusted as the client address.
+	RealIPFrom   []string `json:"real_ip_from,omitempty"`
+	RealIPHeader string   `json:"real_ip_header,omitempty"`
+	// CDN names the CDN the site is behind, e.g. cloudflare. Its published
+	// ranges are trusted proxies and its client address header is used.
+	CDN string `json:"cdn,omitempty"`
+	// CDNFirewall lets only the CDN ranges reach the web ports of the site.
+	CDNFirewall bool `json:"cdn_firewall,omitempty"`
+}
+
+// SatisfyAny lets a client in when either the address or the password check passes.
+const SatisfyAny = "any"
+
+// Protection limits the request rate and the concurrent connections of each
+// client, identified by Key.
+type Protection struct {
+	// Key is one of the LimitBy* constants, empty means LimitByAddress.
+	Key string `json:"key,omitempty"`
+	// Header names the header holding the key for LimitByHeader and LimitByAPIKey.
+	Header string `json:"header,omitempty"`
+	// Rate is the limit_req rate, e.g. 10r/s or 300r/m, empty disables request limiting.
+	Rate    string `json:"rate,omitempty"`
+	Burst   int    `json:"burst,omitempty"`
+	NoDelay bool   `json:"nodelay,omitempty"`
+	// Connections is the limit_conn per key, 0 disables connection limiting.
+	Connections int `json:"connections,omitempty"`
+	// Status is returned to limited clients, 0 means 429. Message replaces the default body.
+	Status  int    `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	LimitByAddress = "remote_addr"
+	LimitByHeader  = "header"
+	// LimitByAPIKey limits by the API key header and by address for requests without one.
+	LimitByAPIKey = "api_key"
+)
+
+// SiteCert is an additional certificate of an SSL site.
+type SiteCert struct {
+	// Name is the certificate name in the cert base path.
+	Name string `json:"name"`
+	// ServerNames get their own HTTPS server using only this certificate.
+	// Empty serves it next to CertName for every name, e.g. ECDSA next to RSA.
+	ServerNames []string `json:"server_names,omitempty"`
+}
+
+// Redirect configures how the plain HTTP server of an SSL site sends clients to HTTPS.
+type Redirect struct {
+	// Code is 301, 302, 307 or 308, 0 means 301.
+	Code int `json:"code,omitempty"`
+	// SkipHTTP leaves out the HTTP server, the site only listens on the HTTPS port.
+	SkipHTTP bool `json:"skip_http,omitempty"`
+	// ACME serves /.well-known/acme-challenge/ over plain HTTP instead of redirecting it.
+	ACME bool `json:"acme,omitempty"`
+}
+
+// ClientCAPrivate selects the private CA of nginx_configure as ClientAuth.CA.
+const ClientCAPrivate = "nginx_configure-ca"
+
+// ClientCACloudflare selects the Cloudflare origin-pull CA as ClientAuth.CA,
+// so only requests proxied by Cloudflare are accepted (Authenticated Origin Pulls).
+const ClientCACloudflare = "cloudflare-origin-pull"
+
+// ClientAuth configures client certificate verification. An empty CA disables it.
+type ClientAuth struct {
+	// CA is a certificate name in the cert base path, or ClientCAPrivate.
+	CA string `json:"ca,omitempty"`
+	// Verify is "on" or "optional".
+	Verify string `json:"verify,omitempty"`
+	Depth  int    `json:"depth,omitempty"`
+	// ForwardHeaders passes the verification result, DN and serial to the upstream.
+	ForwardHeaders bool `json:"forward_headers,omitempty"`
+}
+
+// Security configures the security headers sent by an HTTPS server. Empty
+// values leave a header out.
+type Security struct {
+	// HSTSMaxAge in seconds, 0 disables Strict-Transport-Security.
+	HSTSMaxAge            int  `json:"hsts_max_age,omitempty"`
+	HSTSIncludeSubdomains bool `json:"hsts_include_subdomains,omitempty"`
+	HSTSPreload           bool `json:"hsts_preload,omitempty"`
+	OCSPStapling          bool `json:"ocsp_stapling,omitempty"`
+	// Resolver is the space separated list of DNS servers used to reach the OCSP responder.
+	Resolver           string `json:"resolver,omitempty"`
+	FrameOptions       string `json:"frame_options,omitempty"`
+	ContentTypeOptions bool   `json:"content_type_options,omitempty"`
+	ReferrerPolicy     string `json:"referrer_policy,omitempty"`
+	PermissionsPolicy  string `json:"permissions_policy,omitempty"`
+	CSP                string `json:"csp,omitempty"`
+}
+
+// Stream is the listener of a TCP/UDP proxy served by the nginx stream module.
+type Stream struct {
+	Port string `json:"port"`
+	// Protocol is StreamTCP or StreamUDP.
+	Protocol string `json:"protocol"`
+	// Timeout closes idle sessions, empty keeps the nginx default of 10m.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+const (
+	TLSModern       = "modern"
+	TLSIntermediate = "intermediate"
+	TLSOld          = "old"
+)
+
+const (
+	StreamTCP = "tcp"
+	StreamUDP = "udp"
+)
+
+// GRPC configures a site that proxies gRPC over HTTP/2.
+type GRPC struct {
+	// BackendTLS talks to the upstream with grpcs:// instead of grpc://.
+	BackendTLS bool `json:"backend_tls,omitempty"`
+	// MaxMessageSize limits request bodies, e.g. 64m. gRPC streams count as one body.
+	MaxMessageSize string `json:"max_message_size,omitempty"`
+	// H2C acknowledges that gRPC is served over cleartext HTTP/2 without SSL.
+	H2C bool `json:"h2c,omitempty"`
+}
+
+// App is a FastCGI (PHP-FPM) or uwsgi application server.
+type App struct {
+	// Address is unix:/path/to.sock or host:port.
+	Address string `json:"address"`
+	// Root is the document root holding the PHP scripts.
+	Root string `json:"root,omitempty"`
+}
+
+// Static describes a site that serves files from a document root.
+type Static struct {
+	Root string `json:"root"`
+	// Index is the space separated list of index files.
+	Index string `json:"index"`
+	// SPA sends unknown paths to /index.html so the frontend router handles them.
+	SPA bool `json:"spa,omitempty"`
+	// CacheAssets marks file names containing a content hash as immutable.
+	CacheAssets bool `json:"cache_assets,omitempty"`
+	Gzip        bool `json:"gzip,omitempty"`
+	Autoindex   bool `json:"autoindex,omitempty"`
+}
+
+// Pool is an additional upstream block of a site, rendered as <site>_<name>.
+type Pool struct {
+	Name    string           `json:"name"`
+	Servers []UpstreamServer `json:"servers"`
+}
+
+// Location is one location block of a site.
+type Location struct {
+	Path string `json:"path"`
+	// Match is one of the Match* constants, empty means MatchPrefix.
+	Match string `json:"match,omitempty"`
+	// Pool is the pool the location proxies to, empty means the site upstream.
+	Pool string `json:"pool,omitempty"`
+	// Root serves files from this directory instead of proxying.
+	Root string `json:"root,omitempty"`
+	// StripPrefix removes the location path before proxying or looking up files.
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+	// Rewrite is a "regex replacement" pair applied before proxying.
+	Rewrite   string   `json:"rewrite,omitempty"`
+	Websocket bool     `json:"websocket,omitempty"`
+	Headers   []Header `json:"headers,omitempty"`
+	// Limit overrides the request limit of the site: "off" or "RATE[:BURST][:nodelay]".
+	Limit string `json:"limit,omitempty"`
+	// Allow and Deny replace the address rules of the site in this location.
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// Auth replaces the htpasswd file of the site in this location, "off" disables basic auth.
+	Auth string `json:"auth,omitempty"`
+}
+
+const (
+	MatchPrefix = "prefix"
+	MatchExact  = "exact"
+	MatchRegex  = "regex"
+)
+
+// Header is a request header sent to the upstream, or a response header
+// added to the reply when Response is set.
+type Header struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Response bool   `json:"response,omitempty"`
+}
+
+// HealthCheck configures how the upstream servers of a site are probed.
+// Without a path only a TCP connect is tried.
+type HealthCheck struct {
+	// Path is requested over HTTP after the connect succeeds, e.g. /healthz.
+	Path string `json:"path,omitempty"`
+	// Status is the expected HTTP status, 0 accepts any 2xx or 3xx.
+	Status int `json:"status,omitempty"`
+}
+
+// Balancing selects how the upstream block spreads requests over its servers.
+type Balancing struct {
+	// Method is one of the Balance* constants, empty means the setup default.
+	Method string `json:"method"`
+	// Key is the hash key for BalanceHash, e.g. $request_uri.
+	Key string `json:"key,omitempty"`
+	// Consistent enables ketama consistent hashing for BalanceHash.
+	Consistent bool `json:"consistent,omitempty"`
+}
+
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+	BalanceIPHash     = "ip_hash"
+	BalanceHash       = "hash"
+	BalanceRandomTwo  = "random_two_least_conn"
+)
+
+// UpstreamServer is one `server` line of an upstream block.
+type UpstreamServer struct {
+	// Address is host[:port], [ipv6][:port] or unix:/path/to.sock.
+	Address string `json:"address"`
+	// Weight, MaxConns: 0 leaves the nginx default.
+	Weight   int `json:"weight,omitempty"`
+	MaxConns int `json:"max_conns,omitempty"`
+	// MaxFails is a pointer because max_fails=0 is meaningful (disables failure accounting).
+	MaxFails *int `json:"max_fails,omitempty"`
+	// FailTimeout is an nginx time such as 10s, empty leaves the default.
+	FailTimeout string `json:"fail_timeout,omitempty"`
+	Backup      bool   `json:"backup,omitempty"`
+	Down        bool   `json:"down,omitempty"`
+}
+
+// Tuning holds optional proxy settings. Empty fields keep the nginx defaults.
+type Tuning struct {
+	// Preset is the name of the preset the values were filled from.
+	Preset string `json:"preset,omitempty"`
+	// Keepalive is the number of idle upstream connections kept per worker.
+	Keepalive        int    `json:"keepalive,omitempty"`
+	ConnectTimeout   string `json:"connect_timeout,omitempty"`
+	ReadTimeout      string `json:"read_timeout,omitempty"`
+	SendTimeout      string `json:"send_timeout,omitempty"`
+	Buffering        string `json:"buffering,omitempty"`
+	RequestBuffering string `json:"request_buffering,omitempty"`
+	// ClientMaxBodySize is an nginx size such as 10m, 0 disables the check.
+	ClientMaxBodySize string `json:"client_max_body_size,omitempty"`
+	// NextUpstream is the proxy_next_upstream policy, e.g. "error timeout http_502".
+	NextUpstream string `json:"next_upstream,omitempty"`
+}
@@ -7,10 +7,17 @@ import (
 	"github.com/charmbracelet/lipgloss"
 	"log"
 	"nginx_configure/common"
+	"nginx_configure/management/doctor"
+	"nginx_configure/management/dpkg"
+	"nginx_configure/management/health"
 	"nginx_configure/management/nginx"
+	"nginx_configure/management/pki"
+	"nginx_configure/management/requirements"
+	"nginx_configure/model"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type State int
@@ -43,6 +50,108 @@ const (
 	HttpsPort
 )
 
+const (
+	NginxVersion State = iota + 19
+	NginxModules
+	DeleteNginxConfirm
+	DpkgLock
+	DpkgLockStop
+)
+
+const (
+	Balancing State = iota + 24
+	BalanceKey
+	UpstreamEditor
+	UpstreamServerEdit
+	ProxyTuning
+	TuningEditor
+	TuningFieldEdit
+)
+
+const (
+	SiteActions State = iota + 31
+	SiteUpstreams
+	UpstreamServerAction
+	UpstreamServerAdd
+	UpstreamHealth
+	HealthCheckEdit
+)
+
+const (
+	LocationEditor State = iota + 37
+	LocationEdit
+	PoolEdit
+)
+
+const (
+	DocumentRoot State = iota + 40
+	StaticIndex
+	StaticOptions
+)
+
+const (
+	PHPSocket State = iota + 43
+	AppAddress
+)
+
+const (
+	GRPCMessageSize State = iota + 45
+	GRPCBackend
+	GRPCH2C
+)
+
+const (
+	StreamListen State = iota + 48
+	StreamTimeout
+)
+
+const (
+	TLSProfileSelect State = iota + 50
+	SiteTLSProfile
+	TLSUpgrade
+)
+
+const (
+	SecurityEditor State = iota + 53
+	SecurityFieldEdit
+	SiteSecurity
+)
+
+const (
+	ClientCASelect State = iota + 56
+	SiteClientCA
+	ClientAuthEditor
+	ClientAuthFieldEdit
+	ClientCertIssue
+)
+
+const (
+	DomainAdd State = iota + 61
+	CanonicalRedirect
+	RedirectOptions
+)
+
+const (
+	CertEditor State = iota + 64
+	ExtraCertNames
+	SelectExtraCert
+)
+
+const (
+	ProtectionEditor State = iota + 67
+	ProtectionFieldEdit
+)
+
+const (
+	AccessEditor State = iota + 69
+	AccessFieldEdit
+	HtpasswdUser
+)
+
+const (
+	CertImport State = iota + 72
+)
+
 type ListModel struct {
 	Options   []string
 	ListIndex int
@@ -55,15 +164,7 @@ type CertListModel struct {
 
 type NewConfig struct {
 	DuplicateName bool
-	Name          string
-	Setup         string
-	Upstreams     []string
-	CType         string
-	CertName      string
-	Domain        string
-	ServerIp      string
-	HttpPort      string
-	HttpsPort     string
+	model.Site
 }
 
 type CLIModel struct {
@@ -74,25 +175,142 @@ type CLIModel struct {
 	FirewallMenu    ListModel
 	CertificateMenu ListModel
 	//-------------------------
+	Plan        requirements.Plan
+	PlanStarted bool
+	//-------------------------
+	InstallChannels ListModel
+	NewInstall      model.Install
+	NginxBuild      nginx.BuildInfo
+	DeleteOptions   ListModel
+	Removal         nginx.Removal
+	ArchiveOnDelete bool
+	//-------------------------
 	NewConfig NewConfig
 
 	CTypes  ListModel
 	Certs   CertListModel
 	Domains ListModel
-	Setups  ListModel
+	// DomainSANs are the names of the chosen certificate, DomainNames every name
+	// offered in the Domains step and DomainChosen the ones selected.
+	DomainSANs   []string
+	DomainNames  []string
+	DomainChosen map[string]bool
+	Canonicals   ListModel
+	Redirects    ListModel
+	CertEntries  ListModel
+	ExtraCerts   CertListModel
+	// ExtraCertFor are the server names of the extra certificate being added, empty for all names.
+	ExtraCertFor []string
+	Setups       ListModel
+	Methods      ListModel
+	Servers      ListModel
+	// ServerIndex is the upstream server being edited, -1 while adding one.
+	ServerIndex int
+	Presets     ListModel
+	Fields      ListModel
+	Locations   ListModel
+	// LocationIndex and PoolIndex are the entries being edited, -1 while adding one.
+	LocationIndex int
+	PoolIndex     int
+	Toggles       ListModel
+	PHPSockets    ListModel
+	GRPCBackends  ListModel
+	TLSProfiles   ListModel
+	TLSUpgrades   ListModel
+	// Security is edited by the security header step and the site view, SecurityFields lists it.
+	Security       model.Security
+	SecurityFields ListModel
+	// SecurityHeaders are the security directives found in the config of the selected site.
+	SecurityHeaders []string
+	// SecurityReturn is the list SecurityFieldEdit goes back to.
+	SecurityReturn State
+	// Protection is edited by the rate limiting step, ProtectionFields lists it.
+	Protection       model.Protection
+	ProtectionFields ListModel
+	// Access is edited by the access control step, AccessFields lists it.
+	Access       model.Access
+	AccessFields ListModel
+	ClientCAs    ListModel
+	// ClientAuth is edited by the client certificate steps, ClientAuthFields lists it.
+	ClientAuth       model.ClientAuth
+	ClientAuthFields ListModel
+	// ClientAuthFrom is the CA list the client certificate editor was opened from.
+	ClientAuthFrom State
+	//-------------------------
+	Sites         ListModel
+	SiteMenu      ListModel
+	SiteBlocks    []nginx.UpstreamBlock
+	SiteServers   ListModel
+	ServerActions ListModel
+	HealthOptions ListModel
+	HealthCheck   model.HealthCheck
+	HealthResults []health.Result
+	HealthWatch   bool
+	HealthTicking bool
 	//-------------------------
 
 	TextInput  textinput.Model
 	FilePicker filepicker.Model
 	//-------------------------
+	Findings []doctor.Finding
+	//-------------------------
+	LockOptions   ListModel
+	LockHolders   []dpkg.Holder
+	LockWaitStart time.Time
+	LockReturn    State
+	LockPolling   bool
+	LockStopping  bool
+	PendingCmd    tea.Cmd
+	//-------------------------
 	Logs []common.LogData
 }
 
+// lockTick re-checks the dpkg locks while a flow waits for them.
+type lockTick time.Time
+
+// lockStopped carries the output of stopping a lock holder.
+type lockStopped common.LogData
+
+// upstreamsChanged carries the output of changing an upstream server of a site.
+type upstreamsChanged common.LogData
+
+// healthReport carries the results of probing the upstream servers of a site.
+type healthReport struct {
+	Results []health.Result
+	Err     error
+}
+
+// healthTick starts the next probe while the health view is watched.
+type healthTick time.Time
+
+// healthWatchInterval is how often the health view refreshes in watch mode.
+const healthWatchInterval = 5 * time.Second
+
+// doctorReport carries the findings of the pre-flight check run at startup.
+type doctorReport []doctor.Finding
+
 const (
-	configsBasePath = "/etc/nginx/conf.d/"
+	configsBasePath = common.ConfigsBasePath
 	CertBasePath    = "/etc/ssl/files/"
 )
 
+// balanceMethods maps the balancing menu options to the method and hash consistency stored on the site.
+var balanceMethods = map[string]model.Balancing{
+	"Round robin":                   {Method: model.BalanceRoundRobin},
+	"Least connections":             {Method: model.BalanceLeastConn},
+	"IP hash (sticky per client)":   {Method: model.BalanceIPHash},
+	"Hash by key":                   {Method: model.BalanceHash},
+	"Hash by key (consistent)":      {Method: model.BalanceHash, Consistent: true},
+	"Random, two least connections": {Method: model.BalanceRandomTwo},
+}
+
+// installChannels maps the install menu options to the channel stored in the install record.
+var installChannels = map[string]string{
+	"Distribution package": model.InstallDistro,
+	"nginx.org stable":     model.InstallStable,
+	"nginx.org mainline":   model.InstallMainline,
+}
+
 var (
 	//information       = lipgloss.NewStyle().Margin(0, 0, 0, 0).Padding(0, 0, 0, 0).Foreground(lipgloss.Color("#1E90FF"))
 	itemStyle1        = lipgloss.NewStyle()
@@ -110,6 +328,10 @@ func initial() *CLIModel {
 
 	fp := filepicker.New()
 	fp.AllowedTypes = []string{}
+	fp.DirAllowed = true
+	fp.FileAllowed = false
+	fp.AutoHeight = false
+	fp.Height = 15
 
 	m := CLIModel{
 		State: MainList,
@@ -130,6 +352,11 @@ func initial() *CLIModel {
 				"Delete Nginx",
 				"Add Configs",
 				"Manage Configs",
+				"Upgrade TLS profiles",
+				"Issue client certificate",
+				"Basic auth users",
+				"Refresh CDN ranges",
+				"Import certificate",
 			},
 			ListIndex: 0,
 		},
@@ -150,6 +377,30 @@ func initial() *CLIModel {
 			},
 			ListIndex: 0,
 		},
+		InstallChannels: ListModel{
+			Options: []string{
+				"Distribution package",
+				"nginx.org stable",
+				"nginx.org mainline",
+			},
+			ListIndex: 0,
+		},
+		DeleteOptions: ListModel{
+			Options: []string{
+				"Archive, then uninstall",
+				"Uninstall without archive",
+				"Cancel",
+			},
+			ListIndex: 0,
+		},
+		LockOptions: ListModel{
+			Options: []string{
+				"Keep waiting",
+				"Stop the process holding the lock",
+				"Cancel",
+			},
+			ListIndex: 0,
+		},
 		CTypes: ListModel{
 			Options: []string{
 				"SSL",
@@ -161,6 +412,63 @@ func initial() *CLIModel {
 			Options: []string{
 				"Websocket",
 				"Default",
+				nginx.SetupStatic,
+				nginx.SetupPHP,
+				nginx.SetupUWSGI,
+				nginx.SetupGRPC,
+				nginx.SetupStream,
+			},
+			ListIndex: 0,
+		},
+		TLSUpgrades: ListModel{
+			Options: []string{
+				"intermediate -> modern",
+				"old -> intermediate",
+				"old -> modern",
+				"no profile -> intermediate",
+				"no profile -> modern",
+			},
+			ListIndex: 0,
+		},
+		GRPCBackends: ListModel{
+			Options: []string{
+				"grpc:// (plaintext to the backend)",
+				"grpcs:// (TLS to the backend)",
+			},
+			ListIndex: 0,
+		},
+		Methods: ListModel{
+			Options: []string{
+				"Round robin",
+				"Least connections",
+				"IP hash (sticky per client)",
+				"Hash by key",
+				"Hash by key (consistent)",
+				"Random, two least connections",
+			},
+			ListIndex: 0,
+		},
+		Presets: ListModel{
+			Options:   nginx.TuningPresets,
+			ListIndex: 0,
+		},
+		SiteMenu: ListModel{
+			Options: []string{
+				"Upstream servers",
+				"Upstream health",
+				"TLS profile",
+				"Security headers",
+				"Client certificates (mTLS)",
+			},
+			ListIndex: 0,
+		},
+		ServerActions: ListModel{
+			Options: []string{
+				"Mark down (drain)",
+				"Mark up",
+				"Make backup",
+				"Make primary",
+				"Remove",
 			},
 			ListIndex: 0,
 		},
@@ -172,7 +480,9 @@ func initial() *CLIModel {
 }
 
 func (m *CLIModel) Init() tea.Cmd {
-	return nil
+	return func() tea.Msg {
+		return doctorReport(doctor.Run(configsBasePath))
+	}
 }
 
 func (m *CLIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -184,6 +494,12 @@ func (m *CLIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	m.TextInput, cmd = m.TextInput.Update(msg)
 	cmdS = append(cmdS, cmd)
 
+	// The file picker reads directories in the background; keys are handled below.
+	if _, isKey := msg.(tea.KeyMsg); !isKey && m.State == DocumentRoot {
+		m.FilePicker, cmd = m.FilePicker.Update(msg)
+		cmdS = append(cmdS, cmd)
+	}
+
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		key := msg.String()
@@ -204,36 +520,40 @@ func (m *CLIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			case "enter":
 				switch menu.Options[menu.ListIndex] {
 				case "Install Requirements":
-					m.State = InstallRequirements
+					m.startPlan(InstallRequirements, requirements.Install())
 				case "Nginx Management":
+					m.NginxBuild = nginx.Inspect()
 					m.State = NginxManagement
 				case "Firewall Management":
 					m.State = FirewallManagement
 				case "Certificate Management":
 					m.State = CertificateManagement
 				case "Reinstall everything":
-					m.State = ReinstallEverything
+					m.startPlan(ReinstallEverything, requirements.Reinstall(configsBasePath, CertBasePath))
 				case "Uninstall and delete everything":
-					m.State = UninstallAndDeleteEverything
+					m.startPlan(UninstallAndDeleteEverything, requirements.Uninstall(configsBasePath))
 				}
 			}
-		case InstallRequirements:
-			menu := m.MainMenu
+		case InstallRequirements, ReinstallEverything, UninstallAndDeleteEverything:
 			switch key {
-			case "q":
+			case "ctrl+c":
 				return m, tea.Quit
-			case "b":
+			case "ctrl+b":
 				m.SetState(MainList, nil)
-			case "up", "w":
-				if menu.ListIndex > 0 {
-					m.MainMenu.ListIndex--
+			case "enter":
+				if m.PlanStarted {
+					break
 				}
-			case "down", "s":
-				if menu.ListIndex < len(menu.Options)-1 {
-					m.MainMenu.ListIndex++
+				value := strings.ToLower(strings.TrimSpace(m.TextInput.Value()))
+				if value == "yes" || value == "y" {
+					m.PlanStarted = true
+					m.TextInput.SetValue("")
+					m.TextInput.Blur()
+					m.Logs = nil
+					return m, m.withDpkgLock(m.Plan.Run())
 				}
-			case "enter":
-
+				m.SetState(MainList, nil)
+				return m, common.LogMessage("Canceled, nothing was changed.", common.Blue)
 			}
 
 		case NginxManagement:
@@ -256,15 +576,37 @@ func (m *CLIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				case "Install Nginx":
 					m.State = InstallNginx
 				case "Delete Nginx":
-					m.TextInput.SetValue("")
-					m.TextInput.Focus()
+					m.Removal = nginx.PreviewDelete(configsBasePath)
+					m.DeleteOptions.ListIndex = 0
 					m.State = DeleteNginx
 				case "Add Configs":
+					m.NewConfig = NewConfig{}
 					m.TextInput.SetValue("")
 					m.TextInput.Focus()
 					m.State = ConfigName
 				case "Manage Configs":
+					m.Sites = ListModel{Options: nginx.Sites(configsBasePath)}
 					m.State = ManageConfigs
+				case "Upgrade TLS profiles":
+					m.TLSUpgrades.ListIndex = 0
+					m.SetState(TLSUpgrade, nil)
+				case "Issue client certificate":
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(ClientCertIssue, nil)
+				case "Basic auth users":
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(HtpasswdUser, nil)
+				case "Refresh CDN ranges":
+					m.Logs = nil
+					return m, rewriteSites("Refreshing the Cloudflare ranges...", func() ([]string, error) {
+						return nginx.RefreshCDN(configsBasePath, CertBasePath, "cloudflare")
+					})
+				case "Import certificate":
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(CertImport, nil)
 				}
 			}
 
@@ -306,44 +648,89 @@ func (m *CLIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 			}
 
-		case ReinstallEverything:
+		//-----------------------------------------------------
+		case InstallNginx:
+			menu := m.InstallChannels
 			switch key {
 			case "q":
 				return m, tea.Quit
 			case "b":
-				m.SetState(MainList, nil)
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.InstallChannels.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.InstallChannels.ListIndex++
+				}
 			case "enter":
-
+				m.NewInstall = model.Install{Channel: installChannels[menu.Options[menu.ListIndex]]}
+				m.TextInput.SetValue("")
+				m.TextInput.Focus()
+				m.SetState(NginxVersion, nil)
 			}
-		case UninstallAndDeleteEverything:
+		case NginxVersion:
 			switch key {
-			case "q":
+			case "ctrl+c":
 				return m, tea.Quit
-			case "b":
-				m.SetState(MainList, nil)
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
 			case "enter":
-
+				m.NewInstall.Version = strings.TrimSpace(m.TextInput.Value())
+				m.TextInput.SetValue("")
+				m.TextInput.Focus()
+				m.SetState(NginxModules, nil)
 			}
-
-		//-----------------------------------------------------
-		case InstallNginx:
+		case NginxModules:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
+			case "enter":
+				m.NewInstall.Modules = strings.Fields(m.TextInput.Value())
+				m.Logs = nil
+				return m, m.withDpkgLock(nginx.Install(m.NewInstall))
+			}
+		case DeleteNginx:
+			menu := m.DeleteOptions
 			switch key {
 			case "q":
 				return m, tea.Quit
 			case "b":
 				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.DeleteOptions.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.DeleteOptions.ListIndex++
+				}
 			case "enter":
-				return m, nginx.Install()
+				switch menu.Options[menu.ListIndex] {
+				case "Archive, then uninstall":
+					m.ArchiveOnDelete = true
+				case "Uninstall without archive":
+					m.ArchiveOnDelete = false
+				default:
+					m.SetState(NginxManagement, nil)
+					return m, common.LogMessage("Keep Nginx Installed.", common.Blue)
+				}
+				m.TextInput.SetValue("")
+				m.TextInput.Focus()
+				m.State = DeleteNginxConfirm
 			}
-		case DeleteNginx:
+		case DeleteNginxConfirm:
 			switch key {
 			case "ctrl+b":
 				m.SetState(NginxManagement, nil)
 			case "enter":
-				value := m.TextInput.Value()
-				if value == "yes" {
+				value := strings.ToLower(strings.TrimSpace(m.TextInput.Value()))
+				if value == "yes" || value == "y" {
 					m.SetState(NginxManagement, nil)
-					return m, nginx.Delete()
+					return m, m.withDpkgLock(nginx.Delete(configsBasePath, m.ArchiveOnDelete))
 				} else {
 					m.SetState(NginxManagement, nil)
 					return m, common.LogMessage("Keep Nginx Installed.", common.Blue)
@@ -360,8 +747,7 @@ func (m *CLIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				value := m.TextInput.Value()
 				if value != "" {
 					m.NewConfig.Name = value
-					configFilePath := filepath.Join(configsBasePath, value+".conf")
-					if common.FileExists(configFilePath) {
+					if common.FileExists(nginx.ConfigPath(configsBasePath, value)) {
 						m.NewConfig.DuplicateName = true
 					} else {
 						m.NewConfig.DuplicateName = false
@@ -387,25 +773,27 @@ func (m *CLIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				}
 			case "enter":
 				m.NewConfig.Setup = menu.Options[menu.ListIndex]
+				switch m.NewConfig.Setup {
+				case nginx.SetupPHP:
+					m.PHPSockets = ListModel{Options: append(nginx.PHPSockets(), "Enter address manually")}
+					m.SetState(PHPSocket, nil)
+					return m, tea.Batch(cmdS...)
+				case nginx.SetupUWSGI:
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(AppAddress, nil)
+					return m, tea.Batch(cmdS...)
+				}
+				if m.NewConfig.Setup == nginx.SetupStatic {
+					m.NewConfig.Static = nginx.DefaultStatic
+					return m, m.pickDocumentRoot()
+				}
 				m.TextInput.SetValue("")
 				m.TextInput.Focus()
 				m.SetState(Upstreams, nil)
 			}
-		case Upstreams:
-			switch key {
-			case "ctrl+c":
-				return m, tea.Quit
-			case "ctrl+b":
-				m.SetState(NginxManagement, nil)
-			case "enter":
-				value := m.TextInput.Value()
-				if value != "" {
-					m.NewConfig.Upstreams = strings.Fields(value)
-					m.SetState(CType, nil)
-				}
-			}
-		case CType:
-			menu := m.CTypes
+		case PHPSocket:
+			menu := m.PHPSockets
 			switch key {
 			case "q":
 				return m, tea.Quit
@@ -413,47 +801,77 @@ func (m *CLIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.SetState(NginxManagement, nil)
 			case "up", "w":
 				if menu.ListIndex > 0 {
-					m.CTypes.ListIndex--
+					m.PHPSockets.ListIndex--
 				}
 			case "down", "s":
 				if menu.ListIndex < len(menu.Options)-1 {
-					m.CTypes.ListIndex++
+					m.PHPSockets.ListIndex++
 				}
 			case "enter":
-				m.NewConfig.CType = menu.Options[menu.ListIndex]
-				if m.NewConfig.CType == "SSL" {
-					certs, logMsg := common.Certificates(CertBasePath)
-					m.Certs = CertListModel{Options: certs}
-					m.SetState(SelectCert, &logMsg)
-				} else {
-					m.TextInput.SetValue("")
+				if menu.ListIndex == len(menu.Options)-1 {
+					m.TextInput.SetValue("127.0.0.1:9000")
 					m.TextInput.Focus()
-					m.SetState(ServerIp, nil)
+					m.SetState(AppAddress, nil)
+					break
 				}
+				m.NewConfig.App.Address = menu.Options[menu.ListIndex]
+				return m, m.pickDocumentRoot()
 			}
-		case SelectCert:
-			menu := m.Certs
+		case AppAddress:
 			switch key {
-			case "q":
+			case "ctrl+c":
 				return m, tea.Quit
-			case "b":
+			case "ctrl+b":
 				m.SetState(NginxManagement, nil)
-			case "up", "w":
-				if menu.ListIndex > 0 {
-					m.CTypes.ListIndex--
+			case "enter":
+				value := strings.TrimSpace(m.TextInput.Value())
+				if err := nginx.ValidateAppAddress(value); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(AppAddress, &logMsg)
+					break
 				}
-			case "down", "s":
-				if menu.ListIndex < len(menu.Options)-1 {
-					m.CTypes.ListIndex++
+				m.NewConfig.App.Address = value
+				if m.NewConfig.Setup == nginx.SetupPHP {
+					return m, m.pickDocumentRoot()
+				}
+				m.startProtection()
+			}
+		case DocumentRoot:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
+			case "c":
+				m.chooseDocumentRoot(m.FilePicker.CurrentDirectory)
+			default:
+				m.FilePicker, cmd = m.FilePicker.Update(msg)
+				if didSelect, path := m.FilePicker.DidSelectFile(msg); didSelect {
+					m.chooseDocumentRoot(path)
+					return m, nil
 				}
+				return m, cmd
+			}
+		case StaticIndex:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
 			case "enter":
-				m.NewConfig.CertName = common.GetKeyByIndex(m.Certs.Options, m.Certs.ListIndex)
-				domains, _ := common.ExtractDomains(CertBasePath + m.NewConfig.CertName + ".crt")
-				m.Domains = ListModel{Options: domains}
-				m.SetState(Domains, nil)
+				value := strings.TrimSpace(m.TextInput.Value())
+				if err := nginx.ValidateIndex(value); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(StaticIndex, &logMsg)
+					break
+				}
+				m.NewConfig.Static.Index = value
+				m.refreshToggles()
+				m.Toggles.ListIndex = len(m.Toggles.Options) - 1
+				m.SetState(StaticOptions, nil)
 			}
-		case Domains:
-			menu := m.Domains
+		case StaticOptions:
+			menu := m.Toggles
 			switch key {
 			case "q":
 				return m, tea.Quit
@@ -461,19 +879,22 @@ func (m *CLIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.SetState(NginxManagement, nil)
 			case "up", "w":
 				if menu.ListIndex > 0 {
-					m.Domains.ListIndex--
+					m.Toggles.ListIndex--
 				}
 			case "down", "s":
 				if menu.ListIndex < len(menu.Options)-1 {
-					m.Domains.ListIndex++
+					m.Toggles.ListIndex++
 				}
 			case "enter":
-				m.NewConfig.Domain = m.Domains.Options[m.Domains.ListIndex]
-				m.TextInput.SetValue("")
-				m.TextInput.Focus()
-				m.SetState(HttpPort, nil)
+				if menu.ListIndex == len(nginx.StaticToggles) {
+					m.startProtection()
+					break
+				}
+				field := nginx.StaticToggles[menu.ListIndex].Field(&m.NewConfig.Static)
+				*field = !*field
+				m.refreshToggles()
 			}
-		case ServerIp:
+		case Upstreams:
 			switch key {
 			case "ctrl+c":
 				return m, tea.Quit
@@ -482,63 +903,1493 @@ func (m *CLIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			case "enter":
 				value := m.TextInput.Value()
 				if value != "" {
-					m.NewConfig.ServerIp = value
-					m.TextInput.SetValue("")
-					m.TextInput.Focus()
-					m.SetState(HttpPort, nil)
+					var servers []model.UpstreamServer
+					for _, address := range strings.Fields(value) {
+						server, err := nginx.ParseUpstreamServer(address)
+						if err != nil {
+							logMsg := common.CreateSingleLog(err.Error(), common.Red)
+							m.SetState(Upstreams, &logMsg)
+							return m, tea.Batch(cmdS...)
+						}
+						servers = append(servers, server)
+					}
+					m.NewConfig.Upstreams = servers
+					m.refreshServers()
+					m.Servers.ListIndex = len(m.Servers.Options) - 1
+					m.SetState(UpstreamEditor, nil)
 				}
 			}
-		case HttpPort:
+		case UpstreamEditor:
+			menu := m.Servers
 			switch key {
-			case "ctrl+c":
+			case "q":
 				return m, tea.Quit
-			case "ctrl+b":
+			case "b":
 				m.SetState(NginxManagement, nil)
-			case "enter":
-				value := m.TextInput.Value()
-				if value != "" {
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.Servers.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.Servers.ListIndex++
+				}
+			case "enter":
+				switch menu.Options[menu.ListIndex] {
+				case "Done":
+					if len(m.NewConfig.Upstreams) == 0 {
+						logMsg := common.CreateSingleLog("At least one upstream server is needed.", common.Red)
+						m.SetState(UpstreamEditor, &logMsg)
+						break
+					}
+					// Websocket sites used to always get ip_hash; keep that as the preselected choice.
+					m.Methods.ListIndex = 0
+					if m.NewConfig.Setup == "Websocket" {
+						m.Methods.ListIndex = 2
+					}
+					m.SetState(Balancing, nil)
+				case "+ Add server":
+					m.ServerIndex = -1
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(UpstreamServerEdit, nil)
+				default:
+					m.ServerIndex = menu.ListIndex
+					m.TextInput.SetValue(nginx.FormatUpstreamServer(m.NewConfig.Upstreams[menu.ListIndex]))
+					m.TextInput.Focus()
+					m.SetState(UpstreamServerEdit, nil)
+				}
+			}
+		case UpstreamServerEdit:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(UpstreamEditor, nil)
+			case "enter":
+				value := strings.TrimSpace(m.TextInput.Value())
+				if value == "" {
+					// An empty spec removes the server being edited.
+					if m.ServerIndex >= 0 {
+						m.NewConfig.Upstreams = append(m.NewConfig.Upstreams[:m.ServerIndex], m.NewConfig.Upstreams[m.ServerIndex+1:]...)
+					}
+				} else {
+					server, err := nginx.ParseUpstreamServer(value)
+					if err != nil {
+						logMsg := common.CreateSingleLog(err.Error(), common.Red)
+						m.SetState(UpstreamServerEdit, &logMsg)
+						break
+					}
+					if m.ServerIndex >= 0 {
+						m.NewConfig.Upstreams[m.ServerIndex] = server
+					} else {
+						m.NewConfig.Upstreams = append(m.NewConfig.Upstreams, server)
+					}
+				}
+				m.refreshServers()
+				m.SetState(UpstreamEditor, nil)
+			}
+		case Balancing:
+			menu := m.Methods
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.Methods.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.Methods.ListIndex++
+				}
+			case "enter":
+				m.NewConfig.Balancing = balanceMethods[menu.Options[menu.ListIndex]]
+				validate := func() error {
+					return nginx.ValidateUpstreams(m.NewConfig.Setup, m.NewConfig.Upstreams, m.NewConfig.Balancing)
+				}
+				if m.NewConfig.Setup == nginx.SetupStream {
+					validate = func() error { return nginx.ValidateStream(m.NewConfig.Site) }
+				}
+				if err := validate(); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(Balancing, &logMsg)
+					break
+				}
+				if m.NewConfig.Balancing.Method == model.BalanceHash {
+					m.TextInput.SetValue("$request_uri")
+					m.TextInput.Focus()
+					m.SetState(BalanceKey, nil)
+				} else {
+					m.afterBalancing()
+				}
+			}
+		case BalanceKey:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
+			case "enter":
+				value := strings.TrimSpace(m.TextInput.Value())
+				if err := nginx.ValidateHashKey(value); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(BalanceKey, &logMsg)
+					break
+				}
+				m.NewConfig.Balancing.Key = value
+				m.afterBalancing()
+			}
+		case ProxyTuning:
+			menu := m.Presets
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.Presets.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.Presets.ListIndex++
+				}
+			case "enter":
+				m.NewConfig.Tuning = nginx.TuningPreset(menu.Options[menu.ListIndex])
+				if m.NewConfig.Tuning.Preset == "" {
+					m.startLocations()
+					break
+				}
+				m.refreshTuningFields()
+				m.Fields.ListIndex = len(m.Fields.Options) - 1
+				m.SetState(TuningEditor, nil)
+			}
+		case TuningEditor:
+			menu := m.Fields
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.Fields.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.Fields.ListIndex++
+				}
+			case "enter":
+				if menu.ListIndex == len(nginx.TuningFields) {
+					m.startLocations()
+					break
+				}
+				m.TextInput.SetValue(nginx.TuningFields[menu.ListIndex].Get(m.NewConfig.Tuning))
+				m.TextInput.Focus()
+				m.SetState(TuningFieldEdit, nil)
+			}
+		case TuningFieldEdit:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(TuningEditor, nil)
+			case "enter":
+				field := nginx.TuningFields[m.Fields.ListIndex]
+				if err := field.Set(&m.NewConfig.Tuning, strings.TrimSpace(m.TextInput.Value())); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(TuningFieldEdit, &logMsg)
+					break
+				}
+				m.refreshTuningFields()
+				m.SetState(TuningEditor, nil)
+			}
+		case LocationEditor:
+			menu := m.Locations
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.Locations.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.Locations.ListIndex++
+				}
+			case "enter":
+				locations, pools := len(m.NewConfig.Locations), len(m.NewConfig.Pools)
+				switch menu.Options[menu.ListIndex] {
+				case "Done":
+					if len(m.NewConfig.Locations) == 0 {
+						logMsg := common.CreateSingleLog("At least one location is needed.", common.Red)
+						m.SetState(LocationEditor, &logMsg)
+						break
+					}
+					if err := nginx.ValidateLocations(m.NewConfig.Site); err != nil {
+						logMsg := common.CreateSingleLog(err.Error(), common.Red)
+						m.SetState(LocationEditor, &logMsg)
+						break
+					}
+					m.startProtection()
+				case "+ Add location":
+					m.LocationIndex = -1
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(LocationEdit, nil)
+				case "+ Add upstream pool":
+					m.PoolIndex = -1
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(PoolEdit, nil)
+				default:
+					if menu.ListIndex < locations {
+						m.LocationIndex = menu.ListIndex
+						m.TextInput.SetValue(nginx.FormatLocation(m.NewConfig.Locations[m.LocationIndex]))
+						m.TextInput.Focus()
+						m.SetState(LocationEdit, nil)
+					} else if menu.ListIndex < locations+pools {
+						m.PoolIndex = menu.ListIndex - locations
+						m.TextInput.SetValue(nginx.FormatPool(m.NewConfig.Pools[m.PoolIndex]))
+						m.TextInput.Focus()
+						m.SetState(PoolEdit, nil)
+					}
+				}
+			}
+		case LocationEdit:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(LocationEditor, nil)
+			case "enter":
+				value := strings.TrimSpace(m.TextInput.Value())
+				if value == "" {
+					// An empty spec removes the location being edited.
+					if m.LocationIndex >= 0 {
+						m.NewConfig.Locations = append(m.NewConfig.Locations[:m.LocationIndex], m.NewConfig.Locations[m.LocationIndex+1:]...)
+					}
+				} else {
+					location, err := nginx.ParseLocation(value)
+					if err != nil {
+						logMsg := common.CreateSingleLog(err.Error(), common.Red)
+						m.SetState(LocationEdit, &logMsg)
+						break
+					}
+					if m.LocationIndex >= 0 {
+						m.NewConfig.Locations[m.LocationIndex] = location
+					} else {
+						m.NewConfig.Locations = append(m.NewConfig.Locations, location)
+					}
+				}
+				m.refreshLocations()
+				m.SetState(LocationEditor, nil)
+			}
+		case PoolEdit:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(LocationEditor, nil)
+			case "enter":
+				value := strings.TrimSpace(m.TextInput.Value())
+				if value == "" {
+					if m.PoolIndex >= 0 {
+						m.NewConfig.Pools = append(m.NewConfig.Pools[:m.PoolIndex], m.NewConfig.Pools[m.PoolIndex+1:]...)
+					}
+				} else {
+					pool, err := nginx.ParsePool(value)
+					if err != nil {
+						logMsg := common.CreateSingleLog(err.Error(), common.Red)
+						m.SetState(PoolEdit, &logMsg)
+						break
+					}
+					if m.PoolIndex >= 0 {
+						m.NewConfig.Pools[m.PoolIndex] = pool
+					} else {
+						m.NewConfig.Pools = append(m.NewConfig.Pools, pool)
+					}
+				}
+				m.refreshLocations()
+				m.SetState(LocationEditor, nil)
+			}
+		case StreamListen:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
+			case "enter":
+				stream, err := nginx.ParseStreamListen(m.TextInput.Value())
+				if err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(StreamListen, &logMsg)
+					break
+				}
+				m.NewConfig.Stream = stream
+				m.TextInput.SetValue("")
+				m.TextInput.Focus()
+				m.SetState(StreamTimeout, nil)
+			}
+		case StreamTimeout:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
+			case "enter":
+				m.NewConfig.Stream.Timeout = strings.TrimSpace(m.TextInput.Value())
+				if err := nginx.ValidateStream(m.NewConfig.Site); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(StreamTimeout, &logMsg)
+					break
+				}
+				m.Logs = nil
+				return m, nginx.ConfigureStream(m.NewConfig.Site)
+			}
+		case TLSProfileSelect, SiteTLSProfile:
+			menu := m.TLSProfiles
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				if m.State == SiteTLSProfile {
+					m.SetState(SiteActions, nil)
+				} else {
+					m.SetState(NginxManagement, nil)
+				}
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.TLSProfiles.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.TLSProfiles.ListIndex++
+				}
+			case "enter":
+				profile := nginx.TLSProfiles[menu.ListIndex].Name
+				if m.State == TLSProfileSelect {
+					m.NewConfig.TLSProfile = profile
+					m.Security = nginx.DefaultSecurity
+					m.refreshSecurityFields()
+					m.SecurityFields.ListIndex = len(m.SecurityFields.Options) - 1
+					m.SetState(SecurityEditor, nil)
+					break
+				}
+				site, _ := nginx.LoadSite(m.Sites.Options[m.Sites.ListIndex])
+				site.TLSProfile = profile
+				m.SetState(SiteActions, nil)
+				return m, rewriteSites("Switching "+site.Name+" to the "+profile+" TLS profile...", func() ([]string, error) {
+					return nginx.RewriteSites(configsBasePath, CertBasePath, []model.Site{site})
+				})
+			}
+		case TLSUpgrade:
+			menu := m.TLSUpgrades
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.TLSUpgrades.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.TLSUpgrades.ListIndex++
+				}
+			case "enter":
+				from, to, _ := strings.Cut(menu.Options[menu.ListIndex], " -> ")
+				if from == "no profile" {
+					from = ""
+				}
+				m.Logs = nil
+				return m, rewriteSites("Upgrading SSL sites to the "+to+" TLS profile...", func() ([]string, error) {
+					return nginx.UpgradeTLSProfiles(configsBasePath, CertBasePath, from, to)
+				})
+			}
+		case SecurityEditor, SiteSecurity:
+			menu := m.SecurityFields
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				if m.State == SiteSecurity {
+					m.SetState(SiteActions, nil)
+				} else {
+					m.SetState(NginxManagement, nil)
+				}
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.SecurityFields.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.SecurityFields.ListIndex++
+				}
+			case "enter":
+				if len(menu.Options) == 0 {
+					break
+				}
+				if menu.ListIndex < len(nginx.SecurityFields) {
+					m.TextInput.SetValue(nginx.SecurityFields[menu.ListIndex].Get(m.Security))
+					m.TextInput.Focus()
+					m.SecurityReturn = m.State
+					m.SetState(SecurityFieldEdit, nil)
+					break
+				}
+				if m.State == SecurityEditor {
+					m.NewConfig.Security = m.Security
+					if err := nginx.ValidateSecurity(CertBasePath, m.NewConfig.Site); err != nil {
+						logMsg := common.CreateSingleLog(err.Error(), common.Red)
+						m.SetState(SecurityEditor, &logMsg)
+						break
+					}
+					m.ClientAuth = m.NewConfig.ClientAuth
+					current := m.ClientAuth.CA
+					if current == "" && common.OriginCA(CertBasePath+m.NewConfig.CertName+".crt") {
+						// Offer Authenticated Origin Pulls first for Origin CA certificates.
+						current = model.ClientCACloudflare
+					}
+					m.refreshClientCAs(current)
+					m.SetState(ClientCASelect, nil)
+					break
+				}
+				site, _ := nginx.LoadSite(m.Sites.Options[m.Sites.ListIndex])
+				site.Security = m.Security
+				if err := nginx.ValidateSecurity(CertBasePath, site); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(SiteSecurity, &logMsg)
+					break
+				}
+				m.SetState(SiteActions, nil)
+				return m, rewriteSites("Updating the security headers of "+site.Name+"...", func() ([]string, error) {
+					return nginx.RewriteSites(configsBasePath, CertBasePath, []model.Site{site})
+				})
+			}
+		case ProtectionEditor:
+			menu := m.ProtectionFields
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.ProtectionFields.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.ProtectionFields.ListIndex++
+				}
+			case "enter":
+				if menu.ListIndex < len(nginx.ProtectionFields) {
+					m.TextInput.SetValue(nginx.ProtectionFields[menu.ListIndex].Get(m.Protection))
+					m.TextInput.Focus()
+					m.SetState(ProtectionFieldEdit, nil)
+					break
+				}
+				m.NewConfig.Protection = m.Protection
+				if err := nginx.ValidateProtection(m.NewConfig.Site); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(ProtectionEditor, &logMsg)
+					break
+				}
+				m.Access = m.NewConfig.Access
+				m.refreshAccessFields()
+				m.AccessFields.ListIndex = len(m.AccessFields.Options) - 1
+				m.SetState(AccessEditor, nil)
+			}
+		case ProtectionFieldEdit:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(ProtectionEditor, nil)
+			case "enter":
+				field := nginx.ProtectionFields[m.ProtectionFields.ListIndex]
+				if err := field.Set(&m.Protection, strings.TrimSpace(m.TextInput.Value())); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(ProtectionFieldEdit, &logMsg)
+					break
+				}
+				m.refreshProtectionFields()
+				m.SetState(ProtectionEditor, nil)
+			}
+		case AccessEditor:
+			menu := m.AccessFields
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(ProtectionEditor, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.AccessFields.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.AccessFields.ListIndex++
+				}
+			case "enter":
+				if menu.ListIndex < len(nginx.AccessFields) {
+					m.TextInput.SetValue(nginx.AccessFields[menu.ListIndex].Get(m.Access))
+					m.TextInput.Focus()
+					m.SetState(AccessFieldEdit, nil)
+					break
+				}
+				m.NewConfig.Access = m.Access
+				if err := nginx.ValidateAccess(m.NewConfig.Site); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(AccessEditor, &logMsg)
+					break
+				}
+				m.SetState(CType, nil)
+			}
+		case AccessFieldEdit:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(AccessEditor, nil)
+			case "enter":
+				field := nginx.AccessFields[m.AccessFields.ListIndex]
+				if err := field.Set(&m.Access, strings.TrimSpace(m.TextInput.Value())); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(AccessFieldEdit, &logMsg)
+					break
+				}
+				m.refreshAccessFields()
+				m.SetState(AccessEditor, nil)
+			}
+		case CertImport:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
+			case "enter":
+				fields := strings.Fields(m.TextInput.Value())
+				if len(fields) != 3 {
+					logMsg := common.CreateSingleLog("Please enter the name, the certificate file and the key file, e.g. example /root/origin.pem /root/origin.key", common.Red)
+					m.SetState(CertImport, &logMsg)
+					break
+				}
+				m.Logs = nil
+				return m, importCert(fields[0], fields[1], fields[2])
+			}
+		case HtpasswdUser:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
+			case "enter":
+				fields := strings.Fields(m.TextInput.Value())
+				if len(fields) != 2 {
+					logMsg := common.CreateSingleLog("Please enter the htpasswd file and the user name, e.g. admins alice", common.Red)
+					m.SetState(HtpasswdUser, &logMsg)
+					break
+				}
+				if err := pki.ValidateHtpasswdName(fields[0]); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(HtpasswdUser, &logMsg)
+					break
+				}
+				m.Logs = nil
+				return m, setHtpasswdUser(fields[0], fields[1])
+			}
+		case SecurityFieldEdit:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(m.SecurityReturn, nil)
+			case "enter":
+				field := nginx.SecurityFields[m.SecurityFields.ListIndex]
+				if err := field.Set(&m.Security, strings.TrimSpace(m.TextInput.Value())); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(SecurityFieldEdit, &logMsg)
+					break
+				}
+				m.refreshSecurityFields()
+				m.SetState(m.SecurityReturn, nil)
+			}
+		case ClientCASelect, SiteClientCA:
+			menu := m.ClientCAs
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				if m.State == SiteClientCA {
+					m.SetState(SiteActions, nil)
+				} else {
+					m.SetState(NginxManagement, nil)
+				}
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.ClientCAs.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.ClientCAs.ListIndex++
+				}
+			case "enter":
+				if menu.ListIndex == 0 {
+					// No client certificates.
+					if m.State == ClientCASelect {
+						m.NewConfig.ClientAuth = model.ClientAuth{}
+						m.TextInput.SetValue("")
+						m.TextInput.Focus()
+						m.SetState(HttpPort, nil)
+						break
+					}
+					site, _ := nginx.LoadSite(m.Sites.Options[m.Sites.ListIndex])
+					site.ClientAuth = model.ClientAuth{}
+					m.SetState(SiteActions, nil)
+					return m, rewriteSites("Turning off client certificates on "+site.Name+"...", func() ([]string, error) {
+						return nginx.RewriteSites(configsBasePath, CertBasePath, []model.Site{site})
+					})
+				}
+				ca := nginx.ClientCAs(CertBasePath)[menu.ListIndex-1]
+				if m.ClientAuth.CA == "" {
+					m.ClientAuth = nginx.DefaultClientAuth
+					// Cloudflare's certificate says nothing about the visitor.
+					m.ClientAuth.ForwardHeaders = ca != model.ClientCACloudflare
+				}
+				m.ClientAuth.CA = ca
+				m.ClientAuthFrom = m.State
+				m.refreshClientAuthFields()
+				m.ClientAuthFields.ListIndex = len(m.ClientAuthFields.Options) - 1
+				m.SetState(ClientAuthEditor, nil)
+			}
+		case ClientAuthEditor:
+			menu := m.ClientAuthFields
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(m.ClientAuthFrom, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.ClientAuthFields.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.ClientAuthFields.ListIndex++
+				}
+			case "enter":
+				if menu.ListIndex < len(nginx.ClientAuthFields) {
+					m.TextInput.SetValue(nginx.ClientAuthFields[menu.ListIndex].Get(m.ClientAuth))
+					m.TextInput.Focus()
+					m.SetState(ClientAuthFieldEdit, nil)
+					break
+				}
+				if m.ClientAuthFrom == ClientCASelect {
+					m.NewConfig.ClientAuth = m.ClientAuth
+					if err := nginx.ValidateClientAuth(CertBasePath, m.NewConfig.Site); err != nil {
+						logMsg := common.CreateSingleLog(err.Error(), common.Red)
+						m.SetState(ClientAuthEditor, &logMsg)
+						break
+					}
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(HttpPort, nil)
+					break
+				}
+				site, _ := nginx.LoadSite(m.Sites.Options[m.Sites.ListIndex])
+				site.ClientAuth = m.ClientAuth
+				if err := nginx.ValidateClientAuth(CertBasePath, site); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(ClientAuthEditor, &logMsg)
+					break
+				}
+				m.SetState(SiteActions, nil)
+				return m, rewriteSites("Updating the client certificates of "+site.Name+"...", func() ([]string, error) {
+					return nginx.RewriteSites(configsBasePath, CertBasePath, []model.Site{site})
+				})
+			}
+		case ClientAuthFieldEdit:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(ClientAuthEditor, nil)
+			case "enter":
+				field := nginx.ClientAuthFields[m.ClientAuthFields.ListIndex]
+				if err := field.Set(&m.ClientAuth, strings.TrimSpace(m.TextInput.Value())); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(ClientAuthFieldEdit, &logMsg)
+					break
+				}
+				m.refreshClientAuthFields()
+				m.SetState(ClientAuthEditor, nil)
+			}
+		case ClientCertIssue:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
+			case "enter":
+				fields := strings.Fields(m.TextInput.Value())
+				days := 365
+				if len(fields) == 2 {
+					days, _ = strconv.Atoi(fields[1])
+				}
+				if len(fields) == 0 || len(fields) > 2 || days < 1 {
+					logMsg := common.CreateSingleLog("Please enter a client name, optionally followed by the days it is valid, e.g. ci-runner 90", common.Red)
+					m.SetState(ClientCertIssue, &logMsg)
+					break
+				}
+				if err := pki.ValidateClientName(fields[0]); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(ClientCertIssue, &logMsg)
+					break
+				}
+				m.Logs = nil
+				return m, issueClientCert(fields[0], days)
+			}
+		case GRPCMessageSize:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
+			case "enter":
+				m.NewConfig.GRPC.MaxMessageSize = strings.TrimSpace(m.TextInput.Value())
+				if err := nginx.ValidateGRPC(model.Site{Setup: nginx.SetupGRPC, CType: "SSL", GRPC: m.NewConfig.GRPC}); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(GRPCMessageSize, &logMsg)
+					break
+				}
+				m.GRPCBackends.ListIndex = 0
+				m.SetState(GRPCBackend, nil)
+			}
+		case GRPCBackend:
+			menu := m.GRPCBackends
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.GRPCBackends.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.GRPCBackends.ListIndex++
+				}
+			case "enter":
+				m.NewConfig.GRPC.BackendTLS = menu.ListIndex == 1
+				m.CTypes.ListIndex = 0
+				m.startProtection()
+			}
+		case GRPCH2C:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(CType, nil)
+			case "enter":
+				value := strings.ToLower(strings.TrimSpace(m.TextInput.Value()))
+				if value != "yes" && value != "y" {
+					m.SetState(CType, nil)
+					break
+				}
+				m.NewConfig.GRPC.H2C = true
+				m.TextInput.SetValue("")
+				m.TextInput.Focus()
+				m.SetState(ServerIp, nil)
+			}
+		case CType:
+			menu := m.CTypes
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.CTypes.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.CTypes.ListIndex++
+				}
+			case "enter":
+				m.NewConfig.CType = menu.Options[menu.ListIndex]
+				if m.NewConfig.CType != "SSL" && m.NewConfig.Setup == nginx.SetupGRPC {
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(GRPCH2C, nil)
+					break
+				}
+				if m.NewConfig.CType == "SSL" {
+					certs, logMsg := common.Certificates(CertBasePath)
+					m.Certs = CertListModel{Options: certs}
+					m.SetState(SelectCert, &logMsg)
+				} else {
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(ServerIp, nil)
+				}
+			}
+		case SelectCert:
+			menu := m.Certs
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.Certs.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.Certs.ListIndex++
+				}
+			case "enter":
+				m.NewConfig.CertName = common.GetKeyByIndex(m.Certs.Options, m.Certs.ListIndex)
+				m.NewConfig.ExtraCerts = nil
+				domains, _ := common.ExtractDomains(CertBasePath + m.NewConfig.CertName + ".crt")
+				m.DomainSANs = domains
+				m.DomainNames = nil
+				m.DomainChosen = make(map[string]bool)
+				for _, domain := range domains {
+					m.DomainNames = append(m.DomainNames, domain)
+					m.DomainChosen[domain] = true
+				}
+				m.refreshDomains()
+				m.Domains.ListIndex = 0
+				if common.OriginCA(CertBasePath + m.NewConfig.CertName + ".crt") {
+					logMsg := common.LogData{Messages: common.CreateLogItems(nginx.OriginCAWarning(m.NewConfig.CertName), common.Gold)}
+					m.SetState(Domains, &logMsg)
+					break
+				}
+				m.SetState(Domains, nil)
+			}
+		case Domains:
+			menu := m.Domains
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.Domains.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.Domains.ListIndex++
+				}
+			case "enter":
+				switch {
+				case menu.ListIndex < len(m.DomainNames):
+					name := m.DomainNames[menu.ListIndex]
+					m.DomainChosen[name] = !m.DomainChosen[name]
+					m.refreshDomains()
+				case menu.Options[menu.ListIndex] == "+ Add names":
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(DomainAdd, nil)
+				default:
+					var names []string
+					for _, name := range m.DomainNames {
+						if m.DomainChosen[name] {
+							names = append(names, name)
+						}
+					}
+					m.NewConfig.Domains = names
+					m.NewConfig.Domain = strings.Join(names, " ")
+					m.NewConfig.Canonical = ""
+					if err := nginx.ValidateDomains(m.NewConfig.Site); err != nil {
+						logMsg := common.CreateSingleLog(err.Error(), common.Red)
+						m.SetState(Domains, &logMsg)
+						break
+					}
+					var logMsg *common.LogData
+					if uncovered := nginx.Uncovered(m.DomainSANs, names); len(uncovered) > 0 {
+						warning := common.CreateSingleLog("Warning: "+m.NewConfig.CertName+" does not cover "+strings.Join(uncovered, ", ")+", browsers will reject these names.", common.Gold)
+						logMsg = &warning
+					}
+					if apexes := nginx.CanonicalPairs(names); len(apexes) > 0 {
+						options := []string{"No canonical redirect"}
+						for _, apex := range apexes {
+							options = append(options, "www."+apex+" -> "+apex, apex+" -> www."+apex)
+						}
+						m.Canonicals = ListModel{Options: options}
+						m.SetState(CanonicalRedirect, logMsg)
+						break
+					}
+					m.startCertEditor(logMsg)
+				}
+			}
+		case DomainAdd:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(Domains, nil)
+			case "enter":
+				names, err := nginx.ParseServerNames(m.TextInput.Value())
+				if err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(DomainAdd, &logMsg)
+					break
+				}
+				for _, name := range names {
+					if _, known := m.DomainChosen[name]; !known {
+						m.DomainNames = append(m.DomainNames, name)
+					}
+					m.DomainChosen[name] = true
+				}
+				m.refreshDomains()
+				m.SetState(Domains, nil)
+			}
+		case CanonicalRedirect:
+			menu := m.Canonicals
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(Domains, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.Canonicals.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.Canonicals.ListIndex++
+				}
+			case "enter":
+				m.NewConfig.Canonical = ""
+				if menu.ListIndex > 0 {
+					_, canonical, _ := strings.Cut(menu.Options[menu.ListIndex], " -> ")
+					m.NewConfig.Canonical = canonical
+				}
+				m.startCertEditor(nil)
+			}
+		case ServerIp:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
+			case "enter":
+				value := m.TextInput.Value()
+				if value != "" {
+					m.NewConfig.ServerIp = value
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(HttpPort, nil)
+				}
+			}
+		case HttpPort:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
+			case "enter":
+				value := m.TextInput.Value()
+				if value != "" {
 					m.NewConfig.HttpPort = value
 					m.TextInput.SetValue("")
 					m.TextInput.Focus()
 					m.SetState(HttpsPort, nil)
 				}
 			}
-		case HttpsPort:
+		case HttpsPort:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(NginxManagement, nil)
+			case "enter":
+				value := m.TextInput.Value()
+				if value != "" {
+					m.NewConfig.HttpsPort = value
+					if err := nginx.ValidateGRPC(m.NewConfig.Site); err != nil {
+						logMsg := common.CreateSingleLog(err.Error(), common.Red)
+						m.SetState(HttpsPort, &logMsg)
+						break
+					}
+					if m.NewConfig.CType == "SSL" {
+						m.refreshRedirects()
+						m.Redirects.ListIndex = len(m.Redirects.Options) - 1
+						m.SetState(RedirectOptions, nil)
+						break
+					}
+					m.Logs = nil
+					return m, nginx.Configure(configsBasePath, CertBasePath, m.NewConfig.Site)
+				}
+			}
+		case CertEditor:
+			menu := m.CertEntries
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.CertEntries.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.CertEntries.ListIndex++
+				}
+			case "enter":
+				extras := len(m.NewConfig.ExtraCerts)
+				switch {
+				case menu.ListIndex < extras:
+					m.NewConfig.ExtraCerts = append(m.NewConfig.ExtraCerts[:menu.ListIndex], m.NewConfig.ExtraCerts[menu.ListIndex+1:]...)
+					m.refreshCertEntries()
+				case menu.ListIndex == extras:
+					m.ExtraCertFor = nil
+					m.selectExtraCert(nginx.SiteDomains(m.NewConfig.Site))
+				case menu.ListIndex == extras+1:
+					m.TextInput.SetValue("")
+					m.TextInput.Focus()
+					m.SetState(ExtraCertNames, nil)
+				default:
+					m.refreshTLSProfiles(model.TLSIntermediate)
+					m.SetState(TLSProfileSelect, nil)
+				}
+			}
+		case ExtraCertNames:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(CertEditor, nil)
+			case "enter":
+				names, err := nginx.ParseServerNames(m.TextInput.Value())
+				if err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(ExtraCertNames, &logMsg)
+					break
+				}
+				m.ExtraCertFor = names
+				m.selectExtraCert(names)
+			}
+		case SelectExtraCert:
+			menu := m.ExtraCerts
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(CertEditor, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.ExtraCerts.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.ExtraCerts.ListIndex++
+				}
+			case "enter":
+				if len(menu.Options) == 0 {
+					break
+				}
+				cert := model.SiteCert{Name: common.GetKeyByIndex(menu.Options, menu.ListIndex), ServerNames: m.ExtraCertFor}
+				m.NewConfig.ExtraCerts = append(m.NewConfig.ExtraCerts, cert)
+				if err := nginx.ValidateCerts(CertBasePath, m.NewConfig.Site); err != nil {
+					m.NewConfig.ExtraCerts = m.NewConfig.ExtraCerts[:len(m.NewConfig.ExtraCerts)-1]
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(SelectExtraCert, &logMsg)
+					break
+				}
+				m.refreshCertEntries()
+				m.SetState(CertEditor, nil)
+			}
+		case RedirectOptions:
+			menu := m.Redirects
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.Redirects.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.Redirects.ListIndex++
+				}
+			case "enter":
+				redirect := &m.NewConfig.Redirect
+				switch menu.ListIndex {
+				case 0:
+					redirect.Code = nginx.NextRedirectCode(nginx.RedirectCode(*redirect))
+				case 1:
+					redirect.SkipHTTP = !redirect.SkipHTTP
+					redirect.ACME = redirect.ACME && !redirect.SkipHTTP
+				case 2:
+					redirect.ACME = !redirect.ACME
+					redirect.SkipHTTP = redirect.SkipHTTP && !redirect.ACME
+				default:
+					if err := nginx.ValidateRedirect(m.NewConfig.Site); err != nil {
+						logMsg := common.CreateSingleLog(err.Error(), common.Red)
+						m.SetState(RedirectOptions, &logMsg)
+						break
+					}
+					m.Logs = nil
+					return m, nginx.Configure(configsBasePath, CertBasePath, m.NewConfig.Site)
+				}
+				m.refreshRedirects()
+			}
+		case DpkgLock:
+			menu := m.LockOptions
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.LockOptions.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.LockOptions.ListIndex++
+				}
+			case "enter":
+				switch menu.Options[menu.ListIndex] {
+				case "Keep waiting":
+					m.LockWaitStart = time.Now()
+					if !m.LockPolling {
+						return m, m.pollLock()
+					}
+				case "Stop the process holding the lock":
+					if len(m.LockHolders) > 0 && !m.LockStopping {
+						m.TextInput.SetValue("")
+						m.TextInput.Focus()
+						m.State = DpkgLockStop
+					}
+				case "Cancel":
+					m.PendingCmd = nil
+					m.SetState(m.LockReturn, nil)
+					return m, common.LogMessage("Canceled while waiting for the dpkg lock, nothing was changed.", common.Blue)
+				}
+			}
+		case DpkgLockStop:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.State = DpkgLock
+			case "enter":
+				value := strings.ToLower(strings.TrimSpace(m.TextInput.Value()))
+				m.State = DpkgLock
+				if (value == "yes" || value == "y") && len(m.LockHolders) > 0 {
+					holder := m.LockHolders[0]
+					m.LockStopping = true
+					stop := func() tea.Msg {
+						out, err := dpkg.Stop(holder)
+						logs := common.CreateLogItems(out, common.White)
+						if err != nil {
+							logs = append(logs, common.LogItem{Msg: "❌ " + err.Error(), Color: common.Red})
+						}
+						return lockStopped{Messages: logs}
+					}
+					if !m.LockPolling {
+						return m, tea.Batch(stop, m.pollLock())
+					}
+					return m, stop
+				}
+			}
+		case ManageConfigs:
+			menu := m.Sites
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(NginxManagement, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.Sites.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.Sites.ListIndex++
+				}
+			case "enter":
+				if len(menu.Options) == 0 {
+					break
+				}
+				m.SiteMenu.ListIndex = 0
+				m.SetState(SiteActions, nil)
+			}
+		case SiteActions:
+			menu := m.SiteMenu
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(ManageConfigs, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.SiteMenu.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.SiteMenu.ListIndex++
+				}
+			case "enter":
+				switch menu.Options[menu.ListIndex] {
+				case "Upstream servers":
+					m.SiteServers.ListIndex = 0
+					logMsg := m.refreshSiteServers()
+					m.SetState(SiteUpstreams, logMsg)
+				case "TLS profile":
+					site, ok := nginx.LoadSite(m.Sites.Options[m.Sites.ListIndex])
+					if !ok || site.CType != "SSL" {
+						logMsg := common.CreateSingleLog("TLS profiles can only be set on SSL sites generated by nginx_configure.", common.Red)
+						m.SetState(SiteActions, &logMsg)
+						break
+					}
+					m.refreshTLSProfiles(site.TLSProfile)
+					m.SetState(SiteTLSProfile, nil)
+				case "Security headers":
+					name := m.Sites.Options[m.Sites.ListIndex]
+					headers, err := nginx.SecuritySummary(nginx.ConfigPath(configsBasePath, name))
+					if err != nil {
+						logMsg := common.CreateSingleLog(err.Error(), common.Red)
+						m.SetState(SiteActions, &logMsg)
+						break
+					}
+					m.SecurityHeaders = headers
+					m.SecurityFields = ListModel{}
+					if site, ok := nginx.LoadSite(name); ok && site.CType == "SSL" {
+						m.Security = site.Security
+						m.refreshSecurityFields()
+						m.SecurityFields.ListIndex = len(m.SecurityFields.Options) - 1
+					}
+					m.SetState(SiteSecurity, nil)
+				case "Client certificates (mTLS)":
+					site, ok := nginx.LoadSite(m.Sites.Options[m.Sites.ListIndex])
+					if !ok || site.CType != "SSL" {
+						logMsg := common.CreateSingleLog("Client certificates can only be set on SSL sites generated by nginx_configure.", common.Red)
+						m.SetState(SiteActions, &logMsg)
+						break
+					}
+					m.ClientAuth = site.ClientAuth
+					m.refreshClientCAs(site.ClientAuth.CA)
+					m.SetState(SiteClientCA, nil)
+				case "Upstream health":
+					site, _ := nginx.LoadSite(m.Sites.Options[m.Sites.ListIndex])
+					m.HealthCheck = site.Health
+					m.HealthResults = nil
+					m.HealthWatch = false
+					m.refreshHealthOptions()
+					m.HealthOptions.ListIndex = 0
+					m.SetState(UpstreamHealth, nil)
+					return m, m.probeHealth()
+				}
+			}
+		case SiteUpstreams:
+			menu := m.SiteServers
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(SiteActions, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.SiteServers.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.SiteServers.ListIndex++
+				}
+			case "enter":
+				if len(menu.Options) == 0 {
+					break
+				}
+				if _, _, ok := m.selectedSiteServer(); ok {
+					m.ServerActions.ListIndex = 0
+					m.SetState(UpstreamServerAction, nil)
+					break
+				}
+				m.TextInput.SetValue("")
+				m.TextInput.Focus()
+				m.SetState(UpstreamServerAdd, nil)
+			}
+		case UpstreamServerAction:
+			menu := m.ServerActions
+			switch key {
+			case "q":
+				return m, tea.Quit
+			case "b":
+				m.SetState(SiteUpstreams, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.ServerActions.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.ServerActions.ListIndex++
+				}
+			case "enter":
+				b, s, _ := m.selectedSiteServer()
+				change := map[string]string{
+					"Mark down (drain)": nginx.UpstreamDrain,
+					"Mark up":           nginx.UpstreamEnable,
+					"Make backup":       nginx.UpstreamBackup,
+					"Make primary":      nginx.UpstreamPrimary,
+					"Remove":            nginx.UpstreamRemove,
+				}[menu.Options[menu.ListIndex]]
+				block := m.SiteBlocks[b]
+				return m, m.changeSiteServer(block.Name, change, block.Servers[s].Address)
+			}
+		case UpstreamServerAdd:
 			switch key {
 			case "ctrl+c":
 				return m, tea.Quit
 			case "ctrl+b":
-				m.SetState(NginxManagement, nil)
+				m.SetState(SiteUpstreams, nil)
 			case "enter":
-				value := m.TextInput.Value()
-				if value != "" {
-					m.NewConfig.HttpsPort = value
-					m.Logs = nil
-					return m, nginx.Configure(
-						configsBasePath,
-						CertBasePath,
-						m.NewConfig.Name,
-						m.NewConfig.Setup,
-						m.NewConfig.Upstreams,
-						m.NewConfig.CType,
-						m.NewConfig.CertName,
-						m.NewConfig.Domain,
-						m.NewConfig.ServerIp,
-						m.NewConfig.HttpPort,
-						m.NewConfig.HttpsPort,
-					)
+				value := strings.TrimSpace(m.TextInput.Value())
+				if _, err := nginx.ParseUpstreamServer(value); err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(UpstreamServerAdd, &logMsg)
+					break
 				}
+				block := m.SiteBlocks[m.SiteServers.ListIndex-m.siteServerCount()].Name
+				return m, m.changeSiteServer(block, nginx.UpstreamAdd, value)
 			}
-		case ManageConfigs:
+		case UpstreamHealth:
+			menu := m.HealthOptions
 			switch key {
 			case "q":
 				return m, tea.Quit
 			case "b":
-				m.SetState(NginxManagement, nil)
+				m.HealthWatch = false
+				m.SetState(SiteActions, nil)
+			case "up", "w":
+				if menu.ListIndex > 0 {
+					m.HealthOptions.ListIndex--
+				}
+			case "down", "s":
+				if menu.ListIndex < len(menu.Options)-1 {
+					m.HealthOptions.ListIndex++
+				}
 			case "enter":
-
+				switch menu.ListIndex {
+				case 0:
+					return m, m.probeHealth()
+				case 1:
+					m.HealthWatch = !m.HealthWatch
+					m.refreshHealthOptions()
+					if m.HealthWatch && !m.HealthTicking {
+						m.HealthTicking = true
+						return m, tickHealth()
+					}
+				case 2:
+					value := m.HealthCheck.Path
+					if m.HealthCheck.Status != 0 {
+						value += " " + strconv.Itoa(m.HealthCheck.Status)
+					}
+					m.HealthWatch = false
+					m.refreshHealthOptions()
+					m.TextInput.SetValue(value)
+					m.TextInput.Focus()
+					m.SetState(HealthCheckEdit, nil)
+				}
+			}
+		case HealthCheckEdit:
+			switch key {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "ctrl+b":
+				m.SetState(UpstreamHealth, nil)
+			case "enter":
+				check, err := health.ParseCheck(m.TextInput.Value())
+				if err != nil {
+					logMsg := common.CreateSingleLog(err.Error(), common.Red)
+					m.SetState(HealthCheckEdit, &logMsg)
+					break
+				}
+				m.HealthCheck = check
+				logMsg := common.CreateSingleLog("The HTTP check is used until you leave this view; this config was not generated by nginx_configure.", common.Blue)
+				if site, ok := nginx.LoadSite(m.Sites.Options[m.Sites.ListIndex]); ok {
+					site.Health = check
+					logMsg = common.CreateSingleLog("HTTP check saved.", common.Green)
+					if err := nginx.SaveSite(site); err != nil {
+						logMsg = common.CreateSingleLog("Saving the HTTP check failed: "+err.Error(), common.Red)
+					}
+				}
+				m.SetState(UpstreamHealth, &logMsg)
+				return m, m.probeHealth()
 			}
 		}
+	case healthReport:
+		if m.State != UpstreamHealth {
+			return m, nil
+		}
+		m.HealthResults = msg.Results
+		if msg.Err != nil {
+			m.HealthResults = []health.Result{}
+			m.Logs = []common.LogData{common.CreateSingleLog(msg.Err.Error(), common.Red)}
+		}
+		if m.HealthWatch && !m.HealthTicking {
+			m.HealthTicking = true
+			return m, tickHealth()
+		}
+		return m, nil
+	case healthTick:
+		m.HealthTicking = false
+		if m.State == UpstreamHealth && m.HealthWatch {
+			return m, m.probeHealth()
+		}
+		return m, nil
+	case upstreamsChanged:
+		logMsg := m.refreshSiteServers()
+		m.SetState(SiteUpstreams, nil)
+		m.Logs = append(m.Logs, common.LogData(msg))
+		if logMsg != nil {
+			m.Logs = append(m.Logs, *logMsg)
+		}
+		return m, nil
+	case doctorReport:
+		m.Findings = msg
+		return m, nil
+	case lockStopped:
+		m.LockStopping = false
+		m.LockWaitStart = time.Now()
+		m.Logs = append(m.Logs, common.LogData(msg))
+		return m, nil
+	case lockTick:
+		if m.State != DpkgLock && m.State != DpkgLockStop {
+			m.LockPolling = false
+			return m, nil
+		}
+		m.LockHolders = dpkg.Holders()
+		if m.LockStopping {
+			// dpkg --configure -a takes the lock again after the holder is gone.
+			return m, tickLock()
+		}
+		if len(m.LockHolders) == 0 {
+			m.LockPolling = false
+			cmd := m.PendingCmd
+			m.PendingCmd = nil
+			m.State = m.LockReturn
+			return m, tea.Sequence(common.LogMessage("The dpkg lock was released, continuing.", common.Green), cmd)
+		}
+		if time.Since(m.LockWaitStart) > dpkg.WaitTimeout {
+			// Stop polling; "Keep waiting" starts a new round.
+			m.LockPolling = false
+			return m, nil
+		}
+		return m, tickLock()
 	case common.LogData:
 		m.Logs = append(m.Logs, msg)
 		return m, nil // Append new log message
@@ -547,8 +2398,495 @@ func (m *CLIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, tea.Batch(cmdS...)
 }
 
+// refreshServers rebuilds the upstream editor list from the servers of the new config.
+func (m *CLIModel) refreshServers() {
+	var options []string
+	for _, server := range m.NewConfig.Upstreams {
+		options = append(options, nginx.FormatUpstreamServer(server))
+	}
+	m.Servers.Options = append(options, "+ Add server", "Done")
+	if m.Servers.ListIndex >= len(m.Servers.Options) {
+		m.Servers.ListIndex = len(m.Servers.Options) - 1
+	}
+}
+
+// refreshSiteServers reads the upstream blocks of the selected site again and
+// lists every server followed by one "+ Add server" entry per block.
+func (m *CLIModel) refreshSiteServers() *common.LogData {
+	site := m.Sites.Options[m.Sites.ListIndex]
+	blocks, err := nginx.ReadUpstreams(nginx.ConfigPath(configsBasePath, site))
+	m.SiteBlocks = blocks
+	var options []string
+	for _, block := range blocks {
+		for _, server := range block.Servers {
+			options = append(options, block.Name+": "+nginx.FormatUpstreamServer(server))
+		}
+	}
+	for _, block := range blocks {
+		options = append(options, "+ Add server to "+block.Name)
+	}
+	m.SiteServers.Options = options
+	if m.SiteServers.ListIndex >= len(options) {
+		m.SiteServers.ListIndex = max(len(options)-1, 0)
+	}
+
+	if err != nil {
+		logMsg := common.CreateSingleLog("Reading "+site+".conf failed: "+err.Error(), common.Red)
+		return &logMsg
+	}
+	if len(blocks) == 0 {
+		logMsg := common.CreateSingleLog(site+".conf has no upstream block.", common.Blue)
+		return &logMsg
+	}
+	return nil
+}
+
+// siteServerCount is the number of servers over all upstream blocks of the selected site.
+func (m *CLIModel) siteServerCount() int {
+	count := 0
+	for _, block := range m.SiteBlocks {
+		count += len(block.Servers)
+	}
+	return count
+}
+
+// selectedSiteServer returns the block and server index of the selected entry
+// of the site upstream view, false when an "+ Add server" entry is selected.
+func (m *CLIModel) selectedSiteServer() (int, int, bool) {
+	index := m.SiteServers.ListIndex
+	for b, block := range m.SiteBlocks {
+		if index < len(block.Servers) {
+			return b, index, true
+		}
+		index -= len(block.Servers)
+	}
+	return 0, 0, false
+}
+
+// refreshHealthOptions rebuilds the health view menu.
+func (m *CLIModel) refreshHealthOptions() {
+	watch := "Watch (refresh every " + healthWatchInterval.String() + ")"
+	if m.HealthWatch {
+		watch = "Stop watching"
+	}
+	m.HealthOptions.Options = []string{"Refresh", watch, "Set HTTP check"}
+}
+
+// probeHealth probes the upstream servers of the selected site in the background.
+func (m *CLIModel) probeHealth() tea.Cmd {
+	site := m.Sites.Options[m.Sites.ListIndex]
+	check := m.HealthCheck
+	return func() tea.Msg {
+		results, err := health.Checker{}.CheckSite(configsBasePath, site, &check)
+		return healthReport{Results: results, Err: err}
+	}
+}
+
+func tickHealth() tea.Cmd {
+	return tea.Tick(healthWatchInterval, func(t time.Time) tea.Msg {
+		return healthTick(t)
+	})
+}
+
+// changeSiteServer applies a change to an upstream server of the selected site
+// and reloads nginx.
+func (m *CLIModel) changeSiteServer(block string, change string, spec string) tea.Cmd {
+	site := m.Sites.Options[m.Sites.ListIndex]
+	m.Logs = nil
+	return tea.Sequence(
+		common.LogMessage("Updating "+site+".conf and reloading nginx...", common.Gold),
+		func() tea.Msg {
+			out, err := nginx.ChangeUpstreamServer(configsBasePath, site, block, change, spec)
+			logs := common.CreateLogItems(out, common.White)
+			if err != nil {
+				logs = append(logs, common.LogItem{Msg: "❌ " + err.Error(), Color: common.Red})
+			} else {
+				logs = append(logs, common.LogItem{Msg: "Upstream updated.", Color: common.Green})
+			}
+			return upstreamsChanged{Messages: logs}
+		},
+	)
+}
+
+// pickDocumentRoot opens the file picker to choose the document root of a static or PHP site.
+func (m *CLIModel) pickDocumentRoot() tea.Cmd {
+	m.FilePicker.CurrentDirectory = "/"
+	if common.FileExists("/var/www") {
+		m.FilePicker.CurrentDirectory = "/var/www"
+	}
+	m.TextInput.Blur()
+	m.SetState(DocumentRoot, nil)
+	return m.FilePicker.Init()
+}
+
+// chooseDocumentRoot stores the picked document root. Static sites continue
+// with the index files, PHP sites with the certificate type.
+func (m *CLIModel) chooseDocumentRoot(path string) {
+	if err := nginx.ValidateDocumentRoot(path); err != nil {
+		logMsg := common.CreateSingleLog(err.Error(), common.Red)
+		m.SetState(DocumentRoot, &logMsg)
+		return
+	}
+	if m.NewConfig.Setup == nginx.SetupPHP {
+		m.NewConfig.App.Root = path
+		m.startProtection()
+		return
+	}
+	m.NewConfig.Static.Root = path
+	m.TextInput.SetValue(m.NewConfig.Static.Index)
+	m.TextInput.Focus()
+	m.SetState(StaticIndex, nil)
+}
+
+// refreshToggles rebuilds the static site options list from the new config.
+func (m *CLIModel) refreshToggles() {
+	var options []string
+	for _, toggle := range nginx.StaticToggles {
+		value := "off"
+		if *toggle.Field(&m.NewConfig.Static) {
+			value = "on"
+		}
+		options = append(options, toggle.Label+": "+value)
+	}
+	m.Toggles.Options = append(options, "Done")
+}
+
+// refreshTLSProfiles builds the TLS profile list and selects current.
+func (m *CLIModel) refreshTLSProfiles(current string) {
+	var options []string
+	m.TLSProfiles.ListIndex = 1
+	for i, profile := range nginx.TLSProfiles {
+		option := profile.Name + " - " + profile.Description
+		if profile.Name == current {
+			m.TLSProfiles.ListIndex = i
+		}
+		options = append(options, option)
+	}
+	m.TLSProfiles.Options = options
+}
+
+// startProtection opens the rate limiting step with the values of the new config.
+func (m *CLIModel) startProtection() {
+	m.Protection = m.NewConfig.Protection
+	m.refreshProtectionFields()
+	m.ProtectionFields.ListIndex = len(m.ProtectionFields.Options) - 1
+	m.SetState(ProtectionEditor, nil)
+}
+
+// refreshProtectionFields rebuilds the rate limiting list from the values being edited.
+func (m *CLIModel) refreshProtectionFields() {
+	var options []string
+	for _, field := range nginx.ProtectionFields {
+		options = append(options, field.Label+": "+field.Get(m.Protection))
+	}
+	m.ProtectionFields.Options = append(options, "Done")
+}
+
+// refreshAccessFields rebuilds the access control list from the values being edited.
+func (m *CLIModel) refreshAccessFields() {
+	var options []string
+	for _, field := range nginx.AccessFields {
+		options = append(options, field.Label+": "+field.Get(m.Access))
+	}
+	m.AccessFields.Options = append(options, "Done")
+}
+
+// refreshSecurityFields rebuilds the security header list from the values being edited.
+func (m *CLIModel) refreshSecurityFields() {
+	var options []string
+	for _, field := range nginx.SecurityFields {
+		options = append(options, field.Label+": "+field.Get(m.Security))
+	}
+	m.SecurityFields.Options = append(options, "Done")
+}
+
+// refreshClientCAs builds the client CA list and selects current.
+func (m *CLIModel) refreshClientCAs(current string) {
+	options := []string{"No client certificates"}
+	m.ClientCAs.ListIndex = 0
+	for i, ca := range nginx.ClientCAs(CertBasePath) {
+		option := ca + " (" + nginx.ClientCAPath(CertBasePath, ca) + ")"
+		switch ca {
+		case model.ClientCAPrivate:
+			option = "Private CA of nginx_configure (" + pki.CACertPath + ")"
+			if !pki.CAExists() {
+				option += ", created on first use"
+			}
+		case model.ClientCACloudflare:
+			option = "Cloudflare origin pulls: accept only requests proxied by Cloudflare (" + nginx.OriginPullCAPath + ")"
+			if !common.FileExists(nginx.OriginPullCAPath) {
+				option += ", downloaded on first use"
+			}
+		}
+		if ca == current {
+			m.ClientCAs.ListIndex = i + 1
+		}
+		options = append(options, option)
+	}
+	m.ClientCAs.Options = options
+}
+
+// refreshClientAuthFields rebuilds the client certificate list from the values being edited.
+func (m *CLIModel) refreshClientAuthFields() {
+	var options []string
+	for _, field := range nginx.ClientAuthFields {
+		options = append(options, field.Label+": "+field.Get(m.ClientAuth))
+	}
+	m.ClientAuthFields.Options = append(options, "Done")
+}
+
+// issueClientCert issues a client certificate from the private CA and logs where it was written.
+func issueClientCert(name string, days int) tea.Cmd {
+	return tea.Sequence(
+		common.LogMessage("Issuing a client certificate for "+name+"...", common.Gold),
+		func() tea.Msg {
+			client, err := pki.IssueClient(name, days, "")
+			if err != nil {
+				return common.CreateSingleLog("❌ "+err.Error(), common.Red)
+			}
+			return common.LogData{Messages: []common.LogItem{
+				{Msg: "PKCS#12 bundle: " + client.Path, Color: common.White},
+				{Msg: "Password: " + client.Password, Color: common.White},
+				{Msg: "Serial: " + client.Serial + ", valid until " + client.NotAfter.Format("2006-01-02"), Color: common.White},
+				{Msg: "Sites verify it when they use the private CA (" + pki.CACertPath + ").", Color: common.Green},
+			}}
+		},
+	)
+}
+
+// importCert copies a certificate and key into the cert base path and logs what was imported.
+func importCert(name string, certFile string, keyFile string) tea.Cmd {
+	return tea.Sequence(
+		common.LogMessage("Importing "+certFile+" as "+name+"...", common.Gold),
+		func() tea.Msg {
+			cert, err := nginx.ImportCert(CertBasePath, name, certFile, keyFile)
+			if err != nil {
+				return common.CreateSingleLog("❌ "+err.Error(), common.Red)
+			}
+			logs := []common.LogItem{
+				{Msg: "Imported " + CertBasePath + name + ".crt and " + name + ".key", Color: common.Green},
+				{Msg: cert.KeyType + " | Domains: " + strings.Join(cert.Domains, ", ") + " | valid until " + cert.NotAfter.Format("2006-01-02"), Color: common.White},
+			}
+			if cert.OriginCA {
+				logs = append(logs, common.CreateLogItems(nginx.OriginCAWarning(name), common.Gold)...)
+			}
+			return common.LogData{Messages: logs}
+		},
+	)
+}
+
+// setHtpasswdUser adds a basic auth user with a generated password, or gives an existing user a new one.
+func setHtpasswdUser(file string, user string) tea.Cmd {
+	return tea.Sequence(
+		common.LogMessage("Setting the password of "+user+" in "+pki.HtpasswdPath(file)+"...", common.Gold),
+		func() tea.Msg {
+			password, created, err := pki.SetUser(file, user, "")
+			if err != nil {
+				return common.CreateSingleLog("❌ "+err.Error(), common.Red)
+			}
+			msg := "Changed the password of " + user + "."
+			if created {
+				msg = "Added " + user + "."
+			}
+			return common.LogData{Messages: []common.LogItem{
+				{Msg: msg, Color: common.Green},
+				{Msg: "Password: " + password, Color: common.White},
+				{Msg: "Sites use it with the basic auth file " + file + ", no reload is needed.", Color: common.White},
+			}}
+		},
+	)
+}
+
+// refreshDomains rebuilds the domain list from the offered and chosen names.
+func (m *CLIModel) refreshDomains() {
+	var options []string
+	for _, name := range m.DomainNames {
+		option := "[ ] " + name
+		if m.DomainChosen[name] {
+			option = "[x] " + name
+		}
+		if len(nginx.Uncovered(m.DomainSANs, []string{name})) > 0 {
+			option += " (not covered by the certificate)"
+		}
+		options = append(options, option)
+	}
+	m.Domains.Options = append(options, "+ Add names", "Done")
+}
+
+// startCertEditor continues the SSL wizard with the extra certificates of the site.
+func (m *CLIModel) startCertEditor(logMsg *common.LogData) {
+	m.refreshCertEntries()
+	m.CertEntries.ListIndex = len(m.CertEntries.Options) - 1
+	m.SetState(CertEditor, logMsg)
+}
+
+// refreshCertEntries rebuilds the certificate list from the new config.
+func (m *CLIModel) refreshCertEntries() {
+	var options []string
+	for _, cert := range m.NewConfig.ExtraCerts {
+		names := "next to " + m.NewConfig.CertName + " for every name"
+		if len(cert.ServerNames) > 0 {
+			names = "for " + strings.Join(cert.ServerNames, " ")
+		}
+		options = append(options, cert.Name+" "+names+" (select to remove)")
+	}
+	m.CertEntries.Options = append(options, "+ Add a certificate for every name (e.g. ECDSA next to RSA)", "+ Add a certificate for some names", "Done")
+	if m.CertEntries.ListIndex >= len(m.CertEntries.Options) {
+		m.CertEntries.ListIndex = len(m.CertEntries.Options) - 1
+	}
+}
+
+// selectExtraCert offers the certificates covering names, except the ones the site already uses.
+func (m *CLIModel) selectExtraCert(names []string) {
+	certs, logMsg := nginx.CoveringCerts(CertBasePath, names)
+	delete(certs, m.NewConfig.CertName)
+	for _, cert := range m.NewConfig.ExtraCerts {
+		delete(certs, cert.Name)
+	}
+	if len(certs) == 0 && len(logMsg.Messages) == 0 {
+		logMsg = common.CreateSingleLog("No other certificate covers "+strings.Join(names, ", ")+".", common.Gold)
+	}
+	m.ExtraCerts = CertListModel{Options: certs}
+	m.SetState(SelectExtraCert, &logMsg)
+}
+
+// refreshRedirects rebuilds the redirect option list from the new config.
+func (m *CLIModel) refreshRedirects() {
+	redirect := m.NewConfig.Redirect
+	httpServer := "on (port " + m.NewConfig.HttpPort + ")"
+	if redirect.SkipHTTP {
+		httpServer = "off, HTTPS only"
+	}
+	acme := "off"
+	if redirect.ACME {
+		acme = "on, from " + nginx.ACMERoot
+	}
+	m.Redirects.Options = []string{
+		"Redirect status: " + nginx.RedirectCodeLabel(nginx.RedirectCode(redirect)),
+		"HTTP server: " + httpServer,
+		"Serve /.well-known/acme-challenge/ over HTTP: " + acme,
+		"Done",
+	}
+}
+
+// rewriteSites runs a change that renders stored sites again and logs its output.
+func rewriteSites(title string, rewrite func() ([]string, error)) tea.Cmd {
+	return tea.Sequence(
+		common.LogMessage(title, common.Gold),
+		func() tea.Msg {
+			out, err := rewrite()
+			logs := common.CreateLogItems(out, common.White)
+			if err != nil {
+				logs = append(logs, common.LogItem{Msg: "❌ " + err.Error(), Color: common.Red})
+			} else {
+				logs = append(logs, common.LogItem{Msg: "All is done.", Color: common.Green})
+			}
+			return common.LogData{Messages: logs}
+		},
+	)
+}
+
+// afterBalancing continues the wizard once the balancing method is known.
+// Stream proxies have no HTTP tuning and go on with their listener.
+func (m *CLIModel) afterBalancing() {
+	if m.NewConfig.Setup == nginx.SetupStream {
+		m.TextInput.SetValue("")
+		m.TextInput.Focus()
+		m.SetState(StreamListen, nil)
+		return
+	}
+	m.Presets.ListIndex = 0
+	m.SetState(ProxyTuning, nil)
+}
+
+// startLocations opens the location editor, starting from the single
+// `location /` of the site upstream.
+func (m *CLIModel) startLocations() {
+	if m.NewConfig.Setup == nginx.SetupGRPC {
+		// gRPC sites proxy everything to one service; ask for the gRPC options instead.
+		m.TextInput.SetValue(nginx.DefaultMaxMessageSize)
+		m.TextInput.Focus()
+		m.SetState(GRPCMessageSize, nil)
+		return
+	}
+	if len(m.NewConfig.Locations) == 0 {
+		m.NewConfig.Locations = nginx.SiteLocations(m.NewConfig.Site)
+	}
+	m.refreshLocations()
+	m.Locations.ListIndex = len(m.Locations.Options) - 1
+	m.SetState(LocationEditor, nil)
+}
+
+// refreshLocations rebuilds the location editor list from the locations and pools of the new config.
+func (m *CLIModel) refreshLocations() {
+	var options []string
+	for _, location := range m.NewConfig.Locations {
+		options = append(options, nginx.FormatLocation(location))
+	}
+	for _, pool := range m.NewConfig.Pools {
+		options = append(options, "pool "+nginx.FormatPool(pool))
+	}
+	m.Locations.Options = append(options, "+ Add location", "+ Add upstream pool", "Done")
+	if m.Locations.ListIndex >= len(m.Locations.Options) {
+		m.Locations.ListIndex = len(m.Locations.Options) - 1
+	}
+}
+
+// refreshTuningFields rebuilds the tuning editor list from the tuning of the new config.
+func (m *CLIModel) refreshTuningFields() {
+	var options []string
+	for _, field := range nginx.TuningFields {
+		value := field.Get(m.NewConfig.Tuning)
+		if value == "" {
+			value = "(default)"
+		}
+		options = append(options, field.Label+": "+value)
+	}
+	m.Fields.Options = append(options, "Done")
+}
+
+// withDpkgLock runs cmd right away when no dpkg or apt lock is held. Otherwise
+// it shows who holds the lock and runs cmd once the lock is released.
+func (m *CLIModel) withDpkgLock(cmd tea.Cmd) tea.Cmd {
+	holders := dpkg.Holders()
+	if len(holders) == 0 {
+		return cmd
+	}
+	m.LockHolders = holders
+	m.LockReturn = m.State
+	m.PendingCmd = cmd
+	m.LockWaitStart = time.Now()
+	m.LockOptions.ListIndex = 0
+	m.State = DpkgLock
+	return m.pollLock()
+}
+
+// pollLock starts re-checking the locks every second.
+func (m *CLIModel) pollLock() tea.Cmd {
+	m.LockPolling = true
+	return tickLock()
+}
+
+func tickLock() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg {
+		return lockTick(t)
+	})
+}
+
+// startPlan shows the pre-flight summary of plan and asks for confirmation.
+func (m *CLIModel) startPlan(s State, plan requirements.Plan) {
+	m.Plan = plan
+	m.PlanStarted = false
+	m.TextInput.SetValue("")
+	m.TextInput.Focus()
+	m.SetState(s, nil)
+}
+
 func (m *CLIModel) SetState(s State, log *common.LogData) {
 	m.State = s
+	if s == NginxManagement {
+		m.NginxBuild = nginx.Inspect()
+	}
 	if log != nil {
 		m.Logs = append(m.Logs, *log)
 	} else {
@@ -572,10 +2910,12 @@ func (m *CLIModel) View() string {
 
 	switch m.State {
 	case MainList:
+		sb.WriteString(buildDoctorBanner(m.Findings))
 		sb.WriteString(buildListItems(m.MainMenu))
 	case InstallRequirements:
-		sb.WriteString(itemStyle.Render("Install Requirements"))
+		sb.WriteString(buildPlan("Install Requirements", m.Plan, m.PlanStarted, m.TextInput.View()))
 	case NginxManagement:
+		sb.WriteString(buildNginxInfo(m.NginxBuild, nginx.LoadInstall()))
 		sb.WriteString(buildListItems(m.NginxMenu))
 	case FirewallManagement:
 		sb.WriteString(buildListItems(m.FirewallMenu))
@@ -584,17 +2924,32 @@ func (m *CLIModel) View() string {
 		sb.WriteString(buildListItems(m.CertificateMenu))
 
 	case ReinstallEverything:
-		sb.WriteString(itemStyle.Render("Reinstall Everything"))
+		sb.WriteString(buildPlan("Reinstall Everything", m.Plan, m.PlanStarted, m.TextInput.View()))
 	case UninstallAndDeleteEverything:
-		sb.WriteString(itemStyle.Render("Uninstall And Delete Everything"))
+		sb.WriteString(buildPlan("Uninstall And Delete Everything", m.Plan, m.PlanStarted, m.TextInput.View()))
 	//-----------------------------------------------------------------------------------
 	case InstallNginx:
-		sb.WriteString(itemStyle.Render("Install Nginx"))
+		sb.WriteString(simpleStyle.Render("Where should nginx be installed from?") + "\n")
+		sb.WriteString(buildListItems(m.InstallChannels))
+	case NginxVersion:
+		sb.WriteString(simpleStyle.Render("Please enter the nginx version to pin, e.g. 1.26.2 (leave empty for latest):\n"+m.TextInput.View()) + "\n")
+	case NginxModules:
+		sb.WriteString(simpleStyle.Render("Please enter extra modules to install, e.g. geoip njs (space separated, leave empty for none):\n"+m.TextInput.View()) + "\n")
 	case DeleteNginx:
-		sb.WriteString("Do you really want to uninstall nginx? (yes/y to confirm, no/n to cancel):\n" + m.TextInput.View() + "\n")
+		sb.WriteString(buildRemoval(m.Removal))
+		sb.WriteString(buildListItems(m.DeleteOptions))
+	case DeleteNginxConfirm:
+		sb.WriteString(buildRemoval(m.Removal))
+		text := "Do you really want to uninstall nginx? (yes/y to confirm, no/n to cancel):\n"
+		if m.ArchiveOnDelete {
+			text = "An archive of /etc/nginx and /etc/ssl/files will be written first.\n" + text
+		}
+		sb.WriteString(simpleStyle.Render(text+m.TextInput.View()) + "\n")
 	case ConfigName:
 		text := "Please enter a unique name for config file. Previous configs are shown below:\n"
 		existingConfigs, _ := filepath.Glob(filepath.Join(configsBasePath, "*.conf"))
+		streamConfigs, _ := filepath.Glob(filepath.Join(nginx.StreamsBasePath, "*.conf"))
+		existingConfigs = append(existingConfigs, streamConfigs...)
 		for _, cfg := range existingConfigs {
 			text += cfg + "\n"
 		}
@@ -606,13 +2961,194 @@ func (m *CLIModel) View() string {
 	case Setup:
 		sb.WriteString(buildListItems(m.Setups))
 	case Upstreams:
-		sb.WriteString(simpleStyle.Render("Please enter the list of upstream IP addresses (space separated):\n"+m.TextInput.View()) + "\n")
+		sb.WriteString(simpleStyle.Render("Please enter the list of upstream addresses (space separated), e.g. 10.0.0.1:8000 [::1]:8000 unix:/run/app.sock:\n"+m.TextInput.View()) + "\n")
+	case UpstreamEditor:
+		sb.WriteString(simpleStyle.Render("Upstream servers. Select one to set weight, max_fails, fail_timeout, max_conns, backup or down:") + "\n")
+		sb.WriteString(buildListItems(m.Servers))
+	case UpstreamServerEdit:
+		text := "Please enter the server and its options, e.g.\n"
+		text += "  10.0.0.1:8000 weight=3 max_fails=2 fail_timeout=10s max_conns=100 backup\n"
+		if m.ServerIndex >= 0 {
+			text += "Leave empty to remove this server.\n"
+		}
+		sb.WriteString(simpleStyle.Render(text+m.TextInput.View()) + "\n")
+	case Balancing:
+		sb.WriteString(simpleStyle.Render("How should requests be spread over the upstream servers?") + "\n")
+		sb.WriteString(buildListItems(m.Methods))
+	case BalanceKey:
+		sb.WriteString(simpleStyle.Render("Please enter the hash key, e.g. $request_uri, $remote_addr or $http_x_user_id:\n"+m.TextInput.View()) + "\n")
+	case ProxyTuning:
+		sb.WriteString(simpleStyle.Render("Proxy tuning preset (timeouts, keepalive, buffering, body size):") + "\n")
+		sb.WriteString(buildListItems(m.Presets))
+	case TuningEditor:
+		sb.WriteString(simpleStyle.Render("Tuning ("+m.NewConfig.Tuning.Preset+"). Select a value to change it:") + "\n")
+		sb.WriteString(buildListItems(m.Fields))
+	case TuningFieldEdit:
+		field := nginx.TuningFields[m.Fields.ListIndex]
+		sb.WriteString(simpleStyle.Render("Please enter "+field.Label+" ("+field.Hint+"):\n"+m.TextInput.View()) + "\n")
+	case DocumentRoot:
+		text := "Please pick the document root. right/l opens a directory, left/h goes up,\n"
+		text += "enter chooses the highlighted directory and c chooses the one shown below:\n"
+		text += m.FilePicker.CurrentDirectory + "\n"
+		sb.WriteString(simpleStyle.Render(text) + "\n")
+		sb.WriteString(m.FilePicker.View() + "\n")
+	case PHPSocket:
+		text := "Please select the php-fpm socket"
+		if len(m.PHPSockets.Options) == 1 {
+			text += " (none found in " + nginx.PHPSocketsPath + ", is php-fpm installed?)"
+		}
+		sb.WriteString(simpleStyle.Render(text+":") + "\n")
+		sb.WriteString(buildListItems(m.PHPSockets))
+	case AppAddress:
+		text := "Please enter the uWSGI socket or address, e.g. unix:/run/uwsgi/app.sock or 127.0.0.1:3031:\n"
+		if m.NewConfig.Setup == nginx.SetupPHP {
+			text = "Please enter the php-fpm socket or address, e.g. unix:/run/php/php8.2-fpm.sock or 127.0.0.1:9000:\n"
+		}
+		sb.WriteString(simpleStyle.Render(text+m.TextInput.View()) + "\n")
+	case StaticIndex:
+		sb.WriteString(simpleStyle.Render("Document root: "+m.NewConfig.Static.Root+"\nPlease enter the index files (space separated):\n"+m.TextInput.View()) + "\n")
+	case StaticOptions:
+		sb.WriteString(simpleStyle.Render("Static site options. Select one to switch it on or off:") + "\n")
+		sb.WriteString(buildListItems(m.Toggles))
+	case LocationEditor:
+		text := "Locations and upstream pools. Locations without pool= proxy to the servers entered before.\n"
+		text += "Select one to change it:"
+		sb.WriteString(simpleStyle.Render(text) + "\n")
+		sb.WriteString(buildListItems(m.Locations))
+	case LocationEdit:
+		text := "Please enter the location path and its options, e.g.\n"
+		text += "  /api/ pool=api strip_prefix header=X-Api-Version:2\n"
+		text += "  /ws websocket pool=realtime\n"
+		text += "  = /health add_header=Cache-Control:no-store\n"
+		text += "  ~ ^/v1/(.*)$ rewrite=^/v1/(.*)$->/v2/$1\n"
+		text += "  /static/ root=/var/www/static strip_prefix\n"
+		text += "Start with = for an exact match or ~ for a regex. Options: pool, root, strip_prefix, rewrite, websocket, header (to the upstream), add_header (to the client), limit (off or RATE[:BURST][:nodelay]), allow and deny (CIDRs separated by commas), auth (htpasswd file or off).\n"
+		if m.LocationIndex >= 0 {
+			text += "Leave empty to remove this location.\n"
+		}
+		sb.WriteString(simpleStyle.Render(text+m.TextInput.View()) + "\n")
+	case PoolEdit:
+		text := "Please enter the pool name and its servers (comma separated), e.g.\n"
+		text += "  api: 10.0.0.5:8000 weight=2, 10.0.0.6:8000\n"
+		if m.PoolIndex >= 0 {
+			text += "Leave empty to remove this pool.\n"
+		}
+		sb.WriteString(simpleStyle.Render(text+m.TextInput.View()) + "\n")
+	case StreamListen:
+		sb.WriteString(simpleStyle.Render("Please enter the port to listen on, e.g. 5432 or 5432/tcp for TCP, 53/udp for UDP:\n"+m.TextInput.View()) + "\n")
+	case StreamTimeout:
+		sb.WriteString(simpleStyle.Render("Please enter the idle session timeout, e.g. 1h for database connections (leave empty for the default 10m):\n"+m.TextInput.View()) + "\n")
+	case TLSProfileSelect, SiteTLSProfile:
+		sb.WriteString(simpleStyle.Render("TLS profile (Mozilla server side TLS guidelines):") + "\n")
+		sb.WriteString(buildListItems(m.TLSProfiles))
+	case SecurityEditor:
+		sb.WriteString(simpleStyle.Render("Security headers sent by the HTTPS server. Select one to change it:") + "\n")
+		sb.WriteString(buildListItems(m.SecurityFields))
+	case SiteSecurity:
+		text := "Security directives in " + m.Sites.Options[m.Sites.ListIndex] + ":\n"
+		if len(m.SecurityHeaders) == 0 {
+			text += "  (none)\n"
+		}
+		for _, header := range m.SecurityHeaders {
+			text += "  " + header + "\n"
+		}
+		if len(m.SecurityFields.Options) == 0 {
+			text += "Only SSL sites generated by nginx_configure can be changed here. Press b to go back."
+		} else {
+			text += "Select a value to change it, Done applies the changes:"
+		}
+		sb.WriteString(simpleStyle.Render(text) + "\n")
+		sb.WriteString(buildListItems(m.SecurityFields))
+	case ClientCASelect, SiteClientCA:
+		sb.WriteString(simpleStyle.Render("Require client certificates (mutual TLS) signed by:") + "\n")
+		sb.WriteString(buildListItems(m.ClientCAs))
+	case ClientAuthEditor:
+		sb.WriteString(simpleStyle.Render("Client certificates signed by "+m.ClientAuth.CA+". Select a value to change it:") + "\n")
+		sb.WriteString(buildListItems(m.ClientAuthFields))
+	case ClientAuthFieldEdit:
+		field := nginx.ClientAuthFields[m.ClientAuthFields.ListIndex]
+		sb.WriteString(simpleStyle.Render("Please enter "+field.Label+" ("+field.Hint+"):\n"+m.TextInput.View()) + "\n")
+	case ClientCertIssue:
+		text := "Issue a client certificate from the private CA of nginx_configure as a password protected PKCS#12 file.\n"
+		text += "Please enter the client name, optionally followed by the days it is valid (default 365), e.g. ci-runner 90:\n"
+		sb.WriteString(simpleStyle.Render(text+m.TextInput.View()) + "\n")
+	case ProtectionEditor:
+		sb.WriteString(simpleStyle.Render("Rate and connection limits per client. Select a value to change it:") + "\n")
+		sb.WriteString(buildListItems(m.ProtectionFields))
+	case ProtectionFieldEdit:
+		field := nginx.ProtectionFields[m.ProtectionFields.ListIndex]
+		sb.WriteString(simpleStyle.Render("Please enter "+field.Label+" ("+field.Hint+"):\n"+m.TextInput.View()) + "\n")
+	case AccessEditor:
+		sb.WriteString(simpleStyle.Render("Who may reach the site: addresses, basic auth and trusted proxies. Select a value to change it:") + "\n")
+		sb.WriteString(buildListItems(m.AccessFields))
+	case AccessFieldEdit:
+		field := nginx.AccessFields[m.AccessFields.ListIndex]
+		sb.WriteString(simpleStyle.Render("Please enter "+field.Label+" ("+field.Hint+"):\n"+m.TextInput.View()) + "\n")
+	case CertImport:
+		text := "Import a PEM certificate and its private key into " + CertBasePath + ", e.g. a Cloudflare Origin CA certificate.\n"
+		text += "Please enter the name, the certificate file and the key file, e.g. example /root/origin.pem /root/origin.key:\n"
+		sb.WriteString(simpleStyle.Render(text+m.TextInput.View()) + "\n")
+	case HtpasswdUser:
+		text := "Add a basic auth user with a generated bcrypt hashed password, or give an existing user a new one.\n"
+		text += "Please enter the htpasswd file and the user name, e.g. admins alice:\n"
+		sb.WriteString(simpleStyle.Render(text+m.TextInput.View()) + "\n")
+	case SecurityFieldEdit:
+		field := nginx.SecurityFields[m.SecurityFields.ListIndex]
+		sb.WriteString(simpleStyle.Render("Please enter "+field.Label+" ("+field.Hint+"):\n"+m.TextInput.View()) + "\n")
+	case TLSUpgrade:
+		sb.WriteString(simpleStyle.Render("Move every SSL site generated by nginx_configure from one TLS profile to another:") + "\n")
+		sb.WriteString(buildListItems(m.TLSUpgrades))
+	case GRPCMessageSize:
+		sb.WriteString(simpleStyle.Render("Please enter the largest gRPC message (request body) to accept, e.g. 64m, 0 for no limit:\n"+m.TextInput.View()) + "\n")
+	case GRPCBackend:
+		sb.WriteString(simpleStyle.Render("How does nginx talk to the gRPC backend?") + "\n")
+		sb.WriteString(buildListItems(m.GRPCBackends))
+	case GRPCH2C:
+		text := "gRPC clients expect HTTP/2, which browsers and most clients only negotiate over TLS.\n"
+		text += "Without SSL nginx serves cleartext HTTP/2 (h2c) and clients must be configured for it explicitly.\n"
+		text += "Continue without SSL? (yes/y to confirm, no/n to choose again):\n"
+		sb.WriteString(simpleStyle.Render(text+m.TextInput.View()) + "\n")
 	case CType:
+		if m.NewConfig.Setup == nginx.SetupGRPC {
+			sb.WriteString(simpleStyle.Render("gRPC is served over HTTP/2 with SSL. No SSL needs h2c to be acknowledged.") + "\n")
+		}
 		sb.WriteString(buildListItems(m.CTypes))
 	case SelectCert:
 		sb.WriteString(buildCertListItems(m.Certs))
 	case Domains:
+		text := "Server names of the site. Select a name to choose it or leave it out,\n"
+		text += "*.example.com covers api.example.com but not example.com:"
+		sb.WriteString(simpleStyle.Render(text) + "\n")
 		sb.WriteString(buildListItems(m.Domains))
+	case DomainAdd:
+		sb.WriteString(simpleStyle.Render("Please enter extra server names (space separated), e.g. api.example.com *.example.org:\n"+m.TextInput.View()) + "\n")
+	case CertEditor:
+		text := "Main certificate: " + m.NewConfig.CertName + ". Extra certificates are served next to it,\n"
+		text += "or for some names in a server block of their own:"
+		sb.WriteString(simpleStyle.Render(text) + "\n")
+		sb.WriteString(buildListItems(m.CertEntries))
+	case ExtraCertNames:
+		text := "Server names of the site: " + strings.Join(nginx.SiteDomains(m.NewConfig.Site), " ") + "\n"
+		text += "Please enter the names served with the extra certificate (space separated):\n"
+		sb.WriteString(simpleStyle.Render(text+m.TextInput.View()) + "\n")
+	case SelectExtraCert:
+		text := "Certificates covering every server name of the site:"
+		if len(m.ExtraCertFor) > 0 {
+			text = "Certificates covering " + strings.Join(m.ExtraCertFor, " ") + ":"
+		}
+		sb.WriteString(simpleStyle.Render(text) + "\n")
+		sb.WriteString(buildCertListItems(m.ExtraCerts))
+	case RedirectOptions:
+		text := "HTTP requests are redirected to https://<host>"
+		if m.NewConfig.HttpsPort != "443" {
+			text += ":" + m.NewConfig.HttpsPort
+		}
+		text += ". Select an option to change it:"
+		sb.WriteString(simpleStyle.Render(text) + "\n")
+		sb.WriteString(buildListItems(m.Redirects))
+	case CanonicalRedirect:
+		sb.WriteString(simpleStyle.Render("Both the www and the apex name are chosen. Redirect one to the other?") + "\n")
+		sb.WriteString(buildListItems(m.Canonicals))
 	case ServerIp:
 		sb.WriteString(simpleStyle.Render("Please enter the ip of this server:\n"+m.TextInput.View()) + "\n")
 	case HttpPort:
@@ -620,7 +3156,42 @@ func (m *CLIModel) View() string {
 	case HttpsPort:
 		sb.WriteString(simpleStyle.Render("Please enter https port (443 is default):\n"+m.TextInput.View()) + "\n")
 	case ManageConfigs:
-		sb.WriteString(itemStyle.Render("Manage Configs"))
+		if len(m.Sites.Options) == 0 {
+			sb.WriteString(simpleStyle.Render("No configs found in "+configsBasePath) + "\n")
+			break
+		}
+		sb.WriteString(simpleStyle.Render("Please select a config:") + "\n")
+		sb.WriteString(buildListItems(m.Sites))
+	case SiteActions:
+		sb.WriteString(simpleStyle.Render(m.Sites.Options[m.Sites.ListIndex]+":") + "\n")
+		sb.WriteString(buildListItems(m.SiteMenu))
+	case SiteUpstreams:
+		sb.WriteString(simpleStyle.Render("Upstream servers of "+m.Sites.Options[m.Sites.ListIndex]+". Changes are applied with a graceful reload:") + "\n")
+		sb.WriteString(buildListItems(m.SiteServers))
+	case UpstreamServerAction:
+		b, s, _ := m.selectedSiteServer()
+		sb.WriteString(simpleStyle.Render(m.SiteBlocks[b].Name+": "+nginx.FormatUpstreamServer(m.SiteBlocks[b].Servers[s])) + "\n")
+		sb.WriteString(buildListItems(m.ServerActions))
+	case UpstreamHealth:
+		sb.WriteString(buildHealth(m.Sites.Options[m.Sites.ListIndex], m.HealthCheck, m.HealthResults, m.HealthWatch))
+		sb.WriteString(buildListItems(m.HealthOptions))
+	case HealthCheckEdit:
+		sb.WriteString(simpleStyle.Render("Please enter the path to request and the expected status, e.g. /healthz 200 (leave the status out to accept any 2xx or 3xx, leave empty for a TCP check only):\n"+m.TextInput.View()) + "\n")
+	case UpstreamServerAdd:
+		text := "Please enter the server to add and its options, e.g.\n"
+		text += "  10.0.0.1:8000 weight=3 max_fails=2 fail_timeout=10s\n"
+		sb.WriteString(simpleStyle.Render(text+m.TextInput.View()) + "\n")
+	case DpkgLock:
+		sb.WriteString(buildLockWait(m.LockHolders, m.LockWaitStart))
+		sb.WriteString(buildListItems(m.LockOptions))
+	case DpkgLockStop:
+		sb.WriteString(buildLockWait(m.LockHolders, m.LockWaitStart))
+		if len(m.LockHolders) == 0 {
+			break
+		}
+		text := "The process will be asked to exit cleanly (unattended-upgrades is stopped through systemd, others get SIGTERM),\n"
+		text += "then dpkg --configure -a is run. Stop " + m.LockHolders[0].String() + "? (yes/y to confirm, no/n to cancel):\n"
+		sb.WriteString(simpleStyle.Render(text+m.TextInput.View()) + "\n")
 
 	}
 
@@ -648,6 +3219,131 @@ func buildListItems(menu ListModel) string {
 	return sb.String()
 }
 
+func buildHealth(site string, check model.HealthCheck, results []health.Result, watching bool) string {
+	probe := "TCP connect"
+	if check.Path != "" {
+		probe += ", then GET " + check.Path
+		if check.Status != 0 {
+			probe += " expecting " + strconv.Itoa(check.Status)
+		}
+	}
+	text := "Upstream health of " + site + " (" + probe + ")"
+	if watching {
+		text += ", refreshing every " + healthWatchInterval.String()
+	}
+	var sb strings.Builder
+	sb.WriteString(simpleStyle.Render(text) + "\n\n")
+	if results == nil {
+		sb.WriteString(simpleStyle.Render("Probing...") + "\n\n")
+		return sb.String()
+	}
+	for i, line := range strings.Split(strings.TrimSuffix(health.Table(results), "\n"), "\n") {
+		style := simpleStyle
+		if i > 0 {
+			switch results[i-1].State {
+			case health.Up:
+				style = style.Foreground(lipgloss.Color(common.Green))
+			case health.Down:
+				style = style.Foreground(lipgloss.Color(common.Red))
+			default:
+				style = style.Foreground(lipgloss.Color(common.Gold))
+			}
+		}
+		sb.WriteString(style.Render(line) + "\n")
+	}
+	return sb.String() + "\n"
+}
+
+func buildNginxInfo(info nginx.BuildInfo, install model.Install) string {
+	if info.Version == "" {
+		return simpleStyle.Render("Nginx is not installed.") + "\n\n"
+	}
+
+	text := "Nginx " + info.Version + " (" + install.Channel
+	if install.Version != "" {
+		text += ", pinned " + install.Version
+	}
+	text += ")\n"
+	if info.OpenSSL != "" {
+		text += "Built with " + info.OpenSSL + "\n"
+	}
+	if len(info.Modules) > 0 {
+		text += "Modules: " + strings.Join(info.Modules, ", ") + "\n"
+	}
+	return information.Render(simpleStyle.Render(text)) + "\n"
+}
+
+func buildLockWait(holders []dpkg.Holder, start time.Time) string {
+	elapsed := time.Since(start).Round(time.Second)
+	text := "The package manager is busy:\n"
+	for _, h := range holders {
+		text += "  " + h.String() + "\n"
+	}
+	if elapsed > dpkg.WaitTimeout {
+		text += "Timed out after " + dpkg.WaitTimeout.String() + " of waiting.\n"
+	} else {
+		text += "Waiting for the lock... " + elapsed.String() + " of " + dpkg.WaitTimeout.String() + "\n"
+	}
+	return simpleStyle.Render(text) + "\n"
+}
+
+func buildDoctorBanner(findings []doctor.Finding) string {
+	if findings == nil {
+		return simpleStyle.Render("Checking this host...") + "\n\n"
+	}
+	problems := doctor.Problems(findings)
+	if len(problems) == 0 {
+		return simpleStyle.Foreground(lipgloss.Color(common.Green)).Render("Host checks passed.") + "\n\n"
+	}
+
+	var sb strings.Builder
+	for _, f := range problems {
+		color := common.Gold
+		if f.Status == doctor.Fail {
+			color = common.Red
+		}
+		sb.WriteString(simpleStyle.Foreground(lipgloss.Color(color)).Render("["+f.Status.String()+"] "+f.Check+": "+f.Detail) + "\n")
+		if f.Fix != "" {
+			sb.WriteString(simpleStyle.Render("    fix: "+f.Fix) + "\n")
+		}
+	}
+	sb.WriteString(simpleStyle.Render("Run `nginx_configure doctor` for the full report.") + "\n\n")
+	return sb.String()
+}
+
+func buildPlan(title string, plan requirements.Plan, started bool, input string) string {
+	if started {
+		return "\n" + simpleStyle.Render("Press ctrl+b to go back.") + "\n"
+	}
+
+	text := title + "\n\n"
+	for _, line := range plan.Summary {
+		text += "- " + line + "\n"
+	}
+	text += "\nDo you want to continue? (yes/y to confirm, no/n to cancel):\n" + input
+	return simpleStyle.Render(text) + "\n"
+}
+
+func buildRemoval(removal nginx.Removal) string {
+	section := func(title string, items []string) string {
+		text := title + "\n"
+		if len(items) == 0 {
+			return text + "  (none)\n"
+		}
+		for _, item := range items {
+			text += "  " + item + "\n"
+		}
+		return text
+	}
+
+	text := "The following will be removed:\n"
+	text += section("Packages:", removal.Packages)
+	text += section("Generated sites:", removal.Sites)
+	text += section("Config files:", removal.ConfigFiles)
+	text += section("Certificates referenced by the configs (kept, and included in the archive when archiving):", removal.Certificates)
+	return simpleStyle.Render(text) + "\n"
+}
+
 func buildCertListItems(menu CertListModel) string {
 
 	keys := common.ExtractKeys(menu.Options)